@@ -0,0 +1,283 @@
+// Package fake is an in-memory cloud provider for end to end tests without a
+// real cloud. The nodes that need updating are declared in a configmap or a
+// file, and terminating a node deletes its Node object once the termination
+// operation is waited for.
+package fake
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// Source declares the outdated nodes, reason keyed by node name
+type Source interface {
+	Outdated() (map[string]string, error)
+}
+
+// ConfigMapSource reads outdated nodes from the data of a configmap
+type ConfigMapSource struct {
+	kc        kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func NewConfigMapSource(kc kubernetes.Interface, namespace, name string) *ConfigMapSource {
+	return &ConfigMapSource{kc: kc, namespace: namespace, name: name}
+}
+
+func (s *ConfigMapSource) Outdated() (map[string]string, error) {
+	cm, err := s.kc.CoreV1().ConfigMaps(s.namespace).Get(s.name, v1meta.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	return cm.Data, nil
+}
+
+// FileSource reads outdated nodes from a json object file
+type FileSource struct {
+	path string
+}
+
+func NewFileSource(path string) *FileSource {
+	return &FileSource{path: path}
+}
+
+func (s *FileSource) Outdated() (map[string]string, error) {
+	raw, err := ioutil.ReadFile(s.path)
+	if err != nil {
+		return nil, err
+	}
+	outdated := map[string]string{}
+	if err := json.Unmarshal(raw, &outdated); err != nil {
+		return nil, fmt.Errorf("invalid fake source file %s: %v", s.path, err)
+	}
+	return outdated, nil
+}
+
+// NewSource returns the source declared by either a namespace/name configmap
+// or a file path
+func NewSource(kc kubernetes.Interface, configMap, file string) (Source, error) {
+	switch {
+	case configMap != "" && file != "":
+		return nil, fmt.Errorf("only one of a configmap and a file can be set")
+	case configMap != "":
+		parts := strings.Split(configMap, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid configmap %q, expected namespace/name", configMap)
+		}
+		return NewConfigMapSource(kc, parts[0], parts[1]), nil
+	case file != "":
+		return NewFileSource(file), nil
+	}
+	return nil, fmt.Errorf("a configmap or a file must be set")
+}
+
+// Provider simulates the instances behind the nodes of a cluster. It
+// implements models.CloudProviderInterface and models.FleetProviderInterface,
+// and models.NodeClientInterface through Node.
+type Provider struct {
+	kc     kubernetes.Interface
+	source Source
+	// Recreate registers a fresh Node object under the same name after
+	// deleting one, as a group manager recreating the instance would
+	Recreate bool
+
+	mu sync.Mutex
+	// operations in progress, node name keyed by operation
+	operations map[string]string
+	issued     int
+}
+
+// ReplacedAnnotation marks the Node objects registered by the provider in
+// place of a terminated node. They are up to date whatever the source says.
+const ReplacedAnnotation = "fake.node-cycle/replaced"
+
+func New(kc kubernetes.Interface, source Source) *Provider {
+	return &Provider{
+		kc:         kc,
+		source:     source,
+		operations: map[string]string{},
+	}
+}
+
+// Node returns the client of a single node, as used by its agent
+func (p *Provider) Node(name string) *NodeClient {
+	return &NodeClient{p: p, node: name}
+}
+
+// outdated returns the declared outdated nodes, less the replaced ones
+func (p *Provider) outdated() (map[string]string, error) {
+	outdated, err := p.source.Outdated()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := p.kc.CoreV1().Nodes().List(v1meta.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for _, n := range nodes.Items {
+		if n.Annotations[ReplacedAnnotation] != "" {
+			delete(outdated, n.Name)
+		}
+	}
+	return outdated, nil
+}
+
+// terminate starts the termination of the instance of node. The instance
+// only goes away when the returned operation is waited for, as a cloud
+// operation takes a while and the agent records it meanwhile.
+func (p *Provider) terminate(node string) (string, error) {
+	if _, err := p.kc.CoreV1().Nodes().Get(node, v1meta.GetOptions{}); err != nil {
+		return "", err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.issued++
+	operation := fmt.Sprintf("fake/terminate/%s/%d", node, p.issued)
+	p.operations[operation] = node
+	log.Println(fmt.Sprintf("[INFO] fake: terminating instance of node %s, operation: %s", node, operation))
+	return operation, nil
+}
+
+// complete finishes a termination operation: the Node object is deleted and
+// a new one registered if Recreate is set. Operations already complete, or
+// issued by a previous provider, are done.
+func (p *Provider) complete(operation string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	node, ok := p.operations[operation]
+	if !ok {
+		return nil
+	}
+
+	nc := p.kc.CoreV1().Nodes()
+	n, err := nc.Get(node, v1meta.GetOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err == nil {
+		if err := nc.Delete(node, &v1meta.DeleteOptions{}); err != nil {
+			return err
+		}
+		log.Println("[INFO] fake: instance terminated for node", node)
+		if p.Recreate {
+			if _, err := nc.Create(replacement(n)); err != nil {
+				return err
+			}
+		}
+	}
+	delete(p.operations, operation)
+	return nil
+}
+
+// replacement returns a fresh Ready Node object in place of n
+func replacement(n *v1.Node) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: v1meta.ObjectMeta{
+			Name:              n.Name,
+			Labels:            n.Labels,
+			Annotations:       map[string]string{ReplacedAnnotation: "true"},
+			CreationTimestamp: v1meta.NewTime(time.Now()),
+		},
+		Spec: v1.NodeSpec{ProviderID: n.Spec.ProviderID},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{
+				Type:               v1.NodeReady,
+				Status:             v1.ConditionTrue,
+				LastTransitionTime: v1meta.NewTime(time.Now()),
+			}},
+		},
+	}
+}
+
+// nodeByProviderID finds the Node object behind a providerID
+func (p *Provider) nodeByProviderID(providerID string) (*v1.Node, error) {
+	nodes, err := p.kc.CoreV1().Nodes().List(v1meta.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range nodes.Items {
+		if n.Spec.ProviderID == providerID {
+			return &nodes.Items[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// InstanceExists tells whether a node with the providerID is registered
+func (p *Provider) InstanceExists(ctx context.Context, providerID string) (bool, error) {
+	n, err := p.nodeByProviderID(providerID)
+	return n != nil, err
+}
+
+// OutdatedInstances maps the outdated nodes to their providerID
+func (p *Provider) OutdatedInstances(ctx context.Context) (map[string]string, error) {
+	outdated, err := p.outdated()
+	if err != nil {
+		return nil, err
+	}
+	nodes, err := p.kc.CoreV1().Nodes().List(v1meta.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	instances := map[string]string{}
+	for _, n := range nodes.Items {
+		if reason, ok := outdated[n.Name]; ok && n.Spec.ProviderID != "" {
+			instances[n.Spec.ProviderID] = reason
+		}
+	}
+	return instances, nil
+}
+
+func (p *Provider) RecreateInstance(ctx context.Context, providerID string) (string, error) {
+	n, err := p.nodeByProviderID(providerID)
+	if err != nil {
+		return "", err
+	}
+	if n == nil {
+		return "", fmt.Errorf("no node with providerID %s", providerID)
+	}
+	return p.terminate(n.Name)
+}
+
+// OperationDone completes the operation at once
+func (p *Provider) OperationDone(ctx context.Context, operation string) (bool, error) {
+	if err := p.complete(operation); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// NodeClient is the fake provider as seen by the agent of a node
+type NodeClient struct {
+	p    *Provider
+	node string
+}
+
+func (c *NodeClient) NeedsUpdate(ctx context.Context) (bool, string, error) {
+	outdated, err := c.p.outdated()
+	if err != nil {
+		return false, "", err
+	}
+	reason, ok := outdated[c.node]
+	return ok, reason, nil
+}
+
+func (c *NodeClient) TerminateNode(ctx context.Context) (string, error) {
+	return c.p.terminate(c.node)
+}
+
+func (c *NodeClient) WaitForTermination(ctx context.Context, operation string) error {
+	return c.p.complete(operation)
+}
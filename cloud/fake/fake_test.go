@@ -0,0 +1,86 @@
+package fake
+
+import (
+	"context"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type staticSource map[string]string
+
+func (s staticSource) Outdated() (map[string]string, error) {
+	outdated := map[string]string{}
+	for k, v := range s {
+		outdated[k] = v
+	}
+	return outdated, nil
+}
+
+func node(name string) *v1.Node {
+	return &v1.Node{
+		ObjectMeta: v1meta.ObjectMeta{Name: name, UID: "uid-1"},
+		Spec:       v1.NodeSpec{ProviderID: "fake://" + name},
+	}
+}
+
+func TestTerminateDeletesNode(t *testing.T) {
+	kc := fake.NewSimpleClientset(node("node-1"), node("node-2"))
+	p := New(kc, staticSource{"node-1": "new template"})
+	ctx := context.Background()
+
+	needsUpdate, reason, err := p.Node("node-1").NeedsUpdate(ctx)
+	if err != nil || !needsUpdate || reason != "new template" {
+		t.Fatalf("expected node-1 to need updating, got %t %q %v", needsUpdate, reason, err)
+	}
+	if needsUpdate, _, _ := p.Node("node-2").NeedsUpdate(ctx); needsUpdate {
+		t.Errorf("expected node-2 not to need updating")
+	}
+
+	operation, err := p.Node("node-1").TerminateNode(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	// The agent records the operation before waiting for it
+	if exists, _ := p.InstanceExists(ctx, "fake://node-1"); !exists {
+		t.Errorf("expected node-1 to remain until the operation is waited for")
+	}
+	if err := p.Node("node-1").WaitForTermination(ctx, operation); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if exists, _ := p.InstanceExists(ctx, "fake://node-1"); exists {
+		t.Errorf("expected node-1 to be deleted")
+	}
+}
+
+func TestRecreate(t *testing.T) {
+	kc := fake.NewSimpleClientset(node("node-1"))
+	p := New(kc, staticSource{"node-1": "new template"})
+	p.Recreate = true
+	ctx := context.Background()
+
+	outdated, err := p.OutdatedInstances(ctx)
+	if err != nil || outdated["fake://node-1"] != "new template" {
+		t.Fatalf("expected node-1 to be outdated, got %v %v", outdated, err)
+	}
+	operation, err := p.RecreateInstance(ctx, "fake://node-1")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if done, err := p.OperationDone(ctx, operation); err != nil || !done {
+		t.Fatalf("expected the operation done, got %t %v", done, err)
+	}
+	// Following the operation again leaves the replacement alone
+	if _, err := p.OperationDone(ctx, operation); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if exists, _ := p.InstanceExists(ctx, "fake://node-1"); !exists {
+		t.Errorf("expected node-1 to be registered again")
+	}
+	if outdated, _ := p.OutdatedInstances(ctx); len(outdated) != 0 {
+		t.Errorf("expected recreated node not to be outdated, got %v", outdated)
+	}
+}
@@ -1,28 +1,41 @@
 package client
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"strings"
 
 	"github.com/pkg/errors"
-	"golang.org/x/net/context"
 	"golang.org/x/oauth2/google"
 	compute "google.golang.org/api/compute/v1"
 	"google.golang.org/api/googleapi"
+	"k8s.io/apimachinery/pkg/util/uuid"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
 )
 
+// GCPClient calls the compute api. Every call is bounded by Retry.Timeout and
+// retried on rate limiting and server errors, other errors are returned as
+// models.PermanentError.
 type GCPClient struct {
 	Project        string
 	ComputeService compute.Service
-	Ctx            context.Context
+	Retry          Retry
+	// Templates is where NeedsUpdate looks group templates up. Defaults to
+	// the api, cached for DefaultTemplateTTL
+	Templates GroupTemplates
 }
 
 type GCPClientInterface interface {
-	GetInstanceCreator(instance, zone string) (string, error)
-	GetInstanceTemplateName(instance, zone string) (string, error)
-	IsTemplateAvailable(instanceTemplate string) (bool, error)
-	NeedsUpdate(nodeName string) (bool, error)
-	TerminateInstance(instance, zone string) error
+	GetInstanceCreator(ctx context.Context, instance, zone string) (string, error)
+	GetInstanceTemplateName(ctx context.Context, instance, zone string) (string, error)
+	IsTemplateAvailable(ctx context.Context, instanceTemplate string) (bool, error)
+	InstanceExists(ctx context.Context, providerID string) (bool, error)
+	NeedsUpdate(ctx context.Context, nodeName, region, zone string) (bool, string, error)
+	TerminateInstance(ctx context.Context, instance, region, zone string) (string, error)
+	OperationDone(ctx context.Context, operation string) (bool, error)
+	WaitForOperation(ctx context.Context, operation string) error
 }
 
 // In case of a gcp link it returns the target (final part after /)
@@ -51,94 +64,143 @@ func NewGCPClient(project string) (*GCPClient, error) {
 	gc := &GCPClient{
 		Project:        project,
 		ComputeService: *computeService,
-		Ctx:            ctx,
+		Retry:          DefaultRetry,
 	}
+	gc.Templates = NewTemplateCache(gc, DefaultTemplateTTL)
 
 	return gc, nil
 }
 
-func (gc *GCPClient) GetInstanceCreator(instance, zone string) (string, error) {
+// getInstance fetches an instance object from the api
+func (gc *GCPClient) getInstance(ctx context.Context, instance, zone string) (*compute.Instance, error) {
+	var inst *compute.Instance
+	err := gc.Retry.call(ctx, func(ctx context.Context) error {
+		var err error
+		inst, err = gc.ComputeService.Instances.Get(gc.Project, formatLinkString(zone), instance).Context(ctx).Do()
+		return err
+	})
+	return inst, err
+}
+
+func (gc *GCPClient) GetInstanceCreator(ctx context.Context, instance, zone string) (string, error) {
 	// Get instance object from the api
-	zone = formatLinkString(zone)
-	resp, err := gc.ComputeService.Instances.Get(gc.Project, zone, instance).Context(gc.Ctx).Do()
+	resp, err := gc.getInstance(ctx, instance, zone)
 	if err != nil {
 		return "", err
 	}
+	return creatorOf(resp)
+}
 
-	meta := resp.Metadata
+func (gc *GCPClient) GetInstanceTemplateName(ctx context.Context, instance, zone string) (string, error) {
+	// Get instance object from the api
+	resp, err := gc.getInstance(ctx, instance, zone)
+	if err != nil {
+		return "", err
+	}
+	return templateOf(resp)
+}
 
+// creatorOf reads the group manager that created an instance from its metadata
+func creatorOf(inst *compute.Instance) (string, error) {
 	var instanceCreator string
-	for _, m := range meta.Items {
+	for _, m := range inst.Metadata.Items {
 		if m.Key == "created-by" {
 			instanceCreator = *m.Value
 		}
 	}
 
 	if instanceCreator == "" {
-		return "", errors.New("No instance creator found")
+		return "", &models.PermanentError{Err: errors.New("No instance creator found")}
 	}
 	return instanceCreator, nil
 }
 
-func (gc *GCPClient) GetInstanceTemplateName(instance, zone string) (string, error) {
-	// Get instance object from the api
-	zone = formatLinkString(zone)
-	resp, err := gc.ComputeService.Instances.Get(gc.Project, zone, instance).Context(gc.Ctx).Do()
-	if err != nil {
-		return "", err
-	}
-
-	meta := resp.Metadata
-
-	// Determine instance template
+// templateOf reads the template of an instance from its metadata
+func templateOf(inst *compute.Instance) (string, error) {
 	var instanceTemplate string
-	for _, m := range meta.Items {
+	for _, m := range inst.Metadata.Items {
 		if m.Key == "instance-template" {
 			instanceTemplate = *m.Value
 		}
 	}
 	if instanceTemplate == "" {
-		return "", errors.New("No instance template found")
+		return "", &models.PermanentError{Err: errors.New("No instance template found")}
 	}
 	return instanceTemplate, nil
 }
 
-func (gc *GCPClient) IsTemplateAvailable(instanceTemplate string) (bool, error) {
+func (gc *GCPClient) IsTemplateAvailable(ctx context.Context, instanceTemplate string) (bool, error) {
 	instanceTemplate = formatLinkString(instanceTemplate)
-	_, err := gc.ComputeService.InstanceTemplates.Get(gc.Project, instanceTemplate).Context(gc.Ctx).Do()
-	if err != nil {
-		ae, ok := err.(*googleapi.Error)
-		if ok && ae.Code == 404 {
-			return false, nil
-		} else {
-			return false, err
+	available := true
+	err := gc.Retry.call(ctx, func(ctx context.Context) error {
+		_, err := gc.ComputeService.InstanceTemplates.Get(gc.Project, instanceTemplate).Context(ctx).Do()
+		if isNotFound(err) {
+			available = false
+			return nil
 		}
+		return err
+	})
+	if err != nil {
+		return false, err
 	}
-	return true, nil
+	return available, nil
 }
 
-func (gc *GCPClient) NeedsUpdate(nodeName, region, zone string) (bool, error) {
-	instanceTemplate, err := gc.GetInstanceTemplateName(nodeName, zone)
+// InstanceExists looks up the instance behind a kubernetes node providerID
+func (gc *GCPClient) InstanceExists(ctx context.Context, providerID string) (bool, error) {
+	project, zone, instance, err := ParseProviderID(providerID)
+	if err != nil {
+		return false, &models.PermanentError{Err: err}
+	}
+	exists := true
+	err = gc.Retry.call(ctx, func(ctx context.Context) error {
+		_, err := gc.ComputeService.Instances.Get(project, zone, instance).Context(ctx).Do()
+		if isNotFound(err) {
+			exists = false
+			return nil
+		}
+		return err
+	})
 	if err != nil {
 		return false, err
 	}
+	return exists, nil
+}
+
+func isNotFound(err error) bool {
+	ae, ok := err.(*googleapi.Error)
+	return ok && ae.Code == 404
+}
 
-	instanceCreator, err := gc.GetInstanceCreator(nodeName, zone)
+// NeedsUpdate compares the instance template with the one its group manager is
+// using and returns a human readable reason when they differ. The instance is
+// fetched once and the group template comes from gc.Templates.
+func (gc *GCPClient) NeedsUpdate(ctx context.Context, nodeName, region, zone string) (bool, string, error) {
+	inst, err := gc.getInstance(ctx, nodeName, zone)
 	if err != nil {
-		return false, err
+		return false, "", err
+	}
+	instanceTemplate, err := templateOf(inst)
+	if err != nil {
+		return false, "", err
+	}
+	instanceCreator, err := creatorOf(inst)
+	if err != nil {
+		return false, "", err
 	}
 
 	// Let's just assume that the instance was crated by a Regional Group Manager else fail
-	groupManager, err := gc.ComputeService.RegionInstanceGroupManagers.Get(gc.Project, region, formatLinkString(instanceCreator)).Context(gc.Ctx).Do()
+	groupTemplate, err := gc.Templates.GroupTemplate(ctx, region, formatLinkString(instanceCreator))
 	if err != nil {
-		return false, err
+		return false, "", err
 	}
 
-	if formatLinkString(groupManager.InstanceTemplate) == formatLinkString(instanceTemplate) {
-		return false, nil
+	if groupTemplate == formatLinkString(instanceTemplate) {
+		return false, "", nil
 	} else {
-		log.Println("Update needed for template difference", formatLinkString(groupManager.InstanceTemplate), formatLinkString(instanceTemplate))
-		return true, nil
+		log.Println("Update needed for template difference", groupTemplate, formatLinkString(instanceTemplate))
+		reason := fmt.Sprintf("instance template %s differs from group template %s", formatLinkString(instanceTemplate), groupTemplate)
+		return true, reason, nil
 	}
 
 }
@@ -146,25 +208,34 @@ func (gc *GCPClient) NeedsUpdate(nodeName, region, zone string) (bool, error) {
 // Terminate instance won't be enough
 // Instance needs to be recreated from instance group in order to get the new template
 // $ gcloud compute instance-groups managed recreate-instances NAME --instances=INSTANCE
-func (gc *GCPClient) TerminateInstance(instance, region, zone string) error {
-	zone = formatLinkString(zone)
-	inst, err := gc.ComputeService.Instances.Get(gc.Project, zone, instance).Context(gc.Ctx).Do()
+// It returns the self link of the recreate operation.
+func (gc *GCPClient) TerminateInstance(ctx context.Context, instance, region, zone string) (string, error) {
+	inst, err := gc.getInstance(ctx, instance, zone)
 	if err != nil {
-		return err
+		return "", err
 	}
 	rb := &compute.RegionInstanceGroupManagersRecreateRequest{
 		Instances: []string{inst.SelfLink},
 	}
 
-	instanceCreator, err := gc.GetInstanceCreator(instance, zone)
+	instanceCreator, err := creatorOf(inst)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	_, err = gc.ComputeService.RegionInstanceGroupManagers.RecreateInstances(gc.Project, region, formatLinkString(instanceCreator), rb).Context(gc.Ctx).Do()
-	if err != nil {
+	group := formatLinkString(instanceCreator)
+	// RecreateInstances is not idempotent: every attempt carries the same
+	// request id so that compute answers a retry of an attempt that went
+	// through with its operation rather than recreating the instance twice
+	requestID := string(uuid.NewUUID())
+	var op *compute.Operation
+	err = gc.Retry.call(ctx, func(ctx context.Context) error {
+		op, err = gc.ComputeService.RegionInstanceGroupManagers.RecreateInstances(gc.Project, region, group, rb).RequestId(requestID).Context(ctx).Do()
 		return err
+	})
+	if err != nil {
+		return "", err
 	}
-	return nil
+	return op.SelfLink, nil
 
 }
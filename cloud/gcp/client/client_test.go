@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+const testGroup = "projects/uw-dev/regions/europe-west2/instanceGroupManagers/workers"
+
+// testCompute serves the instance and recreate calls of a TerminateInstance.
+// Recreate requests fail with the status codes in fail, in turn: 429 and 503
+// before being applied, other codes after. As compute does, a request with
+// the id of one already applied returns its operation.
+type testCompute struct {
+	fail       []int
+	recreated  int
+	operations map[string]*compute.Operation
+}
+
+func (c *testCompute) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/zones/europe-west2-a/instances/worker-1"):
+		value := testGroup
+		json.NewEncoder(w).Encode(&compute.Instance{
+			Name:     "worker-1",
+			SelfLink: "https://www.googleapis.com/compute/v1/projects/uw-dev/zones/europe-west2-a/instances/worker-1",
+			Metadata: &compute.Metadata{Items: []*compute.MetadataItems{{Key: "created-by", Value: &value}}},
+		})
+	case strings.HasSuffix(r.URL.Path, "/instanceGroupManagers/workers/recreateInstances"):
+		code := http.StatusOK
+		if len(c.fail) > 0 {
+			code, c.fail = c.fail[0], c.fail[1:]
+		}
+		if code == http.StatusTooManyRequests || code == http.StatusServiceUnavailable {
+			w.WriteHeader(code)
+			return
+		}
+		requestID := r.URL.Query().Get("requestId")
+		op, ok := c.operations[requestID]
+		if !ok || requestID == "" {
+			c.recreated++
+			name := fmt.Sprintf("operation-%d", c.recreated)
+			op = &compute.Operation{
+				Name:     name,
+				SelfLink: "https://www.googleapis.com/compute/v1/projects/uw-dev/regions/europe-west2/operations/" + name,
+			}
+			c.operations[requestID] = op
+		}
+		if code != http.StatusOK {
+			// The request went through but the response is lost
+			w.WriteHeader(code)
+			return
+		}
+		json.NewEncoder(w).Encode(op)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func TestTerminateInstanceRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		fail      []int
+		recreated int
+		operation string
+	}{
+		{"no error", nil, 1, "operation-1"},
+		{"rate limited", []int{429, 429}, 1, "operation-1"},
+		{"server error", []int{503}, 1, "operation-1"},
+		// A timed out request may have been applied, its retry gets the
+		// operation of the first attempt
+		{"response lost", []int{504, 504}, 1, "operation-1"},
+	}
+
+	for _, test := range tests {
+		cs := &testCompute{fail: test.fail, operations: map[string]*compute.Operation{}}
+		srv := httptest.NewServer(cs)
+		svc, err := compute.New(srv.Client())
+		if err != nil {
+			t.Fatal(err)
+		}
+		svc.BasePath = srv.URL + "/"
+		gc := &GCPClient{Project: "uw-dev", ComputeService: *svc, Retry: testRetry}
+
+		operation, err := gc.TerminateInstance(context.Background(), "worker-1", "europe-west2", "europe-west2-a")
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			srv.Close()
+			continue
+		}
+		if cs.recreated != test.recreated {
+			t.Errorf("%s: expected %d recreate requests applied, got %d", test.name, test.recreated, cs.recreated)
+		}
+		if formatLinkString(operation) != test.operation {
+			t.Errorf("%s: expected operation %s, got %s", test.name, test.operation, operation)
+		}
+
+		// Another termination is a new request, not a retry
+		if _, err := gc.TerminateInstance(context.Background(), "worker-1", "europe-west2", "europe-west2-a"); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if cs.recreated != test.recreated+1 {
+			t.Errorf("%s: expected a second termination to be applied, got %d requests applied", test.name, cs.recreated)
+		}
+		srv.Close()
+	}
+}
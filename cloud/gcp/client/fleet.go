@@ -0,0 +1,93 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
+)
+
+// GCPFleet detects and recreates outdated instances of the regional group
+// managers of a region on behalf of the operator
+type GCPFleet struct {
+	gc     *GCPClient
+	Region string
+}
+
+func NewFleet(gc *GCPClient, region string) *GCPFleet {
+	return &GCPFleet{
+		gc:     gc,
+		Region: region,
+	}
+}
+
+// OutdatedInstances lists every group manager of the region and every
+// instance of the project, one call each, and returns the instances whose
+// template differs from their group's keyed by providerID
+func (f *GCPFleet) OutdatedInstances(ctx context.Context) (map[string]string, error) {
+	groupTemplates, err := f.gc.ListGroupTemplates(ctx, f.Region)
+	if err != nil {
+		return nil, err
+	}
+
+	var outdated map[string]string
+	err = f.gc.Retry.call(ctx, func(ctx context.Context) error {
+		outdated = map[string]string{}
+		return f.gc.ComputeService.Instances.AggregatedList(f.gc.Project).Pages(ctx, func(page *compute.InstanceAggregatedList) error {
+			for _, scoped := range page.Items {
+				for _, inst := range scoped.Instances {
+					if reason, ok := f.outdated(inst, groupTemplates); ok {
+						outdated[f.providerID(inst)] = reason
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return outdated, nil
+}
+
+// outdated compares the template of an instance with the one of the group
+// manager of the region that created it. Other instances are ignored.
+func (f *GCPFleet) outdated(inst *compute.Instance, groupTemplates map[string]string) (string, bool) {
+	if inst.Metadata == nil {
+		return "", false
+	}
+	creator, err := creatorOf(inst)
+	if err != nil || !strings.Contains(creator, "/regions/"+f.Region+"/") {
+		return "", false
+	}
+	groupTemplate, ok := groupTemplates[formatLinkString(creator)]
+	if !ok {
+		return "", false
+	}
+	template, err := templateOf(inst)
+	if err != nil || formatLinkString(template) == groupTemplate {
+		return "", false
+	}
+	return fmt.Sprintf("instance template %s differs from group template %s", formatLinkString(template), groupTemplate), true
+}
+
+func (f *GCPFleet) providerID(inst *compute.Instance) string {
+	return fmt.Sprintf("%s%s/%s/%s", providerIDPrefix, f.gc.Project, formatLinkString(inst.Zone), inst.Name)
+}
+
+// RecreateInstance recreates the instance behind a node providerID through
+// its group manager
+func (f *GCPFleet) RecreateInstance(ctx context.Context, providerID string) (string, error) {
+	_, zone, instance, err := ParseProviderID(providerID)
+	if err != nil {
+		return "", &models.PermanentError{Err: err}
+	}
+	return f.gc.TerminateInstance(ctx, instance, f.Region, zone)
+}
+
+func (f *GCPFleet) OperationDone(ctx context.Context, operation string) (bool, error) {
+	return f.gc.OperationDone(ctx, operation)
+}
@@ -1,5 +1,7 @@
 package client
 
+import "context"
+
 type GCPNodeClient struct {
 	gc      *GCPClient
 	Project string
@@ -9,8 +11,9 @@ type GCPNodeClient struct {
 }
 
 type GCPNodeClientInterface interface {
-	NeedsUpdate() (bool, error)
-	TerminateNode() error
+	NeedsUpdate(ctx context.Context) (bool, string, error)
+	TerminateNode(ctx context.Context) (string, error)
+	WaitForTermination(ctx context.Context, operation string) error
 }
 
 func NewNodeClient(project, node, region, zone string) (*GCPNodeClient, error) {
@@ -30,10 +33,24 @@ func NewNodeClient(project, node, region, zone string) (*GCPNodeClient, error) {
 
 }
 
-func (gcn *GCPNodeClient) NeedsUpdate() (bool, error) {
-	return gcn.gc.NeedsUpdate(gcn.Node, gcn.Region, gcn.Zone)
+func (gcn *GCPNodeClient) NeedsUpdate(ctx context.Context) (bool, string, error) {
+	return gcn.gc.NeedsUpdate(ctx, gcn.Node, gcn.Region, gcn.Zone)
+}
+
+func (gcn *GCPNodeClient) TerminateNode(ctx context.Context) (string, error) {
+	return gcn.gc.TerminateInstance(ctx, gcn.Node, gcn.Region, gcn.Zone)
+}
+
+func (gcn *GCPNodeClient) WaitForTermination(ctx context.Context, operation string) error {
+	return gcn.gc.WaitForOperation(ctx, operation)
+}
+
+// Client returns the underlying compute api client
+func (gcn *GCPNodeClient) Client() *GCPClient {
+	return gcn.gc
 }
 
-func (gcn *GCPNodeClient) TerminateNode() error {
-	return gcn.gc.TerminateInstance(gcn.Node, gcn.Region, gcn.Zone)
+// SetGroupTemplates changes where group templates are looked up
+func (gcn *GCPNodeClient) SetGroupTemplates(t GroupTemplates) {
+	gcn.gc.Templates = t
 }
@@ -0,0 +1,88 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
+)
+
+const operationPollInterval = 5 * time.Second
+
+// parseOperation splits the self link of a region operation, as in
+// .../projects/PROJECT/regions/REGION/operations/NAME, into its parts
+func parseOperation(operation string) (project, region, name string, err error) {
+	parts := strings.Split(operation, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		switch parts[i] {
+		case "projects":
+			project = parts[i+1]
+		case "regions":
+			region = parts[i+1]
+		case "operations":
+			name = parts[i+1]
+		}
+	}
+	if project == "" || region == "" || name == "" {
+		return "", "", "", fmt.Errorf("invalid region operation %q", operation)
+	}
+	return project, region, name, nil
+}
+
+// operationError returns the errors of a finished operation, if any
+func operationError(op *compute.Operation) error {
+	if op.Error == nil || len(op.Error.Errors) == 0 {
+		return nil
+	}
+	msgs := []string{}
+	for _, e := range op.Error.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", e.Code, e.Message))
+	}
+	return fmt.Errorf("operation %s failed: %s", op.Name, strings.Join(msgs, ", "))
+}
+
+// OperationDone tells whether a region operation, given by its self link, is
+// done. Errors of the operation itself are returned as models.PermanentError
+// along with done, errors looking it up while not done.
+func (gc *GCPClient) OperationDone(ctx context.Context, operation string) (bool, error) {
+	project, region, name, err := parseOperation(operation)
+	if err != nil {
+		return false, &models.PermanentError{Err: err}
+	}
+
+	var op *compute.Operation
+	err = gc.Retry.call(ctx, func(ctx context.Context) error {
+		op, err = gc.ComputeService.RegionOperations.Get(project, region, name).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return false, err
+	}
+	if op.Status != "DONE" {
+		return false, nil
+	}
+	if err := operationError(op); err != nil {
+		return true, &models.PermanentError{Err: err}
+	}
+	return true, nil
+}
+
+// WaitForOperation polls a region operation until it is done or ctx is
+// cancelled
+func (gc *GCPClient) WaitForOperation(ctx context.Context, operation string) error {
+	for {
+		done, err := gc.OperationDone(ctx, operation)
+		if err != nil || done {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(operationPollInterval):
+		}
+	}
+}
@@ -0,0 +1,17 @@
+package client
+
+import "testing"
+
+func TestParseOperation(t *testing.T) {
+	project, region, name, err := parseOperation("https://www.googleapis.com/compute/v1/projects/uw-dev/regions/europe-west2/operations/operation-1234")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if project != "uw-dev" || region != "europe-west2" || name != "operation-1234" {
+		t.Errorf("unexpected parts: %s %s %s", project, region, name)
+	}
+
+	if _, _, _, err := parseOperation("operation-1234"); err == nil {
+		t.Errorf("expected an error for an operation without project and region")
+	}
+}
@@ -0,0 +1,21 @@
+package client
+
+import (
+	"fmt"
+	"strings"
+)
+
+const providerIDPrefix = "gce://"
+
+// ParseProviderID splits a kubernetes node providerID of the form
+// gce://project/zone/instance into its parts
+func ParseProviderID(providerID string) (project, zone, instance string, err error) {
+	if !strings.HasPrefix(providerID, providerIDPrefix) {
+		return "", "", "", fmt.Errorf("providerID %q is not a gce one", providerID)
+	}
+	parts := strings.Split(strings.TrimPrefix(providerID, providerIDPrefix), "/")
+	if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return "", "", "", fmt.Errorf("invalid providerID %q, expected gce://project/zone/instance", providerID)
+	}
+	return parts[0], parts[1], parts[2], nil
+}
@@ -0,0 +1,35 @@
+package client
+
+import "testing"
+
+func TestParseProviderID(t *testing.T) {
+	tests := []struct {
+		providerID string
+		project    string
+		zone       string
+		instance   string
+		valid      bool
+	}{
+		{"gce://uw-dev/europe-west2-a/worker-1", "uw-dev", "europe-west2-a", "worker-1", true},
+		// Wrong or missing scheme
+		{"aws:///eu-west-1a/i-0123", "", "", "", false},
+		{"uw-dev/europe-west2-a/worker-1", "", "", "", false},
+		{"", "", "", "", false},
+		// Missing or extra parts
+		{"gce://uw-dev/europe-west2-a", "", "", "", false},
+		{"gce://uw-dev//worker-1", "", "", "", false},
+		{"gce:///europe-west2-a/worker-1", "", "", "", false},
+		{"gce://uw-dev/europe-west2-a/worker-1/extra", "", "", "", false},
+	}
+
+	for _, test := range tests {
+		project, zone, instance, err := ParseProviderID(test.providerID)
+		if (err == nil) != test.valid {
+			t.Errorf("%q: expected valid %v, got error %v", test.providerID, test.valid, err)
+			continue
+		}
+		if project != test.project || zone != test.zone || instance != test.instance {
+			t.Errorf("%q: expected %s/%s/%s, got %s/%s/%s", test.providerID, test.project, test.zone, test.instance, project, zone, instance)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package client
+
+import (
+	"context"
+	"log"
+	"net"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
+)
+
+// Retry configures timeouts and retries of compute api calls
+type Retry struct {
+	// Timeout of a single attempt
+	Timeout time.Duration
+	// Attempts is the maximum number of attempts of a call
+	Attempts int
+	// Backoff before the first retry, doubled on every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+var DefaultRetry = Retry{
+	Timeout:    30 * time.Second,
+	Attempts:   5,
+	Backoff:    time.Second,
+	MaxBackoff: 30 * time.Second,
+}
+
+// IsRetryable tells whether a compute api error may go away on retry: rate
+// limiting, server errors, timeouts and network errors
+func IsRetryable(err error) bool {
+	switch e := err.(type) {
+	case *googleapi.Error:
+		return e.Code == 429 || e.Code >= 500
+	case net.Error:
+		return true
+	}
+	return err == context.DeadlineExceeded
+}
+
+// call runs f with a per attempt timeout, retrying retryable errors with an
+// exponential backoff. Other errors are returned as models.PermanentError.
+func (r Retry) call(ctx context.Context, f func(ctx context.Context) error) error {
+	backoff := r.Backoff
+	for attempt := 1; ; attempt++ {
+		actx, cancel := context.WithTimeout(ctx, r.Timeout)
+		err := f(actx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if !IsRetryable(err) {
+			return &models.PermanentError{Err: err}
+		}
+		if attempt >= r.Attempts {
+			return err
+		}
+
+		log.Printf("[INFO] compute api call failed, retrying in %v: %v", backoff, err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > r.MaxBackoff {
+			backoff = r.MaxBackoff
+		}
+	}
+}
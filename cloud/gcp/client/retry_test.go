@@ -0,0 +1,66 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/api/googleapi"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
+)
+
+var testRetry = Retry{
+	Timeout:    time.Second,
+	Attempts:   3,
+	Backoff:    time.Millisecond,
+	MaxBackoff: time.Millisecond,
+}
+
+func TestCallRetriesRetryableErrors(t *testing.T) {
+	calls := 0
+	err := testRetry.call(context.Background(), func(ctx context.Context) error {
+		calls++
+		if calls < 3 {
+			return &googleapi.Error{Code: 503}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestCallGivesUpAfterAttempts(t *testing.T) {
+	calls := 0
+	err := testRetry.call(context.Background(), func(ctx context.Context) error {
+		calls++
+		return &googleapi.Error{Code: 429}
+	})
+	if err == nil || models.IsPermanent(err) {
+		t.Fatalf("expected a retryable error, got %v", err)
+	}
+	if calls != testRetry.Attempts {
+		t.Errorf("expected %d calls, got %d", testRetry.Attempts, calls)
+	}
+}
+
+func TestCallDoesNotRetryPermanentErrors(t *testing.T) {
+	for _, e := range []error{&googleapi.Error{Code: 403}, errors.New("No instance template found")} {
+		calls := 0
+		err := testRetry.call(context.Background(), func(ctx context.Context) error {
+			calls++
+			return e
+		})
+		if !models.IsPermanent(err) {
+			t.Errorf("expected %v to be permanent, got %v", e, err)
+		}
+		if calls != 1 {
+			t.Errorf("expected a single call for %v, got %d", e, calls)
+		}
+	}
+}
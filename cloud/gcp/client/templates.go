@@ -0,0 +1,95 @@
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	compute "google.golang.org/api/compute/v1"
+)
+
+// DefaultTemplateTTL is how long the template of a group manager is cached
+const DefaultTemplateTTL = 5 * time.Minute
+
+// GroupTemplates looks up the instance template a regional group manager is
+// using
+type GroupTemplates interface {
+	GroupTemplate(ctx context.Context, region, group string) (string, error)
+}
+
+// GroupTemplate fetches the instance template of a regional group manager
+func (gc *GCPClient) GroupTemplate(ctx context.Context, region, group string) (string, error) {
+	var groupManager *compute.InstanceGroupManager
+	err := gc.Retry.call(ctx, func(ctx context.Context) error {
+		var err error
+		groupManager, err = gc.ComputeService.RegionInstanceGroupManagers.Get(gc.Project, region, group).Context(ctx).Do()
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return formatLinkString(groupManager.InstanceTemplate), nil
+}
+
+// ListGroupTemplates returns the instance template of every regional group
+// manager in region, keyed by group name
+func (gc *GCPClient) ListGroupTemplates(ctx context.Context, region string) (map[string]string, error) {
+	var templates map[string]string
+	err := gc.Retry.call(ctx, func(ctx context.Context) error {
+		templates = map[string]string{}
+		return gc.ComputeService.RegionInstanceGroupManagers.List(gc.Project, region).Pages(ctx, func(page *compute.RegionInstanceGroupManagerList) error {
+			for _, gm := range page.Items {
+				templates[gm.Name] = formatLinkString(gm.InstanceTemplate)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return templates, nil
+}
+
+type cachedTemplate struct {
+	template string
+	expires  time.Time
+}
+
+// templateCache keeps group templates from another source for a ttl
+type templateCache struct {
+	source GroupTemplates
+	ttl    time.Duration
+
+	mu      sync.Mutex
+	entries map[string]cachedTemplate
+}
+
+// NewTemplateCache caches the templates returned by source for ttl
+func NewTemplateCache(source GroupTemplates, ttl time.Duration) GroupTemplates {
+	return &templateCache{
+		source:  source,
+		ttl:     ttl,
+		entries: map[string]cachedTemplate{},
+	}
+}
+
+func (c *templateCache) GroupTemplate(ctx context.Context, region, group string) (string, error) {
+	key := region + "/" + group
+
+	c.mu.Lock()
+	e, ok := c.entries[key]
+	c.mu.Unlock()
+	if ok && time.Now().Before(e.expires) {
+		return e.template, nil
+	}
+
+	template, err := c.source.GroupTemplate(ctx, region, group)
+	if err != nil {
+		return "", err
+	}
+
+	c.mu.Lock()
+	c.entries[key] = cachedTemplate{template: template, expires: time.Now().Add(c.ttl)}
+	c.mu.Unlock()
+	return template, nil
+}
@@ -1,48 +1,139 @@
+// Package meta reads the identity of the instance from the GCE metadata server
 package meta
 
 import (
-	"bytes"
 	"fmt"
-	"io"
+	"io/ioutil"
+	"log"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
-func bodyToString(body io.Reader) string {
-	buf := new(bytes.Buffer)
-	buf.ReadFrom(body)
-	return buf.String()
+const DefaultBaseURL = "http://metadata.google.internal/computeMetadata/v1"
+
+// Client queries the metadata server
+type Client struct {
+	// BaseURL of the metadata api, up to and including the version
+	BaseURL    string
+	HTTPClient *http.Client
+	// Attempts is the maximum number of attempts of a request. Only network
+	// errors and server errors are retried
+	Attempts      int
+	RetryInterval time.Duration
+}
+
+// NewWithURL returns a client for the metadata api at baseURL, or the default
+// one when empty
+func NewWithURL(baseURL string) *Client {
+	c := New()
+	if baseURL != "" {
+		c.BaseURL = baseURL
+	}
+	return c
+}
+
+// New returns a client for the metadata server, or for the host in
+// GCE_METADATA_HOST when set
+func New() *Client {
+	baseURL := DefaultBaseURL
+	if host := os.Getenv("GCE_METADATA_HOST"); host != "" {
+		baseURL = fmt.Sprintf("http://%s/computeMetadata/v1", host)
+	}
+	return &Client{
+		BaseURL:       baseURL,
+		HTTPClient:    &http.Client{Timeout: 5 * time.Second},
+		Attempts:      3,
+		RetryInterval: time.Second,
+	}
 }
 
-func getMetaInstanceItem(item string) (string, error) {
-	req, err := http.NewRequest("GET", fmt.Sprintf("http://metadata.google.internal/computeMetadata/v1/instance/%s", item), nil)
+// Get returns the value of a metadata item, e.g. instance/name
+func (c *Client) Get(item string) (string, error) {
+	var err error
+	for attempt := 1; ; attempt++ {
+		var value string
+		var retry bool
+		value, retry, err = c.get(item)
+		if err == nil {
+			return value, nil
+		}
+		if !retry || attempt >= c.Attempts {
+			return "", err
+		}
+		log.Printf("[INFO] metadata request failed, retrying in %v: %v", c.RetryInterval, err)
+		time.Sleep(c.RetryInterval)
+	}
+}
+
+// get runs a single request and tells whether a failed one is worth retrying
+func (c *Client) get(item string) (string, bool, error) {
+	req, err := http.NewRequest("GET", fmt.Sprintf("%s/%s", strings.TrimSuffix(c.BaseURL, "/"), item), nil)
 	if err != nil {
-		return "", err
+		return "", false, err
 	}
 	req.Header.Set("Metadata-Flavor", "Google")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := c.HTTPClient.Do(req)
 	if err != nil {
-		return "", err
+		return "", true, err
 	}
 	defer resp.Body.Close()
 
-	return bodyToString(resp.Body), nil
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", true, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", resp.StatusCode >= 500, fmt.Errorf("metadata item %s: unexpected status %s", item, resp.Status)
+	}
+	if resp.Header.Get("Metadata-Flavor") != "Google" {
+		return "", false, fmt.Errorf("metadata item %s: response is not from a metadata server", item)
+	}
+	value := strings.TrimSpace(string(body))
+	if value == "" {
+		return "", false, fmt.Errorf("metadata item %s is empty", item)
+	}
+	return value, false, nil
 }
 
-func InstanceName() (string, error) {
-
-	return getMetaInstanceItem("name")
-
+func (c *Client) InstanceName() (string, error) {
+	return c.Get("instance/name")
 }
 
-func InstanceHostname() (string, error) {
-
-	return getMetaInstanceItem("hostname")
+func (c *Client) InstanceHostname() (string, error) {
+	return c.Get("instance/hostname")
+}
 
+// InstanceZone returns the zone name of the instance, e.g. europe-west2-a
+func (c *Client) InstanceZone() (string, error) {
+	zone, err := c.Get("instance/zone")
+	if err != nil {
+		return "", err
+	}
+	// projects/NUMBER/zones/ZONE
+	return zone[strings.LastIndex(zone, "/")+1:], nil
 }
 
-func InstanceZone() (string, error) {
+func (c *Client) ProjectID() (string, error) {
+	return c.Get("project/project-id")
+}
 
-	return getMetaInstanceItem("zone")
+// Region returns the region of the instance, e.g. europe-west2
+func (c *Client) Region() (string, error) {
+	zone, err := c.InstanceZone()
+	if err != nil {
+		return "", err
+	}
+	return ZoneRegion(zone)
+}
 
+// ZoneRegion returns the region of a zone
+func ZoneRegion(zone string) (string, error) {
+	i := strings.LastIndex(zone, "-")
+	if i <= 0 {
+		return "", fmt.Errorf("invalid zone %q", zone)
+	}
+	return zone[:i], nil
 }
@@ -0,0 +1,75 @@
+package meta
+
+import (
+	"net/http"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/cloud/gcp/meta/metatest"
+)
+
+func testClient(s *metatest.Server) *Client {
+	c := NewWithURL(s.BaseURL())
+	c.RetryInterval = time.Millisecond
+	return c
+}
+
+func TestNewWithURL(t *testing.T) {
+	os.Setenv("GCE_METADATA_HOST", "10.0.0.1:8080")
+	defer os.Unsetenv("GCE_METADATA_HOST")
+
+	if c := NewWithURL(""); c.BaseURL != "http://10.0.0.1:8080/computeMetadata/v1" {
+		t.Errorf("expected GCE_METADATA_HOST to be used, got %s", c.BaseURL)
+	}
+	if c := NewWithURL("http://127.0.0.1/computeMetadata/v1"); c.BaseURL != "http://127.0.0.1/computeMetadata/v1" {
+		t.Errorf("expected the given url to take precedence, got %s", c.BaseURL)
+	}
+}
+
+func TestIdentity(t *testing.T) {
+	s := metatest.NewServer(map[string]string{
+		"instance/name":      "node-1",
+		"instance/zone":      "projects/1234/zones/europe-west2-a",
+		"project/project-id": "uw-dev",
+	})
+	defer s.Close()
+	c := testClient(s)
+
+	for name, f := range map[string]func() (string, error){
+		"node-1":         c.InstanceName,
+		"europe-west2-a": c.InstanceZone,
+		"europe-west2":   c.Region,
+		"uw-dev":         c.ProjectID,
+	} {
+		value, err := f()
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if value != name {
+			t.Errorf("expected %s, got %s", name, value)
+		}
+	}
+}
+
+func TestStatusChecks(t *testing.T) {
+	s := metatest.NewServer(map[string]string{})
+	defer s.Close()
+	c := testClient(s)
+
+	if _, err := c.InstanceName(); err == nil {
+		t.Errorf("expected an error for a missing item")
+	}
+	if s.Requests != 1 {
+		t.Errorf("expected not found not to be retried, got %d requests", s.Requests)
+	}
+
+	s.Requests = 0
+	s.Status = http.StatusInternalServerError
+	if _, err := c.InstanceName(); err == nil {
+		t.Errorf("expected an error for a server error")
+	}
+	if s.Requests != c.Attempts {
+		t.Errorf("expected server errors to be retried %d times, got %d requests", c.Attempts, s.Requests)
+	}
+}
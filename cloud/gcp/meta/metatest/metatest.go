@@ -0,0 +1,51 @@
+// Package metatest provides a fake metadata server for tests
+package metatest
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+)
+
+// Server is a fake metadata server serving a fixed set of items
+type Server struct {
+	*httptest.Server
+	// Items served keyed by path below the version, e.g. instance/name
+	Items map[string]string
+	// Status, when set, is returned for every request instead of the items
+	Status int
+	// Requests counts the requests received
+	Requests int
+}
+
+// NewServer starts a fake metadata server. Its URL plus /computeMetadata/v1
+// is the base url to use.
+func NewServer(items map[string]string) *Server {
+	s := &Server{Items: items}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.handle))
+	return s
+}
+
+// BaseURL returns the base url of the metadata api
+func (s *Server) BaseURL() string {
+	return s.URL + "/computeMetadata/v1"
+}
+
+func (s *Server) handle(w http.ResponseWriter, r *http.Request) {
+	s.Requests++
+	if r.Header.Get("Metadata-Flavor") != "Google" {
+		http.Error(w, "missing Metadata-Flavor header", http.StatusForbidden)
+		return
+	}
+	if s.Status != 0 {
+		http.Error(w, http.StatusText(s.Status), s.Status)
+		return
+	}
+	value, ok := s.Items[strings.TrimPrefix(r.URL.Path, "/computeMetadata/v1/")]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Metadata-Flavor", "Google")
+	w.Write([]byte(value))
+}
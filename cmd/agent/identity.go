@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log"
+	"os"
+
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	gclient "github.com/utilitywarehouse/kube-node-cycle-operator/cloud/gcp/client"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/cloud/gcp/meta"
+)
+
+// nodeName returns the kubernetes name of the node the agent runs on, as set
+// in NODE_NAME through the downward api, falling back to the instance hostname
+func nodeName(md *meta.Client) (string, error) {
+	if name := os.Getenv("NODE_NAME"); name != "" {
+		return name, nil
+	}
+	log.Println("[INFO] NODE_NAME not set, using the instance hostname as node name")
+	return md.InstanceHostname()
+}
+
+// instanceIdentity returns the project, zone and name of the instance behind
+// a node from its spec.providerID, falling back to the metadata server
+func instanceIdentity(kc kubernetes.Interface, md *meta.Client, node string) (project, zone, instance string, err error) {
+	n, err := kc.CoreV1().Nodes().Get(node, v1meta.GetOptions{})
+	if err != nil {
+		return "", "", "", err
+	}
+	if project, zone, instance, err := gclient.ParseProviderID(n.Spec.ProviderID); err == nil {
+		return project, zone, instance, nil
+	}
+
+	log.Println("[INFO] no gce providerID on node, using the metadata server for the instance identity:", node)
+	if project, err = md.ProjectID(); err != nil {
+		return "", "", "", err
+	}
+	if instance, err = md.InstanceName(); err != nil {
+		return "", "", "", err
+	}
+	if zone, err = md.InstanceZone(); err != nil {
+		return "", "", "", err
+	}
+	return project, zone, instance, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/cloud/gcp/meta"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/cloud/gcp/meta/metatest"
+)
+
+func testMetadata() *metatest.Server {
+	return metatest.NewServer(map[string]string{
+		"instance/name":      "worker-md",
+		"instance/hostname":  "worker-md.c.uw-dev.internal",
+		"instance/zone":      "projects/1234/zones/europe-west2-b",
+		"project/project-id": "uw-md",
+	})
+}
+
+func TestInstanceIdentity(t *testing.T) {
+	s := testMetadata()
+	defer s.Close()
+	md := meta.NewWithURL(s.BaseURL())
+
+	tests := []struct {
+		providerID string
+		identity   [3]string
+	}{
+		{"gce://uw-dev/europe-west2-a/worker-1", [3]string{"uw-dev", "europe-west2-a", "worker-1"}},
+		// Nodes without a gce providerID fall back to the metadata server
+		{"", [3]string{"uw-md", "europe-west2-b", "worker-md"}},
+		{"gce://uw-dev/worker-1", [3]string{"uw-md", "europe-west2-b", "worker-md"}},
+	}
+
+	for _, test := range tests {
+		kc := fake.NewSimpleClientset(&v1.Node{
+			ObjectMeta: v1meta.ObjectMeta{Name: "node-a"},
+			Spec:       v1.NodeSpec{ProviderID: test.providerID},
+		})
+		project, zone, instance, err := instanceIdentity(kc, md, "node-a")
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.providerID, err)
+			continue
+		}
+		if got := [3]string{project, zone, instance}; got != test.identity {
+			t.Errorf("%q: expected %v, got %v", test.providerID, test.identity, got)
+		}
+	}
+
+	// The metadata server is not asked when the node is not found
+	requests := s.Requests
+	if _, _, _, err := instanceIdentity(fake.NewSimpleClientset(), md, "node-a"); err == nil {
+		t.Errorf("expected an error for a missing node")
+	}
+	if s.Requests != requests {
+		t.Errorf("expected no metadata request for a missing node")
+	}
+}
+
+func TestInstanceIdentityMetadataDown(t *testing.T) {
+	s := testMetadata()
+	defer s.Close()
+	s.Status = 404
+	kc := fake.NewSimpleClientset(&v1.Node{ObjectMeta: v1meta.ObjectMeta{Name: "node-a"}})
+
+	if _, _, _, err := instanceIdentity(kc, meta.NewWithURL(s.BaseURL()), "node-a"); err == nil {
+		t.Errorf("expected an error without a providerID nor a metadata server")
+	}
+}
+
+func TestNodeName(t *testing.T) {
+	s := testMetadata()
+	defer s.Close()
+	md := meta.NewWithURL(s.BaseURL())
+
+	os.Setenv("NODE_NAME", "node-a")
+	name, err := nodeName(md)
+	os.Unsetenv("NODE_NAME")
+	if err != nil || name != "node-a" {
+		t.Errorf("expected NODE_NAME to be used, got %q %v", name, err)
+	}
+
+	if name, err := nodeName(md); err != nil || name != "worker-md.c.uw-dev.internal" {
+		t.Errorf("expected the instance hostname, got %q %v", name, err)
+	}
+}
@@ -3,62 +3,148 @@ package main
 import (
 	"flag"
 	"log"
-	"os"
 
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/cloud/fake"
 	gclient "github.com/utilitywarehouse/kube-node-cycle-operator/cloud/gcp/client"
 	"github.com/utilitywarehouse/kube-node-cycle-operator/cloud/gcp/meta"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/kube/k8sutil"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
 	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/agent"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/config"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/signals"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/templates"
 )
 
-var (
-	// flags
-	flagProject    = flag.String("project", "", "(Required) GCP Project to use")
-	flagRegion     = flag.String("region", "", "(Required) Region where the node lives")
-	flagKubeConfig = flag.String("conf_file", "", "(Optional) Path of the kube config file to use. Defaults to incluster config for pods")
-)
+var flagConfig = flag.String("config", "", "(Optional) Path of the yaml config file. Flags set on the command line take precedence over it. Reloaded on change")
+
+// bindFlags registers the flags overriding the config file on fs, bound to c
+func bindFlags(fs *flag.FlagSet, c *config.Agent) {
+	fs.StringVar(&c.Cloud.Provider, "cloud_provider", c.Cloud.Provider, "(Optional) Cloud provider of the node, gcp or fake")
+	fs.StringVar(&c.Cloud.Project, "project", c.Cloud.Project, "(Optional) GCP Project to use. Defaults to the project of the instance")
+	fs.StringVar(&c.Cloud.Region, "region", c.Cloud.Region, "(Optional) Region where the node lives. Defaults to the region of the instance zone")
+	fs.StringVar(&c.Cloud.MetadataURL, "metadata_url", c.Cloud.MetadataURL, "(Optional) Base url of the metadata api, up to and including the version. Defaults to the metadata server, or GCE_METADATA_HOST")
+	fs.BoolVar(&c.DryRun, "dry_run", c.DryRun, "(Optional) Report updates but only annotate the node with the actions that would be taken once approved. The node is never cordoned, drained or terminated")
+	fs.StringVar(&c.KubeConfig, "conf_file", c.KubeConfig, "(Optional) Path of the kube config file to use. Defaults to incluster config for pods")
+	fs.DurationVar(&c.PollInterval.Duration, "poll_interval", c.PollInterval.Duration, "(Optional) How often to check for updates and approval")
+
+	fs.DurationVar(&c.Templates.TTL.Duration, "template_ttl", c.Templates.TTL.Duration, "(Optional) How long to cache the instance template of the group manager")
+	fs.StringVar(&c.Templates.Namespace, "templates_namespace", c.Templates.Namespace, "(Optional) Namespace of the configmap where the operator publishes group templates")
+	fs.StringVar(&c.Templates.ConfigMap, "templates_configmap", c.Templates.ConfigMap, "(Optional) Name of the configmap where the operator publishes group templates. Group managers are queried directly when empty")
 
-func usage() {
-	flag.Usage()
-	os.Exit(2)
+	// fake provider
+	fs.StringVar(&c.Fake.ConfigMap, "fake_configmap", c.Fake.ConfigMap, "(Optional) namespace/name of the configmap declaring outdated nodes with -cloud_provider=fake")
+	fs.StringVar(&c.Fake.File, "fake_file", c.Fake.File, "(Optional) Path of the json file declaring outdated nodes with -cloud_provider=fake")
+	fs.BoolVar(&c.Fake.Recreate, "fake_recreate", c.Fake.Recreate, "(Optional) Register a new Node object in place of a terminated one with -cloud_provider=fake")
+}
+
+// agentConfig returns the settings of the agent package
+func agentConfig(c config.Agent) agent.Config {
+	return agent.Config{
+		PollInterval:    c.PollInterval.Duration,
+		DryRun:          c.DryRun,
+		EvictionTimeout: c.Drain.EvictionTimeout.Duration,
+		DeletionTimeout: c.Drain.DeletionTimeout.Duration,
+		ExcludedOwners:  c.Drain.ExcludedOwners,
+	}
 }
+
 func main() {
 	// Flag Parsing
+	conf := config.DefaultAgent()
+	bindFlags(flag.CommandLine, &conf)
 	flag.Parse()
 
-	if *flagProject == "" {
-		usage()
+	overrides := config.SetFlags(flag.CommandLine)
+	load := func() (config.Agent, error) {
+		c := config.DefaultAgent()
+		err := config.Load(*flagConfig, &c, func(fs *flag.FlagSet) { bindFlags(fs, &c) }, overrides)
+		return c, err
 	}
-	project := *flagProject
-	if *flagRegion == "" {
-		usage()
+	conf, err := load()
+	if err != nil {
+		log.Fatal("invalid configuration: ", err)
 	}
-	region := *flagRegion
 
-	// Data from instance metadata
-	nodeName, err := meta.InstanceName()
+	kc, err := k8sutil.GetClient(conf.KubeConfig)
 	if err != nil {
 		log.Fatal(err)
 	}
-	hostName, err := meta.InstanceHostname()
+
+	// Node and instance identity
+	md := meta.NewWithURL(conf.Cloud.MetadataURL)
+	node, err := nodeName(md)
 	if err != nil {
 		log.Fatal(err)
 	}
-	zone, err := meta.InstanceZone()
+	var cc models.NodeClientInterface
+	switch conf.Cloud.Provider {
+	case "gcp":
+		cc, err = gcpClient(kc, md, node, conf)
+	case "fake":
+		cc, err = fakeClient(kc, node, conf)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	// gcp client
-	gc, err := gclient.NewNodeClient(project, nodeName, region, zone)
+	// create a new agent
+	a := agent.New(node, kc, cc, agentConfig(conf))
+
+	ctx := signals.Context()
+
+	// Only the settings of the agent package can change without a restart
+	if *flagConfig != "" {
+		go config.Watch(ctx, *flagConfig, config.DefaultWatchInterval, func() {
+			c, err := load()
+			if err != nil {
+				log.Println("[ERROR] invalid configuration, keeping the current one:", err)
+				return
+			}
+			a.Reload(agentConfig(c))
+		})
+	}
+
+	a.Run(ctx)
+}
+
+// gcpClient returns the client of the GCE instance behind node
+func gcpClient(kc kubernetes.Interface, md *meta.Client, node string, conf config.Agent) (models.NodeClientInterface, error) {
+	instanceProject, zone, instance, err := instanceIdentity(kc, md, node)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	project := conf.Cloud.Project
+	if project == "" {
+		project = instanceProject
+	}
+	region := conf.Cloud.Region
+	if region == "" {
+		if region, err = meta.ZoneRegion(zone); err != nil {
+			return nil, err
+		}
 	}
 
-	// create a new agent
-	a, err := agent.New(hostName, *flagKubeConfig, gc)
+	gc, err := gclient.NewNodeClient(project, instance, region, zone)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+	var groupTemplates gclient.GroupTemplates = gclient.NewTemplateCache(gc.Client(), conf.Templates.TTL.Duration)
+	if conf.Templates.ConfigMap != "" {
+		groupTemplates = templates.NewConfigMap(kc, conf.Templates.Namespace, conf.Templates.ConfigMap, conf.Templates.MaxAge.Duration, groupTemplates)
 	}
-	a.Run()
+	gc.SetGroupTemplates(groupTemplates)
+	return gc, nil
+}
 
+// fakeClient returns the client of node in the fake provider
+func fakeClient(kc kubernetes.Interface, node string, conf config.Agent) (models.NodeClientInterface, error) {
+	source, err := fake.NewSource(kc, conf.Fake.ConfigMap, conf.Fake.File)
+	if err != nil {
+		return nil, err
+	}
+	p := fake.New(kc, source)
+	p.Recreate = conf.Fake.Recreate
+	return p.Node(node), nil
 }
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/kube/k8sutil"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/control"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+var (
+	// flags
+	flagKubeConfig       = flag.String("conf_file", defaultKubeConfig(), "(Optional) Path of the kube config file to use")
+	flagControlNamespace = flag.String("control_namespace", control.DefaultNamespace, "(Optional) Namespace of the operator control configmap")
+	flagControlConfigMap = flag.String("control_configmap", control.DefaultName, "(Optional) Name of the operator control configmap")
+)
+
+const commands = `Commands:
+  status                  show the cycling state of every node (default)
+  force-terminate NODE    terminate NODE without waiting for operator permission
+  skip NODE               never grant NODE permission to terminate
+  unskip NODE             allow NODE to be granted permission again
+  reset NODE              move NODE back to Idle whatever its cycle state is
+  pause                   stop granting permissions
+  resume [POOL]           resume granting permissions, for POOL only if given
+  abort                   revoke pending permissions and pause
+`
+
+func defaultKubeConfig() string {
+	if kc := os.Getenv("KUBECONFIG"); kc != "" {
+		return kc
+	}
+	return filepath.Join(os.Getenv("HOME"), ".kube", "config")
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s [flags] COMMAND [NODE]\n\n%s\nFlags:\n", filepath.Base(os.Args[0]), commands)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	kc, err := k8sutil.GetClient(*flagKubeConfig)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ctl := control.New(kc, *flagControlNamespace, *flagControlConfigMap)
+
+	args := flag.Args()
+	cmd := "status"
+	if len(args) > 0 {
+		cmd = args[0]
+	}
+
+	switch cmd {
+	case "status":
+		err = status(os.Stdout, kc, ctl)
+	case "force-terminate":
+		err = forceTerminate(kc.CoreV1().Nodes(), nodeArg(args))
+	case "skip":
+		err = k8sutil.SetNodeAnnotations(kc.CoreV1().Nodes(), nodeArg(args), map[string]string{
+			annotations.Skip: annotations.AnnoTrue,
+		})
+	case "unskip":
+		err = k8sutil.DeleteNodeAnnotations(kc.CoreV1().Nodes(), nodeArg(args), []string{annotations.Skip})
+	case "reset":
+		_, err = nodestate.Reset(kc.CoreV1().Nodes(), nodeArg(args), "reset with nodecyclectl")
+	case "pause":
+		err = ctl.SetRollout(control.RolloutPaused)
+	case "resume":
+		err = resume(ctl, args)
+	case "abort":
+		err = ctl.SetRollout(control.RolloutAbort)
+	default:
+		usage()
+		os.Exit(2)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// nodeArg returns the node name argument of a command or exits with usage
+func nodeArg(args []string) string {
+	if len(args) != 2 {
+		usage()
+		os.Exit(2)
+	}
+	return args[1]
+}
+
+// forceTerminate approves a node without waiting for the operator. A node
+// approved already, e.g. stuck waiting for its cycle, is only marked forced.
+func forceTerminate(nc v1core.NodeInterface, node string) error {
+	_, err := nodestate.Update(nc, node, func(s *nodestate.State) error {
+		s.Forced = true
+		if s.Phase == nodestate.Approved {
+			return nil
+		}
+		return s.Transition(nodestate.Approved, "termination forced with nodecyclectl")
+	})
+	return err
+}
+
+// resume clears the halt of a single pool, or of every pool along with the
+// rollout pause when no pool is given
+func resume(ctl *control.Control, args []string) error {
+	switch len(args) {
+	case 1:
+		if err := ctl.ResumeAllPools(); err != nil {
+			return err
+		}
+		return ctl.SetRollout(control.RolloutRunning)
+	case 2:
+		return ctl.ResumePool(args[1])
+	default:
+		usage()
+		os.Exit(2)
+	}
+	return nil
+}
+
+// orDash returns s or "-" when empty
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func nodeReady(n v1.Node) string {
+	for _, c := range n.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return string(c.Status)
+		}
+	}
+	return string(v1.ConditionUnknown)
+}
+
+// status prints the rollout mode and a table of every node cycling state
+func status(out io.Writer, kc kubernetes.Interface, ctl *control.Control) error {
+	rollout, err := ctl.Rollout()
+	if err != nil {
+		return err
+	}
+	st, err := ctl.Status()
+	if err != nil {
+		return err
+	}
+	if st == "" {
+		st = "-"
+	}
+	fmt.Fprintf(out, "Rollout: %s (operator status: %s)\n", rollout, st)
+	halted, err := ctl.HaltedPools()
+	if err != nil {
+		return err
+	}
+	if len(halted) > 0 {
+		fmt.Fprintf(out, "Halted pools: %s\n", strings.Join(halted, ","))
+	}
+	fmt.Fprintln(out)
+
+	nodeList, err := kc.CoreV1().Nodes().List(v1meta.ListOptions{})
+	if err != nil {
+		return err
+	}
+	nodes := nodeList.Items
+	sort.Slice(nodes, func(i, j int) bool { return nodes[i].Name < nodes[j].Name })
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "NODE\tREADY\tSCHEDULABLE\tPHASE\tSINCE\tFORCED\tSKIP\tREASON\tERROR")
+	for _, n := range nodes {
+		phase, since, forced, reason, stErr := "-", "-", "-", "-", "-"
+		st, err := nodestate.FromNode(n)
+		if err != nil {
+			stErr = err.Error()
+		} else {
+			phase = string(st.Phase)
+			if t := st.Since(); !t.IsZero() {
+				since = time.Since(t).Round(time.Second).String()
+			}
+			forced = fmt.Sprintf("%t", st.Forced)
+			reason = orDash(st.Reason)
+			stErr = orDash(st.Error)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%t\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			n.Name,
+			nodeReady(n),
+			!n.Spec.Unschedulable,
+			phase,
+			since,
+			forced,
+			orDash(n.Annotations[annotations.Skip]),
+			reason,
+			stErr,
+		)
+	}
+	return w.Flush()
+}
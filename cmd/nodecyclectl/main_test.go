@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/control"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+func testNode(t *testing.T, name string, phase nodestate.Phase) *v1.Node {
+	st := nodestate.New()
+	st.Phase = phase
+	raw, err := st.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &v1.Node{ObjectMeta: v1meta.ObjectMeta{Name: name, Annotations: map[string]string{annotations.State: raw}}}
+}
+
+func TestForceTerminate(t *testing.T) {
+	tests := []struct {
+		phase nodestate.Phase
+		// expected
+		err    bool
+		result nodestate.Phase
+		forced bool
+	}{
+		{nodestate.Idle, false, nodestate.Approved, true},
+		{nodestate.UpdateNeeded, false, nodestate.Approved, true},
+		// Approved nodes stuck waiting are only marked forced
+		{nodestate.Approved, false, nodestate.Approved, true},
+		// Nodes cycling already are left alone
+		{nodestate.Draining, true, nodestate.Draining, false},
+	}
+
+	for _, test := range tests {
+		kc := fake.NewSimpleClientset(testNode(t, "node-a", test.phase))
+		err := forceTerminate(kc.CoreV1().Nodes(), "node-a")
+		if (err != nil) != test.err {
+			t.Errorf("%s: expected error %v, got %v", test.phase, test.err, err)
+		}
+		st, err := nodestate.Get(kc.CoreV1().Nodes(), "node-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Phase != test.result || st.Forced != test.forced {
+			t.Errorf("%s: expected %s (forced %v), got %s (forced %v)", test.phase, test.result, test.forced, st.Phase, st.Forced)
+		}
+	}
+}
+
+func TestResume(t *testing.T) {
+	kc := fake.NewSimpleClientset()
+	ctl := control.New(kc, control.DefaultNamespace, control.DefaultName)
+	for _, pool := range []string{"worker", "master"} {
+		if err := ctl.HaltPool(pool); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ctl.SetRollout(control.RolloutPaused); err != nil {
+		t.Fatal(err)
+	}
+
+	// A single pool leaves the rest halted and the rollout paused
+	if err := resume(ctl, []string{"resume", "worker"}); err != nil {
+		t.Fatal(err)
+	}
+	halted, err := ctl.HaltedPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rollout, _ := ctl.Rollout(); len(halted) != 1 || halted[0] != "master" || rollout != control.RolloutPaused {
+		t.Errorf("expected master halted and the rollout paused, got %v and %s", halted, rollout)
+	}
+
+	if err := resume(ctl, []string{"resume"}); err != nil {
+		t.Fatal(err)
+	}
+	if halted, err = ctl.HaltedPools(); err != nil {
+		t.Fatal(err)
+	}
+	if rollout, _ := ctl.Rollout(); len(halted) != 0 || rollout != control.RolloutRunning {
+		t.Errorf("expected every pool resumed and the rollout running, got %v and %s", halted, rollout)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	skipped := testNode(t, "node-b", nodestate.Idle)
+	skipped.Annotations[annotations.Skip] = annotations.AnnoTrue
+	kc := fake.NewSimpleClientset(testNode(t, "node-a", nodestate.Draining), skipped)
+	ctl := control.New(kc, control.DefaultNamespace, control.DefaultName)
+	if err := ctl.HaltPool("worker"); err != nil {
+		t.Fatal(err)
+	}
+
+	out := &bytes.Buffer{}
+	if err := status(out, kc, ctl); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 6 {
+		t.Fatalf("expected the rollout, halted pools, a blank line, a header and 2 nodes, got:\n%s", out)
+	}
+	if lines[0] != "Rollout: running (operator status: -)" || lines[1] != "Halted pools: worker" {
+		t.Errorf("unexpected rollout status:\n%s", out)
+	}
+	for i, expected := range [][]string{{"node-a", string(nodestate.Draining)}, {"node-b", string(nodestate.Idle), annotations.AnnoTrue}} {
+		fields := strings.Fields(lines[i+4])
+		for _, f := range expected {
+			if !contains(fields, f) {
+				t.Errorf("expected %q in row %q", f, lines[i+4])
+			}
+		}
+	}
+}
+
+func contains(fields []string, f string) bool {
+	for _, s := range fields {
+		if s == f {
+			return true
+		}
+	}
+	return false
+}
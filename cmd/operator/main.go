@@ -1,36 +1,239 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"log"
-	"os"
+	"net/http"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/cloud/fake"
+	gclient "github.com/utilitywarehouse/kube-node-cycle-operator/cloud/gcp/client"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/cloud/gcp/meta"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/kube/k8sutil"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/config"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/etcd"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/notify"
 	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/operator"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/signals"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/templates"
 )
 
-var (
-	// flags
-	flagKubeConfig = flag.String("conf_file", "", "(Optional) Path of the kube config file to use. Defaults to incluster config for pods")
-	flagStatePath  = flag.String("state_path", "", "(Required) Path of the file where operator shall keep the state info. Shall be part of a persistent volume")
-)
+var flagConfig = flag.String("config", "", "(Optional) Path of the yaml config file. Flags set on the command line take precedence over it. Reloaded on change")
+
+// bindFlags registers the flags overriding the config file on fs, bound to c
+func bindFlags(fs *flag.FlagSet, c *config.Operator) {
+	fs.StringVar(&c.KubeConfig, "conf_file", c.KubeConfig, "(Optional) Path of the kube config file to use. Defaults to incluster config for pods")
+	fs.StringVar(&c.StatePath, "state_path", c.StatePath, "(Required) Path of the file where operator shall keep the state info. Shall be part of a persistent volume")
+
+	fs.StringVar(&c.Control.Namespace, "control_namespace", c.Control.Namespace, "(Optional) Namespace of the configmap used to pause, resume and abort the rollout")
+	fs.StringVar(&c.Control.ConfigMap, "control_configmap", c.Control.ConfigMap, "(Optional) Name of the configmap used to pause, resume and abort the rollout")
+	fs.StringVar(&c.PoolLabel, "pool_label", c.PoolLabel, "(Optional) Node label used to group nodes into pools")
+	fs.StringVar(&c.MasterLabel, "master_label", c.MasterLabel, "(Optional) Node label, as key=value, selecting the master nodes for the masters-first and masters-last orders and the etcd checks")
+	fs.Var(config.Strings{List: &c.Order}, "order", "(Optional) Comma separated strategies picking the next node to cycle, later ones breaking ties: masters-first, masters-last, oldest, fewest-pods, zone-round-robin, least-utilized or priority")
+	fs.BoolVar(&c.ZoneAware, "zone_aware", c.ZoneAware, "(Optional) Cycle the nodes of one zone after the other and stop granting while a zone has fewer Ready nodes than before the rollout")
+	fs.StringVar(&c.ListenAddress, "listen_address", c.ListenAddress, "(Optional) Address to serve the status API and metrics on")
+	fs.DurationVar(&c.PollInterval.Duration, "poll_interval", c.PollInterval.Duration, "(Optional) Time between two reconciles")
+	fs.IntVar(&c.FailureBudget, "failure_budget", c.FailureBudget, "(Optional) Number of failed cycles after which a pool is halted until manually resumed. Disabled when 0")
+	fs.DurationVar(&c.CycleTimeout.Duration, "cycle_timeout", c.CycleTimeout.Duration, "(Optional) Time allowed from granting permission to a node until its replacement is Ready with its DaemonSets running")
+	fs.BoolVar(&c.DryRun, "dry_run", c.DryRun, "(Optional) Log and report the node that would be given permission next without giving it. Stale nodes are not removed and agentless cycles not started")
+
+	// cloud provider
+	fs.StringVar(&c.Cloud.Provider, "cloud_provider", c.Cloud.Provider, "(Optional) Cloud provider used to remove nodes whose instance is gone, gcp or fake")
+	fs.StringVar(&c.Cloud.Project, "project", c.Cloud.Project, "(Optional) GCP Project to use with -cloud_provider=gcp. Defaults to the project the operator runs in")
+	fs.StringVar(&c.Cloud.MetadataURL, "metadata_url", c.Cloud.MetadataURL, "(Optional) Base url of the metadata api, up to and including the version, used to discover the project and region. Defaults to the metadata server, or GCE_METADATA_HOST")
+	fs.DurationVar(&c.Cloud.StaleNodeGrace.Duration, "stale_node_grace", c.Cloud.StaleNodeGrace.Duration, "(Optional) Time a node must be NotReady before checking whether its instance is gone")
+
+	// agentless mode
+	fs.BoolVar(&c.Cloud.Agentless, "agentless", c.Cloud.Agentless, "(Optional) Detect outdated nodes and drain and recreate them from the operator, without agents. Requires -cloud_provider")
+	fs.StringVar(&c.Cloud.Region, "region", c.Cloud.Region, "(Optional) Region of the group managers with -agentless and -templates_configmap. Defaults to the region the operator runs in")
+
+	// fake provider
+	fs.StringVar(&c.Fake.ConfigMap, "fake_configmap", c.Fake.ConfigMap, "(Optional) namespace/name of the configmap declaring outdated nodes with -cloud_provider=fake")
+	fs.StringVar(&c.Fake.File, "fake_file", c.Fake.File, "(Optional) Path of the json file declaring outdated nodes with -cloud_provider=fake")
+	fs.BoolVar(&c.Fake.Recreate, "fake_recreate", c.Fake.Recreate, "(Optional) Register a new Node object in place of a terminated one with -cloud_provider=fake")
 
-func usage() {
-	flag.Usage()
-	os.Exit(2)
+	// group templates
+	fs.StringVar(&c.Templates.Namespace, "templates_namespace", c.Templates.Namespace, "(Optional) Namespace of the configmap to publish group templates to")
+	fs.StringVar(&c.Templates.ConfigMap, "templates_configmap", c.Templates.ConfigMap, "(Optional) Name of the configmap to publish group templates to for agents to compare against. Requires -cloud_provider=gcp")
+
+	// health checks
+	fs.BoolVar(&c.Health.KubeSystemPods, "check_kube_system_pods", c.Health.KubeSystemPods, "(Optional) Require all kube-system pods to be Ready before granting")
+	fs.DurationVar(&c.Health.PendingPods.Duration, "check_pending_pods", c.Health.PendingPods.Duration, "(Optional) Block granting while a pod is unschedulable for longer than this. Disabled when 0")
+	fs.Var(config.Strings{List: &c.Health.Workloads}, "check_workloads", "(Optional) Comma separated list of kind/namespace/name deployments or statefulsets that must be fully available before granting")
+	fs.StringVar(&c.Health.PrometheusURL, "check_prometheus_url", c.Health.PrometheusURL, "(Optional) Prometheus base url to run check_prometheus_query against")
+	fs.StringVar(&c.Health.PrometheusQuery, "check_prometheus_query", c.Health.PrometheusQuery, "(Optional) Prometheus query that must return only non zero values before granting")
+
+	// etcd quorum protection
+	fs.Var(config.Strings{List: &c.Etcd.Endpoints}, "etcd_endpoints", "(Optional) Comma separated client urls of the etcd cluster running on the masters. Masters are only cycled while etcd keeps its quorum without them, and the next node waits for every member to be healthy again")
+	fs.StringVar(&c.Etcd.CAFile, "etcd_ca_file", c.Etcd.CAFile, "(Optional) Path of the CA bundle verifying the etcd members")
+	fs.StringVar(&c.Etcd.CertFile, "etcd_cert_file", c.Etcd.CertFile, "(Optional) Path of the client certificate to authenticate to etcd with")
+	fs.StringVar(&c.Etcd.KeyFile, "etcd_key_file", c.Etcd.KeyFile, "(Optional) Path of the key of -etcd_cert_file")
+	fs.DurationVar(&c.Etcd.DialTimeout.Duration, "etcd_dial_timeout", c.Etcd.DialTimeout.Duration, "(Optional) Timeout of connecting to and querying every etcd member")
+
+	// notifications
+	fs.StringVar(&c.Notify.URL, "notify_url", c.Notify.URL, "(Optional) Webhook url to post rollout start and finish, cycled nodes and failures to")
+	fs.StringVar(&c.Notify.Format, "notify_format", c.Notify.Format, "(Optional) Payload posted to -notify_url, json or slack")
+	fs.StringVar(&c.Notify.Template, "notify_template", c.Notify.Template, "(Optional) Go template of the notification text, rendered with the event Type, Pool, Node, Message, Time and Dropped fields")
+	fs.DurationVar(&c.Notify.Interval.Duration, "notify_interval", c.Notify.Interval.Duration, "(Optional) Average time between two notifications, more are dropped. Disabled when 0")
+	fs.IntVar(&c.Notify.Burst, "notify_burst", c.Notify.Burst, "(Optional) Number of notifications sent at once before -notify_interval applies")
 }
+
+// operatorConfig returns the settings of the operator package
+func operatorConfig(c config.Operator) operator.Config {
+	return operator.Config{
+		KubeConfig:       c.KubeConfig,
+		StatePath:        c.StatePath,
+		ControlNamespace: c.Control.Namespace,
+		ControlName:      c.Control.ConfigMap,
+		PoolLabel:        c.PoolLabel,
+		MasterLabel:      c.MasterLabel,
+		Order:            c.Order,
+		PoolOrder:        c.PoolOrder,
+		ZoneAware:        c.ZoneAware,
+		PollInterval:     c.PollInterval.Duration,
+		CycleTimeout:     c.CycleTimeout.Duration,
+		FailureBudget:    c.FailureBudget,
+		StaleNodeGrace:   c.Cloud.StaleNodeGrace.Duration,
+		Health:           c.Health.Config(),
+		EvictionTimeout:  c.Drain.EvictionTimeout.Duration,
+		DeletionTimeout:  c.Drain.DeletionTimeout.Duration,
+		ExcludedOwners:   c.Drain.ExcludedOwners,
+		DryRun:           c.DryRun,
+	}
+}
+
 func main() {
 	// Flag Parsing
+	conf := config.DefaultOperator()
+	bindFlags(flag.CommandLine, &conf)
 	flag.Parse()
 
-	if *flagStatePath == "" {
-		usage()
+	overrides := config.SetFlags(flag.CommandLine)
+	load := func() (config.Operator, error) {
+		c := config.DefaultOperator()
+		err := config.Load(*flagConfig, &c, func(fs *flag.FlagSet) { bindFlags(fs, &c) }, overrides)
+		return c, err
+	}
+	conf, err := load()
+	if err != nil {
+		log.Fatal("invalid configuration: ", err)
+	}
+
+	var cloud models.CloudProviderInterface
+	var fleet models.FleetProviderInterface
+	var lister templates.Lister
+	switch conf.Cloud.Provider {
+	case "gcp":
+		// Default to the project and region the operator runs in
+		md := meta.NewWithURL(conf.Cloud.MetadataURL)
+		if conf.Cloud.Project == "" {
+			project, err := md.ProjectID()
+			if err != nil {
+				log.Fatal("-project not set and failed to discover it: ", err)
+			}
+			conf.Cloud.Project = project
+		}
+		if conf.Cloud.Region == "" && (conf.Cloud.Agentless || conf.Templates.ConfigMap != "") {
+			region, err := md.Region()
+			if err != nil {
+				log.Fatal("-region not set and failed to discover it: ", err)
+			}
+			conf.Cloud.Region = region
+		}
+		gc, err := gclient.NewGCPClient(conf.Cloud.Project)
+		if err != nil {
+			log.Fatal(err)
+		}
+		cloud = gc
+		lister = gc
+		if conf.Cloud.Agentless {
+			fleet = gclient.NewFleet(gc, conf.Cloud.Region)
+		}
+	case "fake":
+		kc, err := k8sutil.GetClient(conf.KubeConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		source, err := fake.NewSource(kc, conf.Fake.ConfigMap, conf.Fake.File)
+		if err != nil {
+			log.Fatal(err)
+		}
+		p := fake.New(kc, source)
+		p.Recreate = conf.Fake.Recreate
+		cloud = p
+		if conf.Cloud.Agentless {
+			fleet = p
+		}
 	}
 
-	// create a new agent
-	op, err := operator.New(*flagKubeConfig, *flagStatePath)
+	// create a new operator
+	opConf := operatorConfig(conf)
+	opConf.Cloud = cloud
+	opConf.Fleet = fleet
+	if len(conf.Etcd.Endpoints) > 0 {
+		ec, err := etcd.New(conf.Etcd.Config())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer ec.Close()
+		opConf.Etcd = ec
+	}
+	if conf.Notify.URL != "" {
+		wh, err := notify.NewWebhook(conf.Notify.Config())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer wh.Close()
+		opConf.Notifier = wh
+	}
+	op, err := operator.New(opConf)
 	if err != nil {
 		log.Fatal(err)
 	}
-	op.Run()
 
+	// status api and metrics
+	mux := http.NewServeMux()
+	mux.Handle("/status", op)
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{Addr: conf.ListenAddress, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	ctx := signals.Context()
+
+	// group templates for the agents
+	if conf.Templates.ConfigMap != "" {
+		kc, err := k8sutil.GetClient(conf.KubeConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go templates.Publish(ctx, kc, conf.Templates.Namespace, conf.Templates.ConfigMap, lister, conf.Cloud.Region, conf.Templates.Interval.Duration)
+	}
+
+	// Only the settings of the operator package can change without a restart
+	if *flagConfig != "" {
+		go config.Watch(ctx, *flagConfig, config.DefaultWatchInterval, func() {
+			c, err := load()
+			if err != nil {
+				log.Println("[ERROR] invalid configuration, keeping the current one:", err)
+				return
+			}
+			op.Reload(operatorConfig(c))
+		})
+	}
+
+	op.Run(ctx)
+
+	sctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(sctx); err != nil {
+		log.Println("[ERROR] failed to shut down http server:", err)
+	}
 }
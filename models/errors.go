@@ -0,0 +1,17 @@
+package models
+
+// PermanentError wraps a cloud error that retrying will not fix, e.g. a
+// missing permission or a malformed request
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+// IsPermanent tells whether err is a PermanentError
+func IsPermanent(err error) bool {
+	_, ok := err.(*PermanentError)
+	return ok
+}
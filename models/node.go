@@ -1,6 +1,43 @@
 package models
 
+import "context"
+
+// NodeClientInterface is used by the agent to query and terminate its own
+// instance. Errors that retrying will not fix are returned as PermanentError.
 type NodeClientInterface interface {
-	NeedsUpdate() (bool, error)
-	TerminateNode() error
+	// NeedsUpdate reports whether the node needs to be replaced and why
+	NeedsUpdate(ctx context.Context) (bool, string, error)
+	// TerminateNode starts terminating the node and returns the cloud
+	// operation doing so
+	TerminateNode(ctx context.Context) (string, error)
+	// WaitForTermination blocks until the operation returned by TerminateNode
+	// is done and returns its error, if any
+	WaitForTermination(ctx context.Context, operation string) error
+}
+
+// CloudProviderInterface is used by the operator to query the cloud about any
+// node of the cluster
+type CloudProviderInterface interface {
+	// InstanceExists tells whether the instance behind a node providerID is
+	// still there
+	InstanceExists(ctx context.Context, providerID string) (bool, error)
+	// OperationDone tells whether an operation returned by
+	// NodeClientInterface.TerminateNode is done and returns its error, if any.
+	// An error while not done is a failure to look the operation up.
+	OperationDone(ctx context.Context, operation string) (bool, error)
+}
+
+// FleetProviderInterface is used by the operator to detect and replace
+// outdated instances itself, without any agent running on the nodes
+type FleetProviderInterface interface {
+	// OutdatedInstances returns the reason an update is needed keyed by the
+	// providerID of every instance that needs one
+	OutdatedInstances(ctx context.Context) (map[string]string, error)
+	// RecreateInstance starts replacing the instance behind a node
+	// providerID and returns the cloud operation doing so
+	RecreateInstance(ctx context.Context, providerID string) (string, error)
+	// OperationDone tells whether an operation returned by RecreateInstance
+	// is done and returns its error, if any. An error while not done is a
+	// failure to look the operation up.
+	OperationDone(ctx context.Context, operation string) (bool, error)
 }
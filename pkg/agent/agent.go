@@ -1,17 +1,15 @@
 package agent
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
-	"os"
-	"sync"
 	"time"
 
-	"k8s.io/api/core/v1"
-	policyv1beta1 "k8s.io/api/policy/v1beta1"
-	"k8s.io/apimachinery/pkg/api/errors"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
@@ -19,347 +17,481 @@ import (
 	"github.com/utilitywarehouse/kube-node-cycle-operator/kube/k8sutil"
 	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
 	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/drain"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
 )
 
 const defaultPollInterval = 10 * time.Second
 
-type Status struct {
-	UpdateNeeded     string
-	UpdateInProgress string
-	LastCheckedTime  time.Time
-}
-
 type NodeAgent struct {
 	node string
-	kc   kubernetes.Interface
-	nc   v1core.NodeInterface
-	cc   models.NodeClientInterface
-	s    *Status
+	// bootID of the running node, recorded in the state when draining starts
+	bootID string
+	// uid of the Node object of the instance, whose state is the only one the
+	// agent writes
+	uid     types.UID
+	kc      kubernetes.Interface
+	nc      v1core.NodeInterface
+	cc      models.NodeClientInterface
+	drainer *drain.Drainer
+	conf    Config
+	reload  chan Config
+
+	// intent is the last action annotated in dry run
+	intent string
 }
 
-type NodeAgentInterface interface {
-	Run()
-	cleanUpOnStartup()
-	updateStatus()
-	drainNode() error
-	getPodsForTermination() ([]v1.Pod, error)
-	deletePod(pod v1.Pod) error
-	evictPod(pod v1.Pod) error
-	waitForPodTermination(pod v1.Pod, podReapTimeOut time.Duration) error
-	syncPodsTermination(pods []v1.Pod, timeout time.Duration)
-	terminateNode() error
-	drainAndTerminate()
+// Config holds the agent settings, all of which can be reloaded while it runs
+type Config struct {
+	// PollInterval is how often updates and approval are checked
+	PollInterval time.Duration
+	// DryRun agents report updates but only annotate the node with what they
+	// would do once approved, never cordoning, draining or terminating it
+	DryRun bool
+	// EvictionTimeout and DeletionTimeout are how long pods are given to
+	// terminate when draining
+	EvictionTimeout time.Duration
+	DeletionTimeout time.Duration
+	// ExcludedOwners lists the kinds of owners whose pods are not drained
+	ExcludedOwners []string
 }
 
-func New(node, kubeConfig string, nodeClientInterface models.NodeClientInterface) (*NodeAgent, error) {
-	// kube client
-	kubeClient, err := k8sutil.GetClient(kubeConfig)
-	if err != nil {
-		return nil, err
-	}
+type NodeAgentInterface interface {
+	Run(ctx context.Context)
+	checkApproval(ctx context.Context) bool
+	cleanUpOnStartup() nodestate.Phase
+	update(f func(*nodestate.State) error) error
+	transition(to nodestate.Phase, message string) error
+	drainNode(ctx context.Context) error
+	terminateNode(ctx context.Context) error
+	drain(ctx context.Context) error
+	terminate(ctx context.Context) error
+	terminateOnce(ctx context.Context) error
+	drainAndTerminate(ctx context.Context, from nodestate.Phase) error
+	Start() nodestate.Phase
+	Step(ctx context.Context) error
+	reportError(err error)
+	annotateIntent(action string)
+	Reload(conf Config)
+	apply(conf Config)
+}
 
+// New returns the agent of node, sharing the kube client of the caller
+func New(node string, kubeClient kubernetes.Interface, nodeClientInterface models.NodeClientInterface, conf Config) *NodeAgent {
 	// node interface
 	kubeNodeInterface := kubeClient.CoreV1().Nodes()
 
-	// Initial Status
-	st := &Status{
-		UpdateNeeded:     annotations.AnnoFalse,
-		UpdateInProgress: annotations.AnnoFalse,
-		LastCheckedTime:  time.Now(),
+	agent := &NodeAgent{
+		node:    node,
+		kc:      kubeClient,
+		nc:      kubeNodeInterface,
+		cc:      nodeClientInterface,
+		drainer: drain.New(kubeClient),
+		reload:  make(chan Config, 1),
+	}
+	agent.apply(conf)
+	return agent
+}
+
+// Run waits for the operator to approve the node, then drains and terminates
+// it. It returns when ctx is cancelled. A cycle interrupted this way is resumed
+// from its recorded phase on the next start.
+func (na *NodeAgent) Run(ctx context.Context) {
+
+	phase := na.cleanUpOnStartup()
+
+	ticker := time.NewTicker(na.conf.PollInterval)
+	defer func() { ticker.Stop() }()
+
+	for phase == nodestate.Idle && !na.checkApproval(ctx) {
+		select {
+		case <-ctx.Done():
+			log.Println("[INFO] agent stopped")
+			return
+		case conf := <-na.reload:
+			log.Println("[INFO] applying reloaded configuration")
+			na.apply(conf)
+			ticker.Stop()
+			ticker = time.NewTicker(na.conf.PollInterval)
+		case <-ticker.C:
+		}
 	}
 
-	agent := &NodeAgent{
-		node: node,
-		kc:   kubeClient,
-		nc:   kubeNodeInterface,
-		cc:   nodeClientInterface,
-		s:    st,
+	if err := na.drainAndTerminate(ctx, phase); err != nil {
+		if ctx.Err() != nil {
+			log.Println("[INFO] cycle interrupted:", err)
+			return
+		}
+		log.Println("[ERROR] cycle failed, waiting for the node to be reset:", err)
+		<-ctx.Done()
+		return
 	}
-	return agent, nil
+
+	// Nothing left to do but wait for the instance to go away
+	log.Println("[INFO] Falling asleep, bye..")
+	<-ctx.Done()
 }
 
-func (na *NodeAgent) Run() {
+// Reload replaces the configuration of a running agent. It is applied between
+// two checks: a cycle in progress finishes with the settings it started with.
+func (na *NodeAgent) Reload(conf Config) {
+	select {
+	case <-na.reload:
+		// superseded
+	default:
+	}
+	na.reload <- conf
+}
 
-	// Initialise Annotations
-	log.Println("[INFO] Annotations Init")
-	na.updateStatus()
-	na.cleanUpOnStartup()
+// apply sets the configuration of the agent and its drainer
+func (na *NodeAgent) apply(conf Config) {
+	if conf.PollInterval <= 0 {
+		conf.PollInterval = 30 * time.Second
+	}
+	na.conf = conf
+	if conf.EvictionTimeout > 0 {
+		na.drainer.EvictionTimeout = conf.EvictionTimeout
+	}
+	if conf.DeletionTimeout > 0 {
+		na.drainer.DeletionTimeout = conf.DeletionTimeout
+	}
+	if conf.ExcludedOwners != nil {
+		na.drainer.ExcludedOwners = conf.ExcludedOwners
+	}
+}
 
-	for t := time.Tick(30 * time.Second); ; <-t {
-		n, err := na.nc.Get(na.node, v1meta.GetOptions{})
-		if err != nil {
-			log.Println("[INFO] failed to get self node (%q): %v", na.node, err)
-			continue
-		}
+// checkApproval reports update needs through the node state and returns true
+// once the node is approved and moved to Draining
+func (na *NodeAgent) checkApproval(ctx context.Context) bool {
+	st, err := nodestate.Get(na.nc, na.node)
+	if err != nil {
+		log.Println("[ERROR] failed to get self node state:", err)
+		return false
+	}
 
-		needsUpdate, err := na.cc.NeedsUpdate()
-		if err != nil {
-			log.Println("[ERROR] ", err)
-			continue
+	// Permission given by the operator or forced termination
+	if st.Phase == nodestate.Approved {
+		if na.conf.DryRun {
+			na.annotateIntent("drain and terminate node")
+			return false
 		}
-
-		// Update Needed discovery
-		if needsUpdate && na.s.UpdateNeeded == annotations.AnnoFalse {
-			log.Println("[INFO] Update Needed Detected")
-			na.s.UpdateNeeded = annotations.AnnoTrue
-			na.updateStatus()
-			continue
+		if st.Forced {
+			log.Println("[INFO] Forcing Termination")
 		}
-
-		// Force Termination
-		if val, ok := n.Annotations[annotations.ForceTermination]; ok {
-			if val == annotations.AnnoTrue {
-				log.Println("[INFO] Forcing Termination")
-				na.s.UpdateInProgress = annotations.AnnoTrue
-				na.updateStatus()
-				break
-			}
+		if err := na.update(func(s *nodestate.State) error {
+			s.BootID = na.bootID
+			return s.Transition(nodestate.Draining, "draining node")
+		}); err != nil {
+			log.Println("[ERROR] failed to start draining:", err)
+			return false
 		}
-		// In case of update needed
-		if needsUpdate && na.s.UpdateNeeded == annotations.AnnoTrue {
+		return true
+	}
 
-			// Poll for permission to start
-			if _, ok := n.Annotations[annotations.CanStartTermination]; !ok {
-				// Ignore and continue to poll on the next iteration
-				continue
-			}
+	// Permanent errors, such as missing permissions, are reported for the
+	// operator to see, others are retried on the next check
+	needsUpdate, reason, err := na.cc.NeedsUpdate(ctx)
+	if models.IsPermanent(err) {
+		log.Println("[ERROR] permanent error checking for updates:", err)
+		if msg := fmt.Sprintf("update check failed: %v", err); st.Error != msg {
+			na.reportError(errors.New(msg))
+		}
+		return false
+	}
+	if err != nil {
+		log.Println("[ERROR] ", err)
+		return false
+	}
+	if st.Error != "" {
+		if err := na.update(func(s *nodestate.State) error {
+			s.Error = ""
+			return nil
+		}); err != nil {
+			log.Println("[ERROR] failed to clear update check error:", err)
+		}
+	}
 
-			if n.Annotations[annotations.CanStartTermination] == annotations.AnnoTrue {
-				// Update status and exit main loop
-				na.s.UpdateInProgress = annotations.AnnoTrue
-				na.updateStatus()
-				break
-			}
+	if na.conf.DryRun {
+		if needsUpdate {
+			na.annotateIntent("wait for approval: " + reason)
+		} else {
+			na.annotateIntent("keep node, no update needed")
+		}
+	}
 
+	// Update Needed discovery
+	if needsUpdate && st.Phase == nodestate.Idle {
+		log.Println("[INFO] Update Needed Detected")
+		if err := na.update(func(s *nodestate.State) error {
+			s.Reason = reason
+			return s.Transition(nodestate.UpdateNeeded, reason)
+		}); err != nil {
+			log.Println("[ERROR] failed to request update:", err)
 		}
+		return false
 	}
-	if na.s.UpdateNeeded == annotations.AnnoTrue && na.s.UpdateInProgress == annotations.AnnoTrue {
-		na.drainAndTerminate()
 
-		//sleep and hope for the best
-		log.Println("[INFO] Falling asleep, bye..")
-		for {
-			time.Sleep(60 * time.Second)
-			log.Println("[INFO] sleeping...")
+	// The group template may have been rolled back
+	if !needsUpdate && st.Phase == nodestate.UpdateNeeded {
+		log.Println("[INFO] Update no longer needed")
+		if err := na.transition(nodestate.Idle, "update no longer needed"); err != nil {
+			log.Println("[ERROR] failed to clear update request:", err)
 		}
-	} else {
-		log.Println("[ERROR] Exited main loop with unexpected status")
-		os.Exit(1)
 	}
+	return false
 }
 
-func (na *NodeAgent) cleanUpOnStartup() {
+// Start prepares the agent for Step as Run does on startup, resetting the
+// state left by a replaced instance. It returns the phase to resume from.
+func (na *NodeAgent) Start() nodestate.Phase {
+	return na.cleanUpOnStartup()
+}
+
+// cleanUpOnStartup looks for a cycle interrupted by a restart and returns the
+// phase to resume it from, or Idle when there is none. A cycle recorded under
+// a different boot id belongs to the instance that was replaced: its state is
+// reset and the node made schedulable again.
+func (na *NodeAgent) cleanUpOnStartup() nodestate.Phase {
 	n, err := na.nc.Get(na.node, v1meta.GetOptions{})
 	if err != nil {
 		log.Fatal(fmt.Sprintf("failed to get self node during startup (%q): %v", na.node, err))
 	}
+	na.bootID = n.Status.NodeInfo.BootID
+	na.uid = n.UID
 
-	if _, ok := n.Annotations[annotations.CanStartTermination]; !ok {
-		return
+	st, err := nodestate.FromNode(*n)
+	if err != nil {
+		log.Fatal(fmt.Sprintf("failed to get self node state during startup (%q): %v", na.node, err))
+	}
+	if !st.InProgress() {
+		return nodestate.Idle
+	}
+	if na.conf.DryRun {
+		log.Println("[INFO] dry run: not resuming cycle in phase", st.Phase)
+		return nodestate.Idle
 	}
 
-	if n.Annotations[annotations.CanStartTermination] == annotations.AnnoTrue {
-
-		log.Println(fmt.Sprintf("[INFO] Cleaning annotation: %s", annotations.CanStartTermination))
-		anno := map[string]string{
-			annotations.CanStartTermination: annotations.AnnoFalse,
+	if st.BootID != "" && st.BootID != na.bootID {
+		log.Println("[INFO] Node instance was replaced, resetting cycle state")
+		if _, err := nodestate.Reset(na.nc, na.node, "instance replaced"); err != nil {
+			log.Fatal(err)
 		}
-		wait.PollUntil(defaultPollInterval, func() (bool, error) {
-			if err := k8sutil.SetNodeAnnotations(na.nc, na.node, anno); err != nil {
-				return false, nil
-			}
-			return true, nil
-		}, wait.NeverStop)
-
 		log.Println("[INFO] Setting Node Schedulable")
 		if err := k8sutil.Unschedulable(na.nc, na.node, false); err != nil {
 			log.Fatal(err)
 		}
+		return nodestate.Idle
 	}
 
+	log.Println("[INFO] Resuming interrupted cycle from phase", st.Phase)
+	return st.Phase
 }
 
-// write status to node annotations
-func (na *NodeAgent) updateStatus() {
-	anno := map[string]string{
-		annotations.UpdateNeeded:     na.s.UpdateNeeded,
-		annotations.LastCheckedTime:  fmt.Sprintf("%v", na.s.LastCheckedTime),
-		annotations.UpdateInProgress: na.s.UpdateInProgress,
-	}
-
-	wait.PollUntil(defaultPollInterval, func() (bool, error) {
-		if err := k8sutil.SetNodeAnnotations(na.nc, na.node, anno); err != nil {
+// update applies f to the node state, retrying until it is written. Writes are
+// not cancelled on shutdown so that the state always matches what the agent
+// did. Errors returned by f, such as invalid transitions, are not retried and
+// neither is a node deleted or replaced along with its instance.
+func (na *NodeAgent) update(f func(*nodestate.State) error) error {
+	var ferr error
+	wait.PollImmediateUntil(defaultPollInterval, func() (bool, error) {
+		_, err := nodestate.UpdateInstance(na.nc, na.node, na.uid, func(s *nodestate.State) error {
+			ferr = f(s)
+			return ferr
+		})
+		if ferr != nil {
+			return true, nil
+		}
+		if apierrors.IsNotFound(err) {
+			ferr = err
+			return true, nil
+		}
+		if err != nil {
+			log.Println("[ERROR] failed to update node state:", err)
 			return false, nil
 		}
 		return true, nil
 	}, wait.NeverStop)
+	return ferr
 }
 
-// Get list of pods that run on the node and are not owned by a DaemonSet
-func (na *NodeAgent) getPodsForTermination() ([]v1.Pod, error) {
-
-	pods := []v1.Pod{}
-
-	// Get all pods running on the node
-	podList, err := na.kc.CoreV1().Pods(v1.NamespaceAll).List(v1meta.ListOptions{
-		FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": na.node}).String(),
+// transition moves the node state to phase `to`
+func (na *NodeAgent) transition(to nodestate.Phase, message string) error {
+	return na.update(func(s *nodestate.State) error {
+		return s.Transition(to, message)
 	})
-	if err != nil {
-		return pods, err
-	}
-
-	// exclude daemonsets
-	for _, pod := range podList.Items {
-		exclude := false
-		for _, ownerRef := range pod.OwnerReferences {
-			// If daemonset reference is present just ignore without testing that the daemonset actually exists
-			if ownerRef.Kind == "DaemonSet" {
-				log.Println("[INFO] excluding %s as part of a daemonset", pod.Name)
-				exclude = true
-				break
-			}
-		}
-		if !exclude {
-			pods = append(pods, pod)
-		}
-	}
-	return pods, nil
 }
 
-// drain the node by evicting and then deleting what failed to evict
-func (na *NodeAgent) drainNode() error {
-
-	// Mark not Unschedulable
-	log.Println("[INFO] Marking node unschedulable")
-	if err := k8sutil.Unschedulable(na.nc, na.node, true); err != nil {
-		return err
+// report a cycle error to the operator through the node state
+func (na *NodeAgent) reportError(err error) {
+	if uerr := na.update(func(s *nodestate.State) error {
+		s.Error = err.Error()
+		return nil
+	}); uerr != nil {
+		log.Println("[ERROR] failed to report error:", uerr)
 	}
+}
 
-	// First try to evict pods
-	pods, err := na.getPodsForTermination()
-	if err != nil {
-		return err
+// annotateIntent records the action a dry run agent would take on the node
+func (na *NodeAgent) annotateIntent(action string) {
+	if action == na.intent {
+		return
 	}
-	for _, pod := range pods {
-		log.Println("[INFO] evicting pod: %s", pod.Name)
-		if err := na.evictPod(pod); err != nil {
-			log.Println("[ERROR] evicting pod: %s %v", pod.Name, err)
-			// Just continue and will attempt to delete later
-		}
+	log.Println("[INFO] dry run: would", action)
+	if err := k8sutil.SetNodeAnnotations(na.nc, na.node, map[string]string{annotations.DryRun: action}); err != nil {
+		log.Println("[ERROR] failed to annotate dry run intent:", err)
+		return
 	}
-	// Allow 10 minutes for pods eviction
-	na.syncPodsTermination(pods, 10*time.Minute)
+	na.intent = action
+}
 
-	// Delete pods that were not drained
-	pods, err = na.getPodsForTermination()
+// drain the node through the shared drainer
+func (na *NodeAgent) drainNode(ctx context.Context) error {
+	return na.drainer.Drain(ctx, na.node)
+}
+
+// Call node termination, unless already issued, and wait for the cloud
+// operation to complete. The operation is recorded in the node state before
+// waiting so that it is not issued twice and the operator can follow it.
+func (na *NodeAgent) terminateNode(ctx context.Context) error {
+	st, err := nodestate.Get(na.nc, na.node)
 	if err != nil {
 		return err
 	}
-	for _, pod := range pods {
-		log.Println("[INFO] deleting  pod: %s", pod.Name)
-		if err := na.deletePod(pod); err != nil {
-			log.Println("[ERROR] deleting pod: %s %v", pod.Name, err)
+
+	operation := st.Operation
+	if operation == "" {
+		if operation, err = na.cc.TerminateNode(ctx); err != nil {
+			return err
+		}
+		log.Println("[INFO] Issued Node termination, operation:", operation)
+		if err := na.update(func(s *nodestate.State) error {
+			s.Operation = operation
+			return nil
+		}); err != nil {
+			return err
 		}
 	}
-	// Allow 2 minutes for pods to delete
-	na.syncPodsTermination(pods, 2*time.Minute)
 
-	return nil
+	log.Println("[INFO] Waiting for termination operation:", operation)
+	return na.cc.WaitForTermination(ctx, operation)
 }
 
-// deletes a pod
-func (na *NodeAgent) deletePod(pod v1.Pod) error {
-	if err := na.kc.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &v1meta.DeleteOptions{}); err != nil {
-		return err
+// Drain and terminate, retrying until done or ctx is cancelled. Steps before
+// phase `from` are skipped when resuming an interrupted cycle.
+func (na *NodeAgent) drainAndTerminate(ctx context.Context, from nodestate.Phase) error {
+	switch from {
+	case nodestate.Done:
+		return nil
+	case nodestate.Terminating:
+		return na.terminate(ctx)
 	}
-	return nil
-}
 
-// evicts pod from the node
-func (na *NodeAgent) evictPod(pod v1.Pod) error {
-
-	eviction := &policyv1beta1.Eviction{
-		TypeMeta: v1meta.TypeMeta{},
-		ObjectMeta: v1meta.ObjectMeta{
-			Name:      pod.Name,
-			Namespace: pod.Namespace,
-		},
-		DeleteOptions: &v1meta.DeleteOptions{},
+	// Drain
+	for {
+		err := na.drain(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err == nil {
+			return na.terminate(ctx)
+		}
+		log.Printf("[ERROR] Error while draining node %v, retrying in 10 seconds..", err)
+		if err := sleep(ctx, 10*time.Second); err != nil {
+			return err
+		}
 	}
+}
 
-	if err := na.kc.PolicyV1beta1().Evictions(eviction.Namespace).Evict(eviction); err != nil {
+// drain drains the node once and moves it to Terminating. A failed drain is
+// reported for the operator to see.
+func (na *NodeAgent) drain(ctx context.Context) error {
+	if err := na.drainNode(ctx); err != nil {
+		if ctx.Err() == nil {
+			na.reportError(fmt.Errorf("drain failed: %v", err))
+		}
 		return err
 	}
+	log.Println("[INFO] Node drained")
+	if err := na.transition(nodestate.Terminating, "terminating node"); err != nil {
+		log.Println("[ERROR] ", err)
+	}
 	return nil
 }
 
-// waits for a pod to be deleted for podReapTimeOut
-func (na *NodeAgent) waitForPodTermination(pod v1.Pod, podReapTimeOut time.Duration) error {
-
-	return wait.PollImmediate(defaultPollInterval, podReapTimeOut, func() (bool, error) {
-		p, err := na.kc.CoreV1().Pods(pod.Namespace).Get(pod.Name, v1meta.GetOptions{})
-		if errors.IsNotFound(err) || (p != nil && p.ObjectMeta.UID != pod.ObjectMeta.UID) {
-			log.Println("[INFO] Terminated pod %q", pod.Name)
-			return true, nil
+// terminate issues the node termination, retrying until done or ctx is
+// cancelled. Permanent cloud errors, including a failed operation, fail the
+// cycle.
+func (na *NodeAgent) terminate(ctx context.Context) error {
+	for {
+		err := na.terminateOnce(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
 		}
-
-		// most errors will be transient. log the error and continue
-		// polling
-		if err != nil {
-			log.Println("[ERROR] Failed to get pod %q: %v", pod.Name, err)
+		if err == nil || models.IsPermanent(err) {
+			return err
 		}
-
-		return false, nil
-	})
+		log.Printf("[ERROR] Error while terminating node %v, retrying in 10 seconds..", err)
+		if err := sleep(ctx, 10*time.Second); err != nil {
+			return err
+		}
+	}
 }
 
-// Gets a pod list and waits for them a certain amount of time (timeout) to terminate
-func (na *NodeAgent) syncPodsTermination(pods []v1.Pod, timeout time.Duration) {
-
-	wg := sync.WaitGroup{}
-	for _, pod := range pods {
-		wg.Add(1)
-		go func(pod v1.Pod) {
-			log.Println("[INFO] Waiting for pod %q to terminate", pod.Name)
-			if err := na.waitForPodTermination(pod, timeout); err != nil {
-				log.Println("[INFO] Skipping wait on pod %q: %v", pod.Name, err)
+// terminateOnce terminates the node and moves it to Done, or to Failed on a
+// permanent error. Other errors are reported for the operator to see.
+func (na *NodeAgent) terminateOnce(ctx context.Context) error {
+	err := na.terminateNode(ctx)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	if err != nil {
+		na.reportError(fmt.Errorf("termination failed: %v", err))
+		if models.IsPermanent(err) {
+			if terr := na.transition(nodestate.Failed, "termination failed"); terr != nil {
+				log.Println("[ERROR] ", terr)
 			}
-			wg.Done()
-		}(pod)
+		}
+		return err
+	}
+	log.Println("[INFO] Node termination completed")
+	err = na.transition(nodestate.Done, "termination completed")
+	if apierrors.IsNotFound(err) {
+		log.Println("[INFO] Node removed along with its instance")
+	} else if err != nil {
+		log.Println("[ERROR] ", err)
 	}
-	wg.Wait()
+	return nil
 }
 
-// Call node termination or throw error
-func (na *NodeAgent) terminateNode() error {
-	if err := na.cc.TerminateNode(); err != nil {
+// Step runs a single check of the agent: before approval it reports whether
+// the node needs updating and starts draining once approved, afterwards it
+// moves the node one phase forward without retrying. Run does the same in a
+// loop. Start must be called first.
+func (na *NodeAgent) Step(ctx context.Context) error {
+	st, err := nodestate.Get(na.nc, na.node)
+	if err != nil {
 		return err
 	}
+	switch st.Phase {
+	case nodestate.Draining:
+		return na.drain(ctx)
+	case nodestate.Terminating:
+		return na.terminateOnce(ctx)
+	case nodestate.Done, nodestate.Failed:
+		return nil
+	}
+	na.checkApproval(ctx)
 	return nil
 }
 
-// Drain and terminate or loop forever
-func (na *NodeAgent) drainAndTerminate() {
-
-	// Drain
-	for {
-		if err := na.drainNode(); err != nil {
-			log.Println("[ERROR] Error while draining node %v, retrying in 10 seconds..", err)
-			time.Sleep(10 * time.Second)
-		} else {
-			log.Println("[INFO] Node drained")
-			break
-		}
-	}
-
-	// Terminate
-	for {
-		if err := na.terminateNode(); err != nil {
-			log.Println("[ERROR] Error while terminating node %v, retrying in 10 seconds..", err)
-			time.Sleep(10 * time.Second)
-		} else {
-			log.Println("[INFO] Issued Node termination")
-			break
-		}
+// sleep waits for d or returns early with the error of a cancelled ctx
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
 	}
 }
@@ -0,0 +1,280 @@
+package agent
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	cloudfake "github.com/utilitywarehouse/kube-node-cycle-operator/cloud/fake"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+// testNodeClient records the terminations issued and waited for
+type testNodeClient struct {
+	outdated   bool
+	err        error
+	terminated []string
+	waited     []string
+}
+
+func (c *testNodeClient) NeedsUpdate(ctx context.Context) (bool, string, error) {
+	return c.outdated, "new template", c.err
+}
+
+func (c *testNodeClient) TerminateNode(ctx context.Context) (string, error) {
+	c.terminated = append(c.terminated, "operation-new")
+	return "operation-new", nil
+}
+
+func (c *testNodeClient) WaitForTermination(ctx context.Context, operation string) error {
+	c.waited = append(c.waited, operation)
+	return nil
+}
+
+// testAgent returns the agent of node-a, booted as boot-a, whose state was
+// left as st by a previous run
+func testAgent(t *testing.T, st nodestate.State, conf Config) (*NodeAgent, *fake.Clientset, *testNodeClient) {
+	raw, err := st.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	kc := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: v1meta.ObjectMeta{Name: "node-a", Annotations: map[string]string{annotations.State: raw}},
+		Spec:       v1.NodeSpec{Unschedulable: st.InProgress()},
+		Status:     v1.NodeStatus{NodeInfo: v1.NodeSystemInfo{BootID: "boot-a"}},
+	})
+	cc := &testNodeClient{}
+	return New("node-a", kc, cc, conf), kc, cc
+}
+
+func TestResumeCycle(t *testing.T) {
+	tests := []struct {
+		name       string
+		phase      nodestate.Phase
+		bootID     string
+		operation  string
+		dryRun     bool
+		resume     nodestate.Phase
+		terminated int
+		waited     string
+	}{
+		{
+			name:       "restarted while draining",
+			phase:      nodestate.Draining,
+			bootID:     "boot-a",
+			resume:     nodestate.Draining,
+			terminated: 1,
+			waited:     "operation-new",
+		},
+		{
+			name:      "restarted while terminating",
+			phase:     nodestate.Terminating,
+			bootID:    "boot-a",
+			operation: "operation-old",
+			resume:    nodestate.Terminating,
+			waited:    "operation-old",
+		},
+		{
+			name:       "restarted before the operation was recorded",
+			phase:      nodestate.Terminating,
+			bootID:     "boot-a",
+			resume:     nodestate.Terminating,
+			terminated: 1,
+			waited:     "operation-new",
+		},
+		{
+			name:   "dry run",
+			phase:  nodestate.Draining,
+			bootID: "boot-a",
+			dryRun: true,
+			resume: nodestate.Idle,
+		},
+	}
+
+	for _, test := range tests {
+		st := nodestate.New()
+		st.Phase = test.phase
+		st.BootID = test.bootID
+		st.Operation = test.operation
+		na, kc, cc := testAgent(t, st, Config{DryRun: test.dryRun})
+
+		phase := na.cleanUpOnStartup()
+		if phase != test.resume {
+			t.Errorf("%s: expected to resume from %s, got %s", test.name, test.resume, phase)
+			continue
+		}
+		if phase == nodestate.Idle {
+			continue
+		}
+		if err := na.drainAndTerminate(context.Background(), phase); err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+
+		if len(cc.terminated) != test.terminated {
+			t.Errorf("%s: expected %d terminations issued, got %v", test.name, test.terminated, cc.terminated)
+		}
+		if len(cc.waited) != 1 || cc.waited[0] != test.waited {
+			t.Errorf("%s: expected to wait for %s, got %v", test.name, test.waited, cc.waited)
+		}
+		got, err := nodestate.Get(kc.CoreV1().Nodes(), "node-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Phase != nodestate.Done || got.Operation != test.waited {
+			t.Errorf("%s: expected done with operation %s, got %s with %q", test.name, test.waited, got.Phase, got.Operation)
+		}
+	}
+}
+
+func TestResetReplacedInstance(t *testing.T) {
+	st := nodestate.New()
+	st.Phase = nodestate.Terminating
+	st.BootID = "boot-old"
+	na, kc, _ := testAgent(t, st, Config{})
+
+	if phase := na.cleanUpOnStartup(); phase != nodestate.Idle {
+		t.Errorf("expected a replaced instance to start idle, got %s", phase)
+	}
+	n, err := kc.CoreV1().Nodes().Get("node-a", v1meta.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := nodestate.FromNode(*n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Phase != nodestate.Idle || n.Spec.Unschedulable {
+		t.Errorf("expected the state reset and the node schedulable, got %s (unschedulable %v)", got.Phase, n.Spec.Unschedulable)
+	}
+}
+
+func TestCheckApprovalErrors(t *testing.T) {
+	na, kc, cc := testAgent(t, nodestate.New(), Config{})
+	na.Start()
+
+	for _, test := range []struct {
+		err      error
+		expected string
+	}{
+		// Transient errors are only logged
+		{errors.New("connection reset"), ""},
+		{&models.PermanentError{Err: errors.New("forbidden")}, "update check failed: forbidden"},
+		// and a successful check clears the error
+		{nil, ""},
+	} {
+		cc.err = test.err
+		na.checkApproval(context.Background())
+		st, err := nodestate.Get(kc.CoreV1().Nodes(), "node-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Phase != nodestate.Idle || st.Error != test.expected {
+			t.Errorf("%v: expected idle with error %q, got %s with %q", test.err, test.expected, st.Phase, st.Error)
+		}
+	}
+}
+
+func TestStep(t *testing.T) {
+	na, kc, cc := testAgent(t, nodestate.New(), Config{})
+	na.Start()
+	cc.outdated = true
+
+	for _, expected := range []nodestate.Phase{
+		nodestate.UpdateNeeded,
+		// waiting for approval
+		nodestate.UpdateNeeded,
+		nodestate.Draining,
+		nodestate.Terminating,
+		nodestate.Done,
+		nodestate.Done,
+	} {
+		if expected == nodestate.Draining {
+			if _, err := nodestate.Transition(kc.CoreV1().Nodes(), "node-a", nodestate.Approved, "granted"); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := na.Step(context.Background()); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		st, err := nodestate.Get(kc.CoreV1().Nodes(), "node-a")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Phase != expected {
+			t.Fatalf("expected phase %s, got %s", expected, st.Phase)
+		}
+	}
+	if len(cc.terminated) != 1 {
+		t.Errorf("expected a single termination, got %v", cc.terminated)
+	}
+}
+
+// outdatedSource declares every node outdated to the fake provider
+type outdatedSource struct{}
+
+func (outdatedSource) Outdated() (map[string]string, error) {
+	return map[string]string{"node-a": "new template"}, nil
+}
+
+func TestCycleWithFakeProvider(t *testing.T) {
+	for _, recreate := range []bool{false, true} {
+		kc := fake.NewSimpleClientset(&v1.Node{
+			ObjectMeta: v1meta.ObjectMeta{Name: "node-a", UID: "uid-a"},
+			Spec:       v1.NodeSpec{ProviderID: "fake://node-a"},
+			Status:     v1.NodeStatus{NodeInfo: v1.NodeSystemInfo{BootID: "boot-a"}},
+		})
+		p := cloudfake.New(kc, outdatedSource{})
+		p.Recreate = recreate
+		na := New("node-a", kc, p.Node("node-a"), Config{})
+		na.Start()
+
+		for i := 0; i < 4; i++ {
+			if i == 1 {
+				if _, err := nodestate.Transition(kc.CoreV1().Nodes(), "node-a", nodestate.Approved, "granted"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := na.Step(context.Background()); err != nil {
+				t.Fatalf("recreate %v: unexpected error: %v", recreate, err)
+			}
+		}
+
+		// The operation is recorded before the instance goes away
+		recorded := false
+		for _, a := range kc.Actions() {
+			if a.GetVerb() == "delete" {
+				break
+			}
+			if u, ok := a.(k8stesting.UpdateAction); ok {
+				if st, err := nodestate.FromNode(*u.GetObject().(*v1.Node)); err == nil && st.Operation != "" {
+					recorded = true
+				}
+			}
+		}
+		if !recorded {
+			t.Errorf("recreate %v: expected the operation recorded before the node was deleted", recreate)
+		}
+
+		n, err := kc.CoreV1().Nodes().Get("node-a", v1meta.GetOptions{})
+		if !recreate {
+			if err == nil {
+				t.Errorf("expected node-a to be deleted")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("expected node-a to be registered again: %v", err)
+		}
+		// The agent of the old instance leaves the replacement alone
+		if st, err := nodestate.FromNode(*n); err != nil || st.Phase != nodestate.Idle || st.Operation != "" {
+			t.Errorf("expected the replacement idle, got %+v (%v)", st, err)
+		}
+	}
+}
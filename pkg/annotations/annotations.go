@@ -4,10 +4,37 @@ const (
 	AnnoTrue  = "true"
 	AnnoFalse = "false"
 
-	UpdateNeeded     = "node-cycle-agent/update-needed"
-	UpdateInProgress = "node-cycle-agent/update-in-progress"
-	LastCheckedTime  = "node-cycle-agent/last-checked-time"
+	// State holds the json encoded cycle state of a node, see pkg/nodestate
+	State = "node-cycle/state"
 
+	Skip = "node-cycle-operator/skip"
+
+	// Priority orders nodes with the priority strategy, highest first
+	Priority = "node-cycle/priority"
+
+	// DryRun holds the action an agent running with -dry_run would take
+	DryRun = "node-cycle/dry-run"
+
+	// Legacy keys, superseded by State. They are only read to pick up the
+	// state of nodes annotated by previous versions and removed on write.
+	UpdateNeeded        = "node-cycle-agent/update-needed"
+	UpdateInProgress    = "node-cycle-agent/update-in-progress"
+	LastCheckedTime     = "node-cycle-agent/last-checked-time"
+	UpdateReason        = "node-cycle-agent/update-reason"
+	CycleError          = "node-cycle-agent/cycle-error"
 	CanStartTermination = "node-cycle-operator/can-start-termination"
 	ForceTermination    = "node-cycle-operator/force-termination"
+	PermissionGivenTime = "node-cycle-operator/permission-given-time"
 )
+
+// Legacy lists the keys superseded by State
+var Legacy = []string{
+	UpdateNeeded,
+	UpdateInProgress,
+	LastCheckedTime,
+	UpdateReason,
+	CycleError,
+	CanStartTermination,
+	ForceTermination,
+	PermissionGivenTime,
+}
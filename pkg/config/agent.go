@@ -0,0 +1,124 @@
+package config
+
+import (
+	"fmt"
+	"time"
+)
+
+// Agent is the configuration of the node agent
+type Agent struct {
+	Version    string `json:"version"`
+	KubeConfig string `json:"kubeConfig,omitempty"`
+	// PollInterval is how often the agent checks for updates and approval
+	PollInterval Duration `json:"pollInterval"`
+	DryRun       bool     `json:"dryRun,omitempty"`
+
+	Cloud     AgentCloud     `json:"cloud"`
+	Templates AgentTemplates `json:"templates"`
+	Fake      Fake           `json:"fake,omitempty"`
+	Drain     Drain          `json:"drain"`
+}
+
+// AgentCloud selects the cloud provider of the node
+type AgentCloud struct {
+	// Provider is gcp or fake
+	Provider string `json:"provider"`
+	// Project and Region default to the ones of the instance
+	Project string `json:"project,omitempty"`
+	Region  string `json:"region,omitempty"`
+	// MetadataURL is the base url of the metadata api, up to and including
+	// the version. Defaults to the metadata server, or GCE_METADATA_HOST
+	MetadataURL string `json:"metadataURL,omitempty"`
+}
+
+// AgentTemplates sets how group templates are looked up
+type AgentTemplates struct {
+	// TTL is how long the template of a group manager is cached
+	TTL Duration `json:"ttl"`
+	// Namespace and ConfigMap of the templates published by the operator.
+	// Group managers are queried directly when ConfigMap is empty
+	Namespace string `json:"namespace"`
+	ConfigMap string `json:"configMap,omitempty"`
+	// MaxAge is how long published templates are trusted without an update
+	MaxAge Duration `json:"maxAge"`
+}
+
+// Fake configures the fake cloud provider
+type Fake struct {
+	// ConfigMap, as namespace/name, or File declaring outdated nodes
+	ConfigMap string `json:"configMap,omitempty"`
+	File      string `json:"file,omitempty"`
+	// Recreate registers a new Node object in place of a terminated one
+	Recreate bool `json:"recreate,omitempty"`
+}
+
+// Drain sets how nodes are emptied before termination
+type Drain struct {
+	// EvictionTimeout is how long evicted pods are given to terminate
+	EvictionTimeout Duration `json:"evictionTimeout"`
+	// DeletionTimeout is how long pods deleted after failing to evict are
+	// given to terminate
+	DeletionTimeout Duration `json:"deletionTimeout"`
+	// ExcludedOwners lists the kinds of owners whose pods are left running
+	ExcludedOwners []string `json:"excludedOwners"`
+}
+
+// DefaultAgent returns the agent configuration used when no file is given
+func DefaultAgent() Agent {
+	return Agent{
+		Version:      Version,
+		PollInterval: Duration{30 * time.Second},
+		Cloud:        AgentCloud{Provider: "gcp"},
+		Templates: AgentTemplates{
+			TTL:       Duration{5 * time.Minute},
+			Namespace: "kube-system",
+			MaxAge:    Duration{15 * time.Minute},
+		},
+		Drain: DefaultDrain(),
+	}
+}
+
+// DefaultDrain returns the drain settings used by both binaries
+func DefaultDrain() Drain {
+	return Drain{
+		EvictionTimeout: Duration{10 * time.Minute},
+		DeletionTimeout: Duration{2 * time.Minute},
+		ExcludedOwners:  []string{"DaemonSet"},
+	}
+}
+
+func (c *Agent) Validate() error {
+	if err := positive("pollInterval", c.PollInterval); err != nil {
+		return err
+	}
+	switch c.Cloud.Provider {
+	case "gcp":
+	case "fake":
+		if err := c.Fake.validate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown cloud provider %q, expected gcp or fake", c.Cloud.Provider)
+	}
+	if err := positive("templates.ttl", c.Templates.TTL); err != nil {
+		return err
+	}
+	if err := positive("templates.maxAge", c.Templates.MaxAge); err != nil {
+		return err
+	}
+	return c.Drain.validate()
+}
+
+func (f Fake) validate() error {
+	if (f.ConfigMap == "") == (f.File == "") {
+		return fmt.Errorf("exactly one of fake.configMap and fake.file must be set with the fake provider")
+	}
+	return nil
+}
+
+func (d Drain) validate() error {
+	if err := positive("drain.evictionTimeout", d.EvictionTimeout); err != nil {
+		return err
+	}
+	return positive("drain.deletionTimeout", d.DeletionTimeout)
+}
@@ -0,0 +1,174 @@
+// Package config loads the versioned yaml configuration files of the agent
+// and the operator. Settings are taken from the defaults, then the file, then
+// the flags set on the command line, and validated as a whole.
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/ghodss/yaml"
+)
+
+// Version is the only configuration version supported
+const Version = "v1"
+
+// DefaultWatchInterval is how often a configuration file is checked for changes
+const DefaultWatchInterval = 30 * time.Second
+
+// Duration is a time.Duration written as a string, e.g. 30s or 10m
+type Duration struct {
+	time.Duration
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("invalid duration %s, expected a string such as 30s", b)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+// Validator is a configuration that can tell whether it is usable
+type Validator interface {
+	Validate() error
+}
+
+// Load reads the yaml file at path, if any, over conf which holds the
+// defaults, then applies the flags in overrides on top. bind registers the
+// flags of the binary on a flag set, bound to the fields of conf.
+func Load(path string, conf Validator, bind func(*flag.FlagSet), overrides map[string]string) error {
+	if path != "" {
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := decode(raw, conf); err != nil {
+			return fmt.Errorf("invalid config file %s: %v", path, err)
+		}
+	}
+
+	fs := flag.NewFlagSet("overrides", flag.ContinueOnError)
+	bind(fs)
+	for name, value := range overrides {
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("invalid value %q for flag -%s: %v", value, name, err)
+		}
+	}
+	return conf.Validate()
+}
+
+// decode strictly unmarshals a yaml document of the supported version
+func decode(raw []byte, conf interface{}) error {
+	j, err := yaml.YAMLToJSON(raw)
+	if err != nil {
+		return err
+	}
+
+	v := struct {
+		Version string `json:"version"`
+	}{}
+	if err := json.Unmarshal(j, &v); err != nil {
+		return err
+	}
+	if v.Version != Version {
+		return fmt.Errorf("unsupported version %q, expected %q", v.Version, Version)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.DisallowUnknownFields()
+	return dec.Decode(conf)
+}
+
+// SetFlags returns the flags of fs set on the command line
+func SetFlags(fs *flag.FlagSet) map[string]string {
+	set := map[string]string{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = f.Value.String()
+	})
+	return set
+}
+
+// Watch calls reload whenever the content of the file at path changes, until
+// ctx is cancelled. Files mounted from a ConfigMap are updated in place by the
+// kubelet.
+func Watch(ctx context.Context, path string, interval time.Duration, reload func()) {
+	last, _ := checksum(path)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		sum, err := checksum(path)
+		if err != nil {
+			log.Println("[ERROR] failed to read config file:", err)
+			continue
+		}
+		if sum == last {
+			continue
+		}
+		log.Println("[INFO] config file changed, reloading:", path)
+		last = sum
+		reload()
+	}
+}
+
+func checksum(path string) ([sha256.Size]byte, error) {
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}, err
+	}
+	return sha256.Sum256(raw), nil
+}
+
+// Strings is a flag.Value setting a list from a comma separated string
+type Strings struct {
+	List *[]string
+}
+
+func (s Strings) String() string {
+	if s.List == nil {
+		return ""
+	}
+	return strings.Join(*s.List, ",")
+}
+
+func (s Strings) Set(v string) error {
+	*s.List = nil
+	if v != "" {
+		*s.List = strings.Split(v, ",")
+	}
+	return nil
+}
+
+func positive(name string, d Duration) error {
+	if d.Duration <= 0 {
+		return fmt.Errorf("%s must be positive, got %v", name, d.Duration)
+	}
+	return nil
+}
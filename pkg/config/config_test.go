@@ -0,0 +1,99 @@
+package config
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func loadOperator(path string, overrides map[string]string) (Operator, error) {
+	c := DefaultOperator()
+	err := Load(path, &c, func(fs *flag.FlagSet) {
+		fs.StringVar(&c.StatePath, "state_path", c.StatePath, "")
+		fs.IntVar(&c.FailureBudget, "failure_budget", c.FailureBudget, "")
+		fs.Var(Strings{List: &c.Health.Workloads}, "check_workloads", "")
+	}, overrides)
+	return c, err
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	path := writeFile(t, `
+version: v1
+statePath: /var/lib/operator/state.json
+failureBudget: 5
+cycleTimeout: 1h
+health:
+  workloads:
+  - deployment/kube-system/kube-dns
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	c, err := loadOperator(path, map[string]string{"failure_budget": "1"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if c.StatePath != "/var/lib/operator/state.json" {
+		t.Errorf("expected the state path of the file, got %q", c.StatePath)
+	}
+	if c.FailureBudget != 1 {
+		t.Errorf("expected the flag to take precedence, got %d", c.FailureBudget)
+	}
+	if c.CycleTimeout.Duration != time.Hour {
+		t.Errorf("expected the cycle timeout of the file, got %v", c.CycleTimeout)
+	}
+	if c.PollInterval.Duration != 30*time.Second {
+		t.Errorf("expected the default poll interval, got %v", c.PollInterval)
+	}
+	if len(c.Health.Workloads) != 1 {
+		t.Errorf("expected the workloads of the file, got %v", c.Health.Workloads)
+	}
+}
+
+func TestLoadInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		content string
+		err     string
+	}{
+		{"statePath: /state.json\n", "unsupported version"},
+		{"version: v2\nstatePath: /state.json\n", "unsupported version"},
+		{"version: v1\nstatePath: /state.json\npollIntrval: 10s\n", "unknown field"},
+		{"version: v1\nstatePath: /state.json\ncycleTimeout: 10\n", "invalid duration"},
+		{"version: v1\n", "statePath is required"},
+		{"version: v1\nstatePath: /state.json\nmasterLabel: master\n", "invalid masterLabel"},
+		{"version: v1\nstatePath: /state.json\ncloud:\n  agentless: true\n", "requires a cloud provider"},
+		{"version: v1\nstatePath: /state.json\nhealth:\n  workloads: [pod/default/x]\n", "invalid workload kind"},
+	} {
+		path := writeFile(t, tc.content)
+		_, err := loadOperator(path, nil)
+		os.RemoveAll(filepath.Dir(path))
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("expected error containing %q for %q, got %v", tc.err, tc.content, err)
+		}
+	}
+}
+
+func TestLoadWithoutFile(t *testing.T) {
+	c, err := loadOperator("", map[string]string{"state_path": "/state.json", "check_workloads": "deployment/a/b,statefulset/c/d"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(c.Health.Workloads) != 2 {
+		t.Errorf("expected 2 workloads, got %v", c.Health.Workloads)
+	}
+}
@@ -0,0 +1,263 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/etcd"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/health"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/notify"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/operator"
+)
+
+// Operator is the configuration of the operator
+type Operator struct {
+	Version    string `json:"version"`
+	KubeConfig string `json:"kubeConfig,omitempty"`
+	// StatePath is the file the operator keeps its state in. Shall be part of
+	// a persistent volume
+	StatePath string `json:"statePath"`
+	// ListenAddress serves the status API and metrics
+	ListenAddress string `json:"listenAddress"`
+	// PollInterval is the time between two reconciles
+	PollInterval Duration `json:"pollInterval"`
+	// PoolLabel is the node label grouping nodes into pools
+	PoolLabel string `json:"poolLabel"`
+	// MasterLabel, as key=value, selects the master nodes cycled first
+	MasterLabel string `json:"masterLabel"`
+	// Order lists the strategies picking the next node to cycle, later ones
+	// breaking the ties of earlier ones
+	Order []string `json:"order"`
+	// PoolOrder overrides Order within the pools it lists
+	PoolOrder map[string][]string `json:"poolOrder,omitempty"`
+	// ZoneAware rolls one zone after the other and stops granting while a
+	// zone has fewer Ready nodes than before the rollout
+	ZoneAware bool `json:"zoneAware,omitempty"`
+	// CycleTimeout is the time allowed from granting permission to a node
+	// until its replacement is Ready with its DaemonSets running
+	CycleTimeout Duration `json:"cycleTimeout"`
+	// FailureBudget is the number of failed cycles after which a pool is
+	// halted until manually resumed. Disabled when 0
+	FailureBudget int  `json:"failureBudget"`
+	DryRun        bool `json:"dryRun,omitempty"`
+
+	Control   Control           `json:"control"`
+	Cloud     OperatorCloud     `json:"cloud"`
+	Templates OperatorTemplates `json:"templates"`
+	Fake      Fake              `json:"fake,omitempty"`
+	Drain     Drain             `json:"drain"`
+	Health    Health            `json:"health"`
+	Etcd      Etcd              `json:"etcd,omitempty"`
+	Notify    Notify            `json:"notify"`
+}
+
+// Control locates the configmap used to pause, resume and abort the rollout
+type Control struct {
+	Namespace string `json:"namespace"`
+	ConfigMap string `json:"configMap"`
+}
+
+// OperatorCloud selects the cloud provider, if any
+type OperatorCloud struct {
+	// Provider is empty, gcp or fake
+	Provider string `json:"provider,omitempty"`
+	// Project and Region default to the ones the operator runs in
+	Project string `json:"project,omitempty"`
+	Region  string `json:"region,omitempty"`
+	// MetadataURL is the base url of the metadata api, up to and including
+	// the version. Defaults to the metadata server, or GCE_METADATA_HOST
+	MetadataURL string `json:"metadataURL,omitempty"`
+	// StaleNodeGrace is how long a node must be NotReady before checking
+	// whether its instance is gone
+	StaleNodeGrace Duration `json:"staleNodeGrace"`
+	// Agentless detects outdated nodes and cycles them from the operator
+	Agentless bool `json:"agentless,omitempty"`
+}
+
+// OperatorTemplates sets where group templates are published for agents
+type OperatorTemplates struct {
+	Namespace string `json:"namespace"`
+	// ConfigMap to publish to, disabled when empty
+	ConfigMap string   `json:"configMap,omitempty"`
+	Interval  Duration `json:"interval"`
+}
+
+// Health selects the checks run before every grant
+type Health struct {
+	KubeSystemPods bool `json:"kubeSystemPods,omitempty"`
+	// PendingPods blocks granting while a pod is unschedulable for longer
+	// than this. Disabled when 0
+	PendingPods     Duration `json:"pendingPods,omitempty"`
+	Workloads       []string `json:"workloads,omitempty"`
+	PrometheusURL   string   `json:"prometheusURL,omitempty"`
+	PrometheusQuery string   `json:"prometheusQuery,omitempty"`
+}
+
+// Config returns the settings of the health package
+func (h Health) Config() health.Config {
+	return health.Config{
+		KubeSystemPods:     h.KubeSystemPods,
+		PendingPodsTimeout: h.PendingPods.Duration,
+		Workloads:          h.Workloads,
+		PrometheusURL:      h.PrometheusURL,
+		PrometheusQuery:    h.PrometheusQuery,
+	}
+}
+
+// Etcd locates the etcd cluster running on the masters. Masters are cycled
+// without checking etcd when Endpoints is empty
+type Etcd struct {
+	Endpoints   []string `json:"endpoints,omitempty"`
+	CAFile      string   `json:"caFile,omitempty"`
+	CertFile    string   `json:"certFile,omitempty"`
+	KeyFile     string   `json:"keyFile,omitempty"`
+	DialTimeout Duration `json:"dialTimeout"`
+}
+
+// Config returns the settings of the etcd package
+func (e Etcd) Config() etcd.Config {
+	return etcd.Config{
+		Endpoints:   e.Endpoints,
+		CAFile:      e.CAFile,
+		CertFile:    e.CertFile,
+		KeyFile:     e.KeyFile,
+		DialTimeout: e.DialTimeout.Duration,
+	}
+}
+
+func (e Etcd) validate() error {
+	if err := positive("etcd.dialTimeout", e.DialTimeout); err != nil {
+		return err
+	}
+	if (e.CertFile == "") != (e.KeyFile == "") {
+		return fmt.Errorf("etcd certFile and keyFile must be set together")
+	}
+	return nil
+}
+
+// Notify sets the webhook rollout progress is posted to. Disabled when URL is
+// empty
+type Notify struct {
+	URL string `json:"url,omitempty"`
+	// Format is json or slack
+	Format   string   `json:"format"`
+	Template string   `json:"template"`
+	Interval Duration `json:"interval"`
+	Burst    int      `json:"burst"`
+}
+
+// Config returns the settings of the notify package
+func (n Notify) Config() notify.Config {
+	return notify.Config{
+		URL:      n.URL,
+		Format:   n.Format,
+		Template: n.Template,
+		Interval: n.Interval.Duration,
+		Burst:    n.Burst,
+	}
+}
+
+// DefaultOperator returns the operator configuration used when no file is
+// given
+func DefaultOperator() Operator {
+	return Operator{
+		Version:       Version,
+		ListenAddress: ":8080",
+		PollInterval:  Duration{30 * time.Second},
+		PoolLabel:     "role",
+		MasterLabel:   "role=master",
+		Order:         operator.DefaultOrder,
+		CycleTimeout:  Duration{30 * time.Minute},
+		FailureBudget: 3,
+		Control: Control{
+			Namespace: "kube-system",
+			ConfigMap: "kube-node-cycle-operator",
+		},
+		Cloud: OperatorCloud{StaleNodeGrace: Duration{10 * time.Minute}},
+		Templates: OperatorTemplates{
+			Namespace: "kube-system",
+			Interval:  Duration{5 * time.Minute},
+		},
+		Drain: DefaultDrain(),
+		Etcd:  Etcd{DialTimeout: Duration{5 * time.Second}},
+		Notify: Notify{
+			Format:   notify.FormatJSON,
+			Template: notify.DefaultTemplate,
+			Interval: Duration{time.Minute},
+			Burst:    5,
+		},
+	}
+}
+
+// MasterSelector splits MasterLabel into its key and value
+func (c *Operator) MasterSelector() (string, string) {
+	parts := strings.SplitN(c.MasterLabel, "=", 2)
+	if len(parts) != 2 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
+func (c *Operator) Validate() error {
+	if c.StatePath == "" {
+		return fmt.Errorf("statePath is required")
+	}
+	for name, d := range map[string]Duration{
+		"pollInterval":         c.PollInterval,
+		"cycleTimeout":         c.CycleTimeout,
+		"cloud.staleNodeGrace": c.Cloud.StaleNodeGrace,
+		"templates.interval":   c.Templates.Interval,
+	} {
+		if err := positive(name, d); err != nil {
+			return err
+		}
+	}
+	if c.FailureBudget < 0 {
+		return fmt.Errorf("failureBudget must not be negative, got %d", c.FailureBudget)
+	}
+	if c.PoolLabel == "" {
+		return fmt.Errorf("poolLabel is required")
+	}
+	if k, v := c.MasterSelector(); k == "" || v == "" {
+		return fmt.Errorf("invalid masterLabel %q, expected key=value", c.MasterLabel)
+	}
+
+	if err := operator.ValidateOrder(c.Order); err != nil {
+		return err
+	}
+	for pool, order := range c.PoolOrder {
+		if err := operator.ValidateOrder(order); err != nil {
+			return fmt.Errorf("poolOrder %s: %v", pool, err)
+		}
+	}
+
+	switch c.Cloud.Provider {
+	case "", "gcp":
+	case "fake":
+		if err := c.Fake.validate(); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown cloud provider %q, expected gcp or fake", c.Cloud.Provider)
+	}
+	if c.Cloud.Agentless && c.Cloud.Provider == "" {
+		return fmt.Errorf("agentless mode requires a cloud provider")
+	}
+	if c.Templates.ConfigMap != "" && c.Cloud.Provider != "gcp" {
+		return fmt.Errorf("publishing templates requires the gcp cloud provider")
+	}
+
+	if err := c.Drain.validate(); err != nil {
+		return err
+	}
+	if err := c.Etcd.validate(); err != nil {
+		return err
+	}
+	if c.Notify.URL != "" {
+		if err := c.Notify.Config().Validate(); err != nil {
+			return err
+		}
+	}
+	return c.Health.Config().Validate()
+}
@@ -0,0 +1,185 @@
+package control
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/kube/k8sutil"
+)
+
+// The control ConfigMap is the switch operators use to steer a rollout. The
+// `rollout` key is written by humans (or nodecyclectl) and the `status` key is
+// maintained by the operator to reflect what it is actually doing.
+const (
+	DefaultNamespace = "kube-system"
+	DefaultName      = "kube-node-cycle-operator"
+
+	RolloutKey = "rollout"
+	StatusKey  = "status"
+	// HaltedKey lists the pools, comma separated, the operator stopped
+	// cycling after exhausting their failure budget
+	HaltedKey = "halted"
+
+	// Values accepted under RolloutKey
+	RolloutRunning = "running"
+	RolloutPaused  = "paused"
+	RolloutAbort   = "abort"
+
+	// Values reported under StatusKey
+	StatusRunning = "running"
+	StatusPaused  = "paused"
+	StatusAborted = "aborted"
+)
+
+type Control struct {
+	kc        kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func New(kc kubernetes.Interface, namespace, name string) *Control {
+	return &Control{
+		kc:        kc,
+		namespace: namespace,
+		name:      name,
+	}
+}
+
+// Rollout returns the requested rollout mode. A missing ConfigMap or key means
+// the rollout is running.
+func (c *Control) Rollout() (string, error) {
+	cm, err := c.kc.CoreV1().ConfigMaps(c.namespace).Get(c.name, v1meta.GetOptions{})
+	if errors.IsNotFound(err) {
+		return RolloutRunning, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	switch r := cm.Data[RolloutKey]; r {
+	case "", RolloutRunning:
+		return RolloutRunning, nil
+	case RolloutPaused, RolloutAbort:
+		return r, nil
+	default:
+		return "", fmt.Errorf("unknown %s value %q in configmap %s/%s", RolloutKey, r, c.namespace, c.name)
+	}
+}
+
+// Status returns the rollout status last reported by the operator
+func (c *Control) Status() (string, error) {
+	cm, err := c.kc.CoreV1().ConfigMaps(c.namespace).Get(c.name, v1meta.GetOptions{})
+	if errors.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return cm.Data[StatusKey], nil
+}
+
+// HaltedPools returns the pools halted by the operator
+func (c *Control) HaltedPools() ([]string, error) {
+	cm, err := c.kc.CoreV1().ConfigMaps(c.namespace).Get(c.name, v1meta.GetOptions{})
+	if errors.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return splitPools(cm.Data[HaltedKey]), nil
+}
+
+// HaltPool adds a pool to the halted list
+func (c *Control) HaltPool(pool string) error {
+	return c.update(func(data map[string]string) {
+		pools := splitPools(data[HaltedKey])
+		for _, p := range pools {
+			if p == pool {
+				return
+			}
+		}
+		data[HaltedKey] = strings.Join(append(pools, pool), ",")
+	})
+}
+
+// ResumePool removes a pool from the halted list
+func (c *Control) ResumePool(pool string) error {
+	return c.update(func(data map[string]string) {
+		pools := []string{}
+		for _, p := range splitPools(data[HaltedKey]) {
+			if p != pool {
+				pools = append(pools, p)
+			}
+		}
+		data[HaltedKey] = strings.Join(pools, ",")
+	})
+}
+
+// ResumeAllPools clears the halted list
+func (c *Control) ResumeAllPools() error {
+	return c.set(HaltedKey, "")
+}
+
+func splitPools(s string) []string {
+	pools := []string{}
+	for _, p := range strings.Split(s, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			pools = append(pools, p)
+		}
+	}
+	return pools
+}
+
+// SetRollout sets the requested rollout mode
+func (c *Control) SetRollout(rollout string) error {
+	return c.set(RolloutKey, rollout)
+}
+
+// SetStatus records the rollout status as observed by the operator
+func (c *Control) SetStatus(status string) error {
+	return c.set(StatusKey, status)
+}
+
+// set writes a single key in the control ConfigMap
+func (c *Control) set(key, value string) error {
+	return c.update(func(data map[string]string) {
+		data[key] = value
+	})
+}
+
+// update applies f to the data of the control ConfigMap, creating it if needed
+func (c *Control) update(f func(map[string]string)) error {
+	cmi := c.kc.CoreV1().ConfigMaps(c.namespace)
+
+	return k8sutil.RetryOnConflict(k8sutil.DefaultBackoff, func() error {
+		cm, err := cmi.Get(c.name, v1meta.GetOptions{})
+		if errors.IsNotFound(err) {
+			data := map[string]string{}
+			f(data)
+			_, err = cmi.Create(&v1.ConfigMap{
+				ObjectMeta: v1meta.ObjectMeta{
+					Name:      c.name,
+					Namespace: c.namespace,
+				},
+				Data: data,
+			})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if cm.Data == nil {
+			cm.Data = map[string]string{}
+		}
+		f(cm.Data)
+		_, err = cmi.Update(cm)
+		return err
+	})
+}
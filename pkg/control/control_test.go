@@ -0,0 +1,91 @@
+package control
+
+import (
+	"reflect"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func testControl(data map[string]string) *Control {
+	objects := []runtime.Object{}
+	if data != nil {
+		objects = append(objects, &v1.ConfigMap{
+			ObjectMeta: v1meta.ObjectMeta{Name: DefaultName, Namespace: DefaultNamespace},
+			Data:       data,
+		})
+	}
+	return New(fake.NewSimpleClientset(objects...), DefaultNamespace, DefaultName)
+}
+
+func TestRollout(t *testing.T) {
+	tests := []struct {
+		data     map[string]string
+		expected string
+		err      bool
+	}{
+		// A missing configmap or key means running
+		{nil, RolloutRunning, false},
+		{map[string]string{}, RolloutRunning, false},
+		{map[string]string{RolloutKey: "running"}, RolloutRunning, false},
+		{map[string]string{RolloutKey: "paused"}, RolloutPaused, false},
+		{map[string]string{RolloutKey: "abort"}, RolloutAbort, false},
+		// Typos must not be taken for running
+		{map[string]string{RolloutKey: "pause"}, "", true},
+	}
+	for _, test := range tests {
+		rollout, err := testControl(test.data).Rollout()
+		if (err != nil) != test.err {
+			t.Errorf("%v: unexpected error %v", test.data, err)
+		}
+		if rollout != test.expected {
+			t.Errorf("%v: expected %q, got %q", test.data, test.expected, rollout)
+		}
+	}
+}
+
+func TestSetRolloutCreatesConfigMap(t *testing.T) {
+	c := testControl(nil)
+	if err := c.SetRollout(RolloutPaused); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SetStatus(StatusPaused); err != nil {
+		t.Fatal(err)
+	}
+	if rollout, err := c.Rollout(); err != nil || rollout != RolloutPaused {
+		t.Errorf("expected the rollout to be paused, got %q (%v)", rollout, err)
+	}
+	if status, err := c.Status(); err != nil || status != StatusPaused {
+		t.Errorf("expected the status to be paused, got %q (%v)", status, err)
+	}
+}
+
+func TestHaltedPools(t *testing.T) {
+	c := testControl(map[string]string{HaltedKey: " worker, ,infra"})
+	if err := c.HaltPool("worker"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.HaltPool("master"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.ResumePool("infra"); err != nil {
+		t.Fatal(err)
+	}
+	pools, err := c.HaltedPools()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"worker", "master"}; !reflect.DeepEqual(pools, expected) {
+		t.Errorf("expected halted pools %v, got %v", expected, pools)
+	}
+
+	if err := c.ResumeAllPools(); err != nil {
+		t.Fatal(err)
+	}
+	if pools, _ := c.HaltedPools(); len(pools) != 0 {
+		t.Errorf("expected no halted pools, got %v", pools)
+	}
+}
@@ -0,0 +1,200 @@
+// Package drain empties a node before its instance is terminated
+package drain
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"k8s.io/api/core/v1"
+	policyv1beta1 "k8s.io/api/policy/v1beta1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/kube/k8sutil"
+)
+
+const defaultPollInterval = 10 * time.Second
+
+// Drainer evicts pods from nodes, deleting the ones that could not be evicted
+type Drainer struct {
+	kc kubernetes.Interface
+	// EvictionTimeout is how long evicted pods are given to terminate
+	EvictionTimeout time.Duration
+	// DeletionTimeout is how long deleted pods are given to terminate
+	DeletionTimeout time.Duration
+	// ExcludedOwners lists the kinds of owners whose pods are left running
+	ExcludedOwners []string
+}
+
+func New(kc kubernetes.Interface) *Drainer {
+	return &Drainer{
+		kc:              kc,
+		EvictionTimeout: 10 * time.Minute,
+		DeletionTimeout: 2 * time.Minute,
+		ExcludedOwners:  []string{"DaemonSet"},
+	}
+}
+
+// PodsForTermination lists the pods that run on the node and are not owned by
+// an excluded kind, DaemonSets by default
+func (d *Drainer) PodsForTermination(node string) ([]v1.Pod, error) {
+
+	pods := []v1.Pod{}
+
+	// Get all pods running on the node
+	podList, err := d.kc.CoreV1().Pods(v1.NamespaceAll).List(v1meta.ListOptions{
+		FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": node}).String(),
+	})
+	if err != nil {
+		return pods, err
+	}
+
+	// exclude daemonsets
+	for _, pod := range podList.Items {
+		exclude := false
+		for _, ownerRef := range pod.OwnerReferences {
+			// If the owner reference is present just ignore without testing that the owner actually exists
+			if d.excluded(ownerRef.Kind) {
+				log.Printf("[INFO] excluding %s as part of a %s", pod.Name, ownerRef.Kind)
+				exclude = true
+				break
+			}
+		}
+		if !exclude {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// Drain cordons the node, evicts its pods and then deletes what failed to
+// evict. It returns early with the ctx error when ctx is cancelled.
+func (d *Drainer) Drain(ctx context.Context, node string) error {
+
+	// Mark not Unschedulable
+	log.Println("[INFO] Marking node unschedulable")
+	if err := k8sutil.Unschedulable(d.kc.CoreV1().Nodes(), node, true); err != nil {
+		return err
+	}
+
+	// First try to evict pods
+	pods, err := d.PodsForTermination(node)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("[INFO] evicting pod: %s", pod.Name)
+		if err := d.evictPod(pod); err != nil {
+			log.Printf("[ERROR] evicting pod: %s %v", pod.Name, err)
+			// Just continue and will attempt to delete later
+		}
+	}
+	// Allow some time for pods eviction
+	d.syncPodsTermination(ctx, pods, d.EvictionTimeout)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Delete pods that were not drained
+	pods, err = d.PodsForTermination(node)
+	if err != nil {
+		return err
+	}
+	for _, pod := range pods {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		log.Printf("[INFO] deleting  pod: %s", pod.Name)
+		if err := d.deletePod(pod); err != nil {
+			log.Printf("[ERROR] deleting pod: %s %v", pod.Name, err)
+		}
+	}
+	// Allow some time for pods to delete
+	d.syncPodsTermination(ctx, pods, d.DeletionTimeout)
+
+	return ctx.Err()
+}
+
+// deletes a pod
+func (d *Drainer) deletePod(pod v1.Pod) error {
+	if err := d.kc.CoreV1().Pods(pod.Namespace).Delete(pod.Name, &v1meta.DeleteOptions{}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// evicts pod from the node
+func (d *Drainer) evictPod(pod v1.Pod) error {
+
+	eviction := &policyv1beta1.Eviction{
+		TypeMeta: v1meta.TypeMeta{},
+		ObjectMeta: v1meta.ObjectMeta{
+			Name:      pod.Name,
+			Namespace: pod.Namespace,
+		},
+		DeleteOptions: &v1meta.DeleteOptions{},
+	}
+
+	if err := d.kc.PolicyV1beta1().Evictions(eviction.Namespace).Evict(eviction); err != nil {
+		return err
+	}
+	return nil
+}
+
+// waits for a pod to be deleted for podReapTimeOut or until ctx is cancelled
+func (d *Drainer) waitForPodTermination(ctx context.Context, pod v1.Pod, podReapTimeOut time.Duration) error {
+
+	ctx, cancel := context.WithTimeout(ctx, podReapTimeOut)
+	defer cancel()
+
+	return wait.PollUntil(defaultPollInterval, func() (bool, error) {
+		p, err := d.kc.CoreV1().Pods(pod.Namespace).Get(pod.Name, v1meta.GetOptions{})
+		if errors.IsNotFound(err) || (p != nil && p.ObjectMeta.UID != pod.ObjectMeta.UID) {
+			log.Printf("[INFO] Terminated pod %q", pod.Name)
+			return true, nil
+		}
+
+		// most errors will be transient. log the error and continue
+		// polling
+		if err != nil {
+			log.Printf("[ERROR] Failed to get pod %q: %v", pod.Name, err)
+		}
+
+		return false, nil
+	}, ctx.Done())
+}
+
+// Gets a pod list and waits for them a certain amount of time (timeout) to terminate
+func (d *Drainer) syncPodsTermination(ctx context.Context, pods []v1.Pod, timeout time.Duration) {
+
+	wg := sync.WaitGroup{}
+	for _, pod := range pods {
+		wg.Add(1)
+		go func(pod v1.Pod) {
+			log.Printf("[INFO] Waiting for pod %q to terminate", pod.Name)
+			if err := d.waitForPodTermination(ctx, pod, timeout); err != nil {
+				log.Printf("[INFO] Skipping wait on pod %q: %v", pod.Name, err)
+			}
+			wg.Done()
+		}(pod)
+	}
+	wg.Wait()
+}
+
+// excluded tells whether pods owned by kind are left running
+func (d *Drainer) excluded(kind string) bool {
+	for _, k := range d.ExcludedOwners {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,163 @@
+// Package etcd reports the health of the members of the etcd cluster running
+// on the master nodes, so that masters are only cycled while etcd can afford to
+// lose one of them.
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/pkg/transport"
+)
+
+const defaultDialTimeout = 5 * time.Second
+
+// Config selects the etcd cluster to check
+type Config struct {
+	// Endpoints are the client urls of any members of the cluster
+	Endpoints []string
+	// CAFile, CertFile and KeyFile enable TLS client authentication. Optional
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// DialTimeout bounds connecting and querying every member
+	DialTimeout time.Duration
+}
+
+// Member is a member of the cluster as seen by the others. Members added but
+// not started yet have no name nor client urls.
+type Member struct {
+	ID         uint64   `json:"id"`
+	Name       string   `json:"name"`
+	PeerURLs   []string `json:"peerURLs"`
+	ClientURLs []string `json:"clientURLs"`
+	Healthy    bool     `json:"healthy"`
+	Error      string   `json:"error,omitempty"`
+}
+
+// Cluster lists the members of an etcd cluster along with their health
+type Cluster interface {
+	Members(ctx context.Context) ([]Member, error)
+}
+
+// Client queries an etcd cluster through the v3 api
+type Client struct {
+	c       *clientv3.Client
+	timeout time.Duration
+}
+
+// New returns a client of the cluster in conf
+func New(conf Config) (*Client, error) {
+	if len(conf.Endpoints) == 0 {
+		return nil, fmt.Errorf("no etcd endpoints")
+	}
+	if conf.DialTimeout == 0 {
+		conf.DialTimeout = defaultDialTimeout
+	}
+
+	var tlsConfig *tls.Config
+	if conf.CertFile != "" || conf.KeyFile != "" || conf.CAFile != "" {
+		info := transport.TLSInfo{
+			CertFile:      conf.CertFile,
+			KeyFile:       conf.KeyFile,
+			TrustedCAFile: conf.CAFile,
+		}
+		var err error
+		if tlsConfig, err = info.ClientConfig(); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := clientv3.New(clientv3.Config{
+		Endpoints:   conf.Endpoints,
+		DialTimeout: conf.DialTimeout,
+		TLS:         tlsConfig,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &Client{c: c, timeout: conf.DialTimeout}, nil
+}
+
+// Close closes the connections to the cluster
+func (c *Client) Close() error {
+	return c.c.Close()
+}
+
+// Members lists the members of the cluster. A member is healthy when it
+// answers a status request on one of its client urls.
+func (c *Client) Members(ctx context.Context) ([]Member, error) {
+	lctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	resp, err := c.c.MemberList(lctx)
+	if err != nil {
+		return nil, err
+	}
+
+	members := []Member{}
+	for _, m := range resp.Members {
+		member := Member{
+			ID:         m.ID,
+			Name:       m.Name,
+			PeerURLs:   m.PeerURLs,
+			ClientURLs: m.ClientURLs,
+			Error:      "not started",
+		}
+		for _, u := range m.ClientURLs {
+			sctx, cancel := context.WithTimeout(ctx, c.timeout)
+			_, err := c.c.Status(sctx, u)
+			cancel()
+			if err == nil {
+				member.Healthy, member.Error = true, ""
+				break
+			}
+			member.Error = err.Error()
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// Quorum is the number of healthy members a cluster of size members needs to
+// keep serving
+func Quorum(size int) int {
+	return size/2 + 1
+}
+
+// Healthy counts the healthy members
+func Healthy(members []Member) int {
+	healthy := 0
+	for _, m := range members {
+		if m.Healthy {
+			healthy++
+		}
+	}
+	return healthy
+}
+
+// CanLose tells whether the cluster keeps its quorum while the member with id
+// is down, and why not. An id that matches no member, such as 0 for a master
+// whose member could not be found, counts as losing a healthy member.
+func CanLose(members []Member, id uint64) (bool, string) {
+	healthy := Healthy(members)
+	found := false
+	for _, m := range members {
+		if m.ID != id {
+			continue
+		}
+		found = true
+		if m.Healthy {
+			healthy--
+		}
+	}
+	if !found {
+		healthy--
+	}
+	if quorum := Quorum(len(members)); healthy < quorum {
+		return false, fmt.Sprintf("%d of %d members would be healthy, quorum is %d", healthy, len(members), quorum)
+	}
+	return true, ""
+}
@@ -0,0 +1,122 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/coreos/etcd/embed"
+)
+
+func freeURL(t *testing.T) url.URL {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return url.URL{Scheme: "http", Host: l.Addr().String()}
+}
+
+// startEtcd runs a single member cluster named master-1
+func startEtcd(t *testing.T) (*embed.Etcd, string) {
+	dir, err := ioutil.TempDir("", "etcd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := embed.NewConfig()
+	cfg.Name = "master-1"
+	cfg.Dir = dir
+	peer, client := freeURL(t), freeURL(t)
+	cfg.LPUrls, cfg.APUrls = []url.URL{peer}, []url.URL{peer}
+	cfg.LCUrls, cfg.ACUrls = []url.URL{client}, []url.URL{client}
+	cfg.InitialCluster = cfg.InitialClusterFromName(cfg.Name)
+
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatal(err)
+	}
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		e.Close()
+		os.RemoveAll(dir)
+		t.Fatal("etcd did not start")
+	}
+	return e, client.String()
+}
+
+func TestMembers(t *testing.T) {
+	e, endpoint := startEtcd(t)
+	defer os.RemoveAll(e.Config().Dir)
+	defer e.Close()
+
+	c, err := New(Config{Endpoints: []string{endpoint}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ctx := context.Background()
+	members, err := c.Members(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].Name != "master-1" || !members[0].Healthy {
+		t.Fatalf("expected master-1 to be healthy, got %+v", members)
+	}
+	if ok, _ := CanLose(members, members[0].ID); ok {
+		t.Errorf("expected a single member cluster not to tolerate losing it")
+	}
+
+	// A member added but never started is not healthy
+	peer := freeURL(t)
+	if _, err := c.c.MemberAdd(ctx, []string{peer.String()}); err != nil {
+		t.Fatal(err)
+	}
+	members, err = c.Members(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 || Healthy(members) != 1 {
+		t.Fatalf("expected 1 of 2 healthy members, got %+v", members)
+	}
+}
+
+func TestCanLose(t *testing.T) {
+	cluster := func(healthy ...bool) []Member {
+		members := []Member{}
+		for i, h := range healthy {
+			members = append(members, Member{ID: uint64(i + 1), Name: fmt.Sprintf("master-%d", i+1), Healthy: h})
+		}
+		return members
+	}
+
+	tests := []struct {
+		members []Member
+		id      uint64
+		ok      bool
+	}{
+		{cluster(true, true, true), 1, true},
+		{cluster(true, true, false), 1, false},
+		// Losing the unhealthy member changes nothing
+		{cluster(true, true, false), 3, true},
+		{cluster(true, true, true, true), 1, true},
+		{cluster(true, true, true, false), 1, false},
+		{cluster(true, true, true, true, false), 1, true},
+		// Unknown members are assumed healthy
+		{cluster(true, true, true), 0, true},
+		{cluster(true, true, false), 0, false},
+		{cluster(true, true, false), 9, false},
+	}
+	for _, test := range tests {
+		if ok, reason := CanLose(test.members, test.id); ok != test.ok {
+			t.Errorf("losing %d of %+v: expected %v, got %v (%s)", test.id, test.members, test.ok, ok, reason)
+		}
+	}
+}
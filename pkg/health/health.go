@@ -0,0 +1,94 @@
+package health
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/client-go/kubernetes"
+)
+
+// Check is a cluster health gate evaluated before every grant. Healthy returns
+// false with a reason when the next node should not be cycled yet.
+type Check interface {
+	Name() string
+	Healthy() (bool, string, error)
+}
+
+// Config selects which checks are enabled
+type Config struct {
+	// KubeSystemPods requires every pod in kube-system to be Ready
+	KubeSystemPods bool
+	// PendingPodsTimeout fails when a pod is unschedulable for longer than
+	// this. Zero disables the check
+	PendingPodsTimeout time.Duration
+	// Workloads that must be fully available, in the form kind/namespace/name
+	// where kind is deployment or statefulset
+	Workloads []string
+	// PrometheusURL and PrometheusQuery enable a check that passes when the
+	// query returns a non empty result with only non zero values
+	PrometheusURL   string
+	PrometheusQuery string
+	// Now is the clock unschedulable pods are timed with. Defaults to time.Now
+	Now func() time.Time
+}
+
+// Validate tells whether the enabled checks are usable
+func (conf Config) Validate() error {
+	for _, w := range conf.Workloads {
+		parts := strings.Split(w, "/")
+		if len(parts) != 3 {
+			return fmt.Errorf("invalid workload %q, expected kind/namespace/name", w)
+		}
+		switch parts[0] {
+		case KindDeployment, KindStatefulSet:
+		default:
+			return fmt.Errorf("invalid workload kind %q, expected %s or %s", parts[0], KindDeployment, KindStatefulSet)
+		}
+	}
+	if conf.PrometheusURL != "" && conf.PrometheusQuery == "" {
+		return fmt.Errorf("prometheus url set without a query")
+	}
+	return nil
+}
+
+// New returns the checks enabled in conf
+func New(kc kubernetes.Interface, conf Config) ([]Check, error) {
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	checks := []Check{}
+
+	if conf.KubeSystemPods {
+		checks = append(checks, &PodsReady{kc: kc, Namespace: "kube-system"})
+	}
+	if conf.PendingPodsTimeout > 0 {
+		now := conf.Now
+		if now == nil {
+			now = time.Now
+		}
+		checks = append(checks, &PendingPods{kc: kc, now: now, Timeout: conf.PendingPodsTimeout})
+	}
+	for _, w := range conf.Workloads {
+		parts := strings.Split(w, "/")
+		checks = append(checks, &WorkloadAvailable{kc: kc, Kind: parts[0], Namespace: parts[1], Workload: parts[2]})
+	}
+	if conf.PrometheusURL != "" {
+		checks = append(checks, NewPrometheusQuery(conf.PrometheusURL, conf.PrometheusQuery))
+	}
+	return checks, nil
+}
+
+// Run evaluates checks in order and stops at the first unhealthy one
+func Run(checks []Check) (bool, string, error) {
+	for _, c := range checks {
+		ok, reason, err := c.Healthy()
+		if err != nil {
+			return false, "", fmt.Errorf("health check %s: %v", c.Name(), err)
+		}
+		if !ok {
+			return false, fmt.Sprintf("%s: %s", c.Name(), reason), nil
+		}
+	}
+	return true, "", nil
+}
@@ -0,0 +1,193 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	appsv1 "k8s.io/api/apps/v1"
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var epoch = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func pod(namespace, name string, phase v1.PodPhase, conditions ...v1.PodCondition) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: v1meta.ObjectMeta{Name: name, Namespace: namespace},
+		Status:     v1.PodStatus{Phase: phase, Conditions: conditions},
+	}
+}
+
+func deleting(p *v1.Pod) *v1.Pod {
+	at := v1meta.NewTime(epoch)
+	p.DeletionTimestamp = &at
+	return p
+}
+
+func ready(status v1.ConditionStatus) v1.PodCondition {
+	return v1.PodCondition{Type: v1.PodReady, Status: status}
+}
+
+func unschedulable(since time.Duration) v1.PodCondition {
+	return v1.PodCondition{
+		Type:               v1.PodScheduled,
+		Status:             v1.ConditionFalse,
+		Reason:             v1.PodReasonUnschedulable,
+		LastTransitionTime: v1meta.NewTime(epoch.Add(-since)),
+	}
+}
+
+func expectHealthy(t *testing.T, c Check, expected bool) {
+	ok, reason, err := c.Healthy()
+	if err != nil {
+		t.Fatalf("%s: unexpected error: %v", c.Name(), err)
+	}
+	if ok != expected {
+		t.Errorf("%s: expected healthy to be %v, got %v (%s)", c.Name(), expected, ok, reason)
+	}
+}
+
+func TestPodsReady(t *testing.T) {
+	tests := []struct {
+		pods    []runtime.Object
+		healthy bool
+	}{
+		{[]runtime.Object{pod("kube-system", "dns", v1.PodRunning, ready(v1.ConditionTrue))}, true},
+		{[]runtime.Object{pod("kube-system", "dns", v1.PodRunning, ready(v1.ConditionFalse))}, false},
+		// Pending pods are not ready
+		{[]runtime.Object{pod("kube-system", "dns", v1.PodPending)}, false},
+		// Completed pods are ignored
+		{[]runtime.Object{pod("kube-system", "job", v1.PodSucceeded)}, true},
+		// and so are failed or evicted ones
+		{[]runtime.Object{pod("kube-system", "dns-evicted", v1.PodFailed)}, true},
+		// and pods being deleted
+		{[]runtime.Object{deleting(pod("kube-system", "dns-old", v1.PodRunning, ready(v1.ConditionFalse)))}, true},
+		// Other namespaces are ignored
+		{[]runtime.Object{pod("default", "app", v1.PodRunning, ready(v1.ConditionFalse))}, true},
+	}
+	for _, test := range tests {
+		c := &PodsReady{kc: fake.NewSimpleClientset(test.pods...), Namespace: "kube-system"}
+		expectHealthy(t, c, test.healthy)
+	}
+}
+
+func TestPendingPods(t *testing.T) {
+	now := func() time.Time { return epoch }
+	tests := []struct {
+		pods    []runtime.Object
+		healthy bool
+	}{
+		{[]runtime.Object{pod("default", "app", v1.PodPending, unschedulable(time.Minute))}, true},
+		{[]runtime.Object{pod("default", "app", v1.PodPending, unschedulable(time.Hour))}, false},
+		// Pending for another reason, e.g. pulling images
+		{[]runtime.Object{pod("default", "app", v1.PodPending)}, true},
+		{[]runtime.Object{pod("default", "app", v1.PodRunning, unschedulable(time.Hour))}, true},
+	}
+	for _, test := range tests {
+		c := &PendingPods{kc: fake.NewSimpleClientset(test.pods...), now: now, Timeout: 10 * time.Minute}
+		expectHealthy(t, c, test.healthy)
+	}
+}
+
+func TestWorkloadAvailable(t *testing.T) {
+	three := int32(3)
+	deployment := func(available, updated int32) runtime.Object {
+		return &appsv1.Deployment{
+			ObjectMeta: v1meta.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       appsv1.DeploymentSpec{Replicas: &three},
+			Status:     appsv1.DeploymentStatus{AvailableReplicas: available, UpdatedReplicas: updated},
+		}
+	}
+	statefulSet := func(ready int32) runtime.Object {
+		return &appsv1.StatefulSet{
+			ObjectMeta: v1meta.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec:       appsv1.StatefulSetSpec{Replicas: &three},
+			Status:     appsv1.StatefulSetStatus{ReadyReplicas: ready},
+		}
+	}
+
+	tests := []struct {
+		kind    string
+		object  runtime.Object
+		healthy bool
+	}{
+		{KindDeployment, deployment(3, 3), true},
+		{KindDeployment, deployment(2, 3), false},
+		// Available replicas of the previous revision do not count
+		{KindDeployment, deployment(3, 1), false},
+		{KindStatefulSet, statefulSet(3), true},
+		{KindStatefulSet, statefulSet(2), false},
+	}
+	for _, test := range tests {
+		c := &WorkloadAvailable{kc: fake.NewSimpleClientset(test.object), Kind: test.kind, Namespace: "default", Workload: "app"}
+		expectHealthy(t, c, test.healthy)
+	}
+
+	// A missing workload is an error, not a pass
+	c := &WorkloadAvailable{kc: fake.NewSimpleClientset(), Kind: KindDeployment, Namespace: "default", Workload: "app"}
+	if _, _, err := c.Healthy(); err == nil {
+		t.Errorf("expected an error for a missing deployment")
+	}
+}
+
+func TestPrometheusQuery(t *testing.T) {
+	tests := []struct {
+		response string
+		healthy  bool
+		err      bool
+	}{
+		{`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1514764800,"1"]}]}}`, true, false},
+		{`{"status":"success","data":{"resultType":"vector","result":[{"metric":{},"value":[1514764800,"0"]}]}}`, false, false},
+		{`{"status":"success","data":{"resultType":"vector","result":[]}}`, false, false},
+		{`{"status":"error","error":"bad query"}`, false, true},
+		{`{"status":"success","data":{"resultType":"matrix","result":[]}}`, false, true},
+	}
+	for _, test := range tests {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if q := r.URL.Query().Get("query"); q != "up" {
+				t.Errorf("unexpected query %q", q)
+			}
+			fmt.Fprint(w, test.response)
+		}))
+		ok, reason, err := NewPrometheusQuery(srv.URL, "up").Healthy()
+		srv.Close()
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error %v", test.response, err)
+		}
+		if ok != test.healthy {
+			t.Errorf("%s: expected healthy to be %v, got %v (%s)", test.response, test.healthy, ok, reason)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	kc := fake.NewSimpleClientset(pod("kube-system", "dns", v1.PodRunning, ready(v1.ConditionFalse)))
+	checks, err := New(kc, Config{KubeSystemPods: true, PendingPodsTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok, reason, err := Run(checks)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok || reason != "pods-ready/kube-system: pod dns is not ready" {
+		t.Errorf("expected the first failing check to be reported, got %v %q", ok, reason)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, conf := range []Config{
+		{Workloads: []string{"deployment/app"}},
+		{Workloads: []string{"daemonset/kube-system/proxy"}},
+		{PrometheusURL: "http://prometheus:9090"},
+	} {
+		if err := conf.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", conf)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package health
+
+import (
+	"fmt"
+	"time"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// PodsReady passes when every pod in Namespace that has not terminated is
+// Ready. Pending pods are not Ready. Pods being deleted are ignored: they are
+// going away, and their replacements are checked instead.
+type PodsReady struct {
+	kc        kubernetes.Interface
+	Namespace string
+}
+
+func (c *PodsReady) Name() string {
+	return fmt.Sprintf("pods-ready/%s", c.Namespace)
+}
+
+func (c *PodsReady) Healthy() (bool, string, error) {
+	pods, err := c.kc.CoreV1().Pods(c.Namespace).List(v1meta.ListOptions{})
+	if err != nil {
+		return false, "", err
+	}
+
+	for _, p := range pods.Items {
+		// Completed, failed and evicted pods are not expected to be ready
+		if p.Status.Phase == v1.PodSucceeded || p.Status.Phase == v1.PodFailed {
+			continue
+		}
+		if p.DeletionTimestamp != nil {
+			continue
+		}
+		if !podReady(p) {
+			return false, fmt.Sprintf("pod %s is not ready", p.Name), nil
+		}
+	}
+	return true, "", nil
+}
+
+func podReady(p v1.Pod) bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// PendingPods passes unless a pod has been unschedulable for longer than Timeout
+type PendingPods struct {
+	kc      kubernetes.Interface
+	now     func() time.Time
+	Timeout time.Duration
+}
+
+func (c *PendingPods) Name() string {
+	return "pending-pods"
+}
+
+func (c *PendingPods) Healthy() (bool, string, error) {
+	pods, err := c.kc.CoreV1().Pods(v1.NamespaceAll).List(v1meta.ListOptions{})
+	if err != nil {
+		return false, "", err
+	}
+
+	for _, p := range pods.Items {
+		if p.Status.Phase != v1.PodPending {
+			continue
+		}
+		for _, cond := range p.Status.Conditions {
+			if cond.Type != v1.PodScheduled || cond.Status != v1.ConditionFalse || cond.Reason != v1.PodReasonUnschedulable {
+				continue
+			}
+			if since := c.now().Sub(cond.LastTransitionTime.Time); since > c.Timeout {
+				return false, fmt.Sprintf("pod %s/%s unschedulable for %v", p.Namespace, p.Name, since.Round(time.Second)), nil
+			}
+		}
+	}
+	return true, "", nil
+}
@@ -0,0 +1,87 @@
+package health
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const prometheusTimeout = 10 * time.Second
+
+// PrometheusQuery passes when an instant query returns at least one sample
+// and every sample has a non zero value
+type PrometheusQuery struct {
+	URL    string
+	Query  string
+	client *http.Client
+}
+
+func NewPrometheusQuery(address, query string) *PrometheusQuery {
+	return &PrometheusQuery{
+		URL:    address,
+		Query:  query,
+		client: &http.Client{Timeout: prometheusTimeout},
+	}
+}
+
+type prometheusResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+	Data   struct {
+		ResultType string `json:"resultType"`
+		Result     []struct {
+			Metric map[string]string `json:"metric"`
+			Value  []interface{}     `json:"value"`
+		} `json:"result"`
+	} `json:"data"`
+}
+
+func (c *PrometheusQuery) Name() string {
+	return "prometheus"
+}
+
+func (c *PrometheusQuery) Healthy() (bool, string, error) {
+	u := fmt.Sprintf("%s/api/v1/query?query=%s", strings.TrimSuffix(c.URL, "/"), url.QueryEscape(c.Query))
+	resp, err := c.client.Get(u)
+	if err != nil {
+		return false, "", err
+	}
+	defer resp.Body.Close()
+
+	pr := &prometheusResponse{}
+	if err := json.NewDecoder(resp.Body).Decode(pr); err != nil {
+		return false, "", fmt.Errorf("failed to decode response (status %d): %v", resp.StatusCode, err)
+	}
+	if pr.Status != "success" {
+		return false, "", fmt.Errorf("query failed: %s", pr.Error)
+	}
+	if pr.Data.ResultType != "vector" {
+		return false, "", fmt.Errorf("unexpected result type %q, expected vector", pr.Data.ResultType)
+	}
+	if len(pr.Data.Result) == 0 {
+		return false, fmt.Sprintf("query %q returned no result", c.Query), nil
+	}
+
+	for _, r := range pr.Data.Result {
+		// value is [ <unix time>, "<value>" ]
+		if len(r.Value) != 2 {
+			return false, "", fmt.Errorf("unexpected sample %v", r.Value)
+		}
+		s, ok := r.Value[1].(string)
+		if !ok {
+			return false, "", fmt.Errorf("unexpected sample value %v", r.Value[1])
+		}
+		v, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return false, "", err
+		}
+		if v == 0 {
+			return false, fmt.Sprintf("query %q returned 0 for %v", c.Query, r.Metric), nil
+		}
+	}
+	return true, "", nil
+}
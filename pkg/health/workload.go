@@ -0,0 +1,63 @@
+package health
+
+import (
+	"fmt"
+
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	KindDeployment  = "deployment"
+	KindStatefulSet = "statefulset"
+)
+
+// WorkloadAvailable passes when a Deployment or StatefulSet has all its
+// replicas updated and available
+type WorkloadAvailable struct {
+	kc        kubernetes.Interface
+	Kind      string
+	Namespace string
+	Workload  string
+}
+
+func (c *WorkloadAvailable) Name() string {
+	return fmt.Sprintf("%s/%s/%s", c.Kind, c.Namespace, c.Workload)
+}
+
+func (c *WorkloadAvailable) Healthy() (bool, string, error) {
+	var desired, available int32
+
+	switch c.Kind {
+	case KindDeployment:
+		d, err := c.kc.AppsV1().Deployments(c.Namespace).Get(c.Workload, v1meta.GetOptions{})
+		if err != nil {
+			return false, "", err
+		}
+		desired = 1
+		if d.Spec.Replicas != nil {
+			desired = *d.Spec.Replicas
+		}
+		available = d.Status.AvailableReplicas
+		if d.Status.UpdatedReplicas < available {
+			available = d.Status.UpdatedReplicas
+		}
+	case KindStatefulSet:
+		s, err := c.kc.AppsV1().StatefulSets(c.Namespace).Get(c.Workload, v1meta.GetOptions{})
+		if err != nil {
+			return false, "", err
+		}
+		desired = 1
+		if s.Spec.Replicas != nil {
+			desired = *s.Spec.Replicas
+		}
+		available = s.Status.ReadyReplicas
+	default:
+		return false, "", fmt.Errorf("unknown workload kind %q", c.Kind)
+	}
+
+	if available < desired {
+		return false, fmt.Sprintf("%d/%d replicas available", available, desired), nil
+	}
+	return true, "", nil
+}
@@ -0,0 +1,171 @@
+// Package nodestate holds the cycle state machine shared by the agent and the
+// operator. The state of a node is kept json encoded under a single annotation
+// and only changes through validated transitions:
+//
+//	Idle -> UpdateNeeded -> Approved -> Draining -> Terminating -> Done
+//	                                       |             |
+//	                                       +--> Failed <-+
+//
+// Approval may be revoked (Approved -> UpdateNeeded) and an approval may be
+// forced on a node that does not need updating (Idle -> Approved).
+package nodestate
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+)
+
+type Phase string
+
+const (
+	Idle         Phase = "Idle"
+	UpdateNeeded Phase = "UpdateNeeded"
+	Approved     Phase = "Approved"
+	Draining     Phase = "Draining"
+	Terminating  Phase = "Terminating"
+	Done         Phase = "Done"
+	Failed       Phase = "Failed"
+)
+
+// transitions lists the phases each phase may move to
+var transitions = map[Phase][]Phase{
+	Idle:         {UpdateNeeded, Approved},
+	UpdateNeeded: {Idle, Approved},
+	Approved:     {UpdateNeeded, Draining},
+	Draining:     {UpdateNeeded, Terminating, Failed},
+	Terminating:  {Done, Failed},
+	Done:         {},
+	Failed:       {Idle, UpdateNeeded},
+}
+
+// now is replaced in tests
+var now = time.Now
+
+// State is the cycle state of a node
+type State struct {
+	Phase Phase `json:"phase"`
+	// Reason why the node needs updating, as reported by the agent
+	Reason string `json:"reason,omitempty"`
+	// Message describing the last transition
+	Message string `json:"message,omitempty"`
+	// Error is the last error hit while cycling the node. Transient errors
+	// are cleared by the next transition, the error of a Failed node is kept
+	// until the node is reset so that the operator does not miss it
+	Error string `json:"error,omitempty"`
+	// Forced approvals do not wait for the node to need an update
+	Forced bool `json:"forced,omitempty"`
+	// BootID of the node when the agent started cycling it, used to tell an
+	// agent restart apart from a replaced instance
+	BootID string `json:"bootID,omitempty"`
+	// Operation is the cloud operation terminating the node, if any
+	Operation string `json:"operation,omitempty"`
+	// Timestamps records when each phase was last entered
+	Timestamps map[Phase]time.Time `json:"timestamps,omitempty"`
+}
+
+// New returns an Idle state
+func New() State {
+	return State{
+		Phase:      Idle,
+		Timestamps: map[Phase]time.Time{Idle: now()},
+	}
+}
+
+// CanTransition tells whether moving to phase `to` is allowed
+func (s State) CanTransition(to Phase) bool {
+	for _, p := range transitions[s.Phase] {
+		if p == to {
+			return true
+		}
+	}
+	return false
+}
+
+// Transition moves the state to phase `to` or errors if not allowed
+func (s *State) Transition(to Phase, message string) error {
+	if !s.CanTransition(to) {
+		return fmt.Errorf("invalid node state transition %s -> %s", s.Phase, to)
+	}
+	s.Phase = to
+	s.Message = message
+	if s.Timestamps == nil {
+		s.Timestamps = map[Phase]time.Time{}
+	}
+	s.Timestamps[to] = now()
+	if to == Idle || to == UpdateNeeded {
+		s.Forced = false
+	}
+	// A new cycle starts draining, earlier operations are not relevant
+	if to == Draining {
+		s.Operation = ""
+	}
+	if to != Failed {
+		s.Error = ""
+	}
+	return nil
+}
+
+// Since returns when the current phase was entered
+func (s State) Since() time.Time {
+	return s.Timestamps[s.Phase]
+}
+
+// InProgress tells whether the node started cycling
+func (s State) InProgress() bool {
+	return s.Phase == Draining || s.Phase == Terminating || s.Phase == Done
+}
+
+// Parse reads the state from node annotations, falling back to the legacy
+// boolean annotations for nodes that have not been migrated yet
+func Parse(anno map[string]string) (State, error) {
+	if raw, ok := anno[annotations.State]; ok {
+		s := State{}
+		if err := json.Unmarshal([]byte(raw), &s); err != nil {
+			return State{}, fmt.Errorf("invalid %s annotation: %v", annotations.State, err)
+		}
+		if _, ok := transitions[s.Phase]; !ok {
+			return State{}, fmt.Errorf("invalid %s annotation: unknown phase %q", annotations.State, s.Phase)
+		}
+		return s, nil
+	}
+	return parseLegacy(anno), nil
+}
+
+func parseLegacy(anno map[string]string) State {
+	s := New()
+	s.Reason = anno[annotations.UpdateReason]
+	s.Error = anno[annotations.CycleError]
+	isTrue := func(key string) bool { return anno[key] == annotations.AnnoTrue }
+
+	switch {
+	case isTrue(annotations.UpdateInProgress):
+		s.Phase = Draining
+	case isTrue(annotations.ForceTermination):
+		s.Phase = Approved
+		s.Forced = true
+	case isTrue(annotations.CanStartTermination):
+		s.Phase = Approved
+	case isTrue(annotations.UpdateNeeded):
+		s.Phase = UpdateNeeded
+	default:
+		return s
+	}
+	s.Message = "migrated from legacy annotations"
+	s.Timestamps[s.Phase] = now()
+	if t, err := time.Parse(time.RFC3339, anno[annotations.PermissionGivenTime]); err == nil && s.Phase == Approved {
+		s.Timestamps[Approved] = t
+	}
+	return s
+}
+
+// Encode returns the annotation value for the state
+func (s State) Encode() (string, error) {
+	raw, err := json.Marshal(s)
+	if err != nil {
+		return "", err
+	}
+	return string(raw), nil
+}
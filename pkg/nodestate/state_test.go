@@ -0,0 +1,123 @@
+package nodestate
+
+import (
+	"testing"
+	"time"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+)
+
+func TestTransition(t *testing.T) {
+	fixed := time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+	now = func() time.Time { return fixed }
+	defer func() { now = time.Now }()
+
+	s := New()
+	for _, p := range []Phase{UpdateNeeded, Approved, Draining, Terminating, Done} {
+		if err := s.Transition(p, "next"); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if s.Phase != p || s.Since() != fixed {
+			t.Errorf("expected phase %s entered at %v, got %s at %v", p, fixed, s.Phase, s.Since())
+		}
+	}
+
+	if err := s.Transition(Draining, "back"); err == nil {
+		t.Errorf("expected Done -> Draining to be rejected")
+	}
+	if s.Phase != Done {
+		t.Errorf("rejected transition changed the phase to %s", s.Phase)
+	}
+}
+
+func TestTransitionClearsForced(t *testing.T) {
+	s := New()
+	s.Forced = true
+	if err := s.Transition(Approved, "forced"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if err := s.Transition(UpdateNeeded, "revoked"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Forced {
+		t.Errorf("expected revoked approval to clear forced")
+	}
+}
+
+func TestTransitionClearsError(t *testing.T) {
+	s := New()
+	s.Phase = Draining
+	s.Error = "drain failed"
+	if err := s.Transition(Terminating, "drained"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Error != "" {
+		t.Errorf("expected the next step to clear a transient error, got %q", s.Error)
+	}
+
+	s.Error = "termination failed"
+	if err := s.Transition(Failed, "gave up"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if s.Error != "termination failed" {
+		t.Errorf("expected a failed node to keep its error, got %q", s.Error)
+	}
+}
+
+func TestParseLegacy(t *testing.T) {
+	tests := []struct {
+		anno   map[string]string
+		phase  Phase
+		forced bool
+	}{
+		{map[string]string{}, Idle, false},
+		{map[string]string{annotations.UpdateNeeded: annotations.AnnoFalse}, Idle, false},
+		{map[string]string{annotations.UpdateNeeded: annotations.AnnoTrue}, UpdateNeeded, false},
+		{map[string]string{
+			annotations.UpdateNeeded:        annotations.AnnoTrue,
+			annotations.CanStartTermination: annotations.AnnoTrue,
+		}, Approved, false},
+		{map[string]string{annotations.ForceTermination: annotations.AnnoTrue}, Approved, true},
+		{map[string]string{
+			annotations.UpdateNeeded:        annotations.AnnoTrue,
+			annotations.CanStartTermination: annotations.AnnoTrue,
+			annotations.UpdateInProgress:    annotations.AnnoTrue,
+		}, Draining, false},
+	}
+
+	for _, test := range tests {
+		s, err := Parse(test.anno)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if s.Phase != test.phase || s.Forced != test.forced {
+			t.Errorf("%v: expected %s (forced %t), got %s (forced %t)", test.anno, test.phase, test.forced, s.Phase, s.Forced)
+		}
+	}
+}
+
+func TestParsePrefersState(t *testing.T) {
+	s := New()
+	if err := s.Transition(UpdateNeeded, "template changed"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	raw, err := s.Encode()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	got, err := Parse(map[string]string{
+		annotations.State:            raw,
+		annotations.UpdateInProgress: annotations.AnnoTrue,
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got.Phase != UpdateNeeded || got.Message != "template changed" {
+		t.Errorf("expected the state annotation to win, got %+v", got)
+	}
+
+	if _, err := Parse(map[string]string{annotations.State: `{"phase":"Bogus"}`}); err == nil {
+		t.Errorf("expected unknown phase to be rejected")
+	}
+}
@@ -0,0 +1,102 @@
+package nodestate
+
+import (
+	"fmt"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/kube/k8sutil"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+)
+
+// FromNode reads the state of a node
+func FromNode(n v1.Node) (State, error) {
+	return Parse(n.Annotations)
+}
+
+// Get fetches a node and reads its state
+func Get(nc v1core.NodeInterface, node string) (State, error) {
+	n, err := nc.Get(node, v1meta.GetOptions{})
+	if err != nil {
+		return State{}, getError(node, err)
+	}
+	return FromNode(*n)
+}
+
+// getError describes a failure to get node. NotFound errors are returned as
+// is for callers to tell a node that is gone.
+func getError(node string, err error) error {
+	if apierrors.IsNotFound(err) {
+		return err
+	}
+	return fmt.Errorf("failed to get node %q: %v", node, err)
+}
+
+// Update applies f to the current state of a node and writes it back,
+// retrying on conflicts. If f errors the node is left untouched. Legacy
+// annotations are removed on write.
+func Update(nc v1core.NodeInterface, node string, f func(*State) error) (State, error) {
+	return UpdateInstance(nc, node, "", f)
+}
+
+// UpdateInstance is Update limited to the Node object with the given uid. A
+// Node registered under the same name by a replacement instance is left
+// untouched and a NotFound error returned, as for a deleted node. Any Node
+// is updated when uid is empty.
+func UpdateInstance(nc v1core.NodeInterface, node string, uid types.UID, f func(*State) error) (State, error) {
+	var s State
+	err := k8sutil.RetryOnConflict(k8sutil.DefaultBackoff, func() error {
+		n, err := nc.Get(node, v1meta.GetOptions{})
+		if err != nil {
+			return getError(node, err)
+		}
+		if uid != "" && n.UID != uid {
+			return apierrors.NewNotFound(v1.Resource("nodes"), node)
+		}
+
+		if s, err = FromNode(*n); err != nil {
+			return err
+		}
+		if err := f(&s); err != nil {
+			return err
+		}
+		raw, err := s.Encode()
+		if err != nil {
+			return err
+		}
+
+		if n.Annotations == nil {
+			n.Annotations = map[string]string{}
+		}
+		for _, k := range annotations.Legacy {
+			delete(n.Annotations, k)
+		}
+		n.Annotations[annotations.State] = raw
+
+		_, err = nc.Update(n)
+		return err
+	})
+	return s, err
+}
+
+// Transition moves a node to phase `to`, validating the transition against
+// its current state
+func Transition(nc v1core.NodeInterface, node string, to Phase, message string) (State, error) {
+	return Update(nc, node, func(s *State) error {
+		return s.Transition(to, message)
+	})
+}
+
+// Reset moves a node back to Idle whatever its current state is. Meant as a
+// manual escape hatch for nodes stuck mid cycle.
+func Reset(nc v1core.NodeInterface, node string, message string) (State, error) {
+	return Update(nc, node, func(s *State) error {
+		*s = New()
+		s.Message = message
+		return nil
+	})
+}
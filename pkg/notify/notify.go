@@ -0,0 +1,240 @@
+// Package notify posts rollout progress to webhooks, either as generic json or
+// as Slack compatible messages.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// FormatJSON posts the event along with its rendered text
+	FormatJSON = "json"
+	// FormatSlack posts the rendered text only, as Slack incoming webhooks
+	// and compatible chat services expect it
+	FormatSlack = "slack"
+
+	// DefaultTemplate renders the event message
+	DefaultTemplate = "{{.Message}}"
+
+	webhookTimeout = 10 * time.Second
+	// queueSize bounds the events waiting to be posted
+	queueSize = 100
+)
+
+// EventType is a lifecycle transition of a rollout
+type EventType string
+
+const (
+	RolloutStarted  EventType = "rollout-started"
+	RolloutFinished EventType = "rollout-finished"
+	NodeCycled      EventType = "node-cycled"
+	CycleFailed     EventType = "cycle-failed"
+	RolloutHalted   EventType = "rollout-halted"
+)
+
+// Event is what templates are rendered with
+type Event struct {
+	Type    EventType `json:"type"`
+	Pool    string    `json:"pool,omitempty"`
+	Node    string    `json:"node,omitempty"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	// Dropped is the number of events dropped by the rate limit or a full
+	// queue since the last one sent
+	Dropped int `json:"dropped,omitempty"`
+}
+
+// Notifier sends events somewhere. Notify is called from the reconcile loop
+// and must not block on the destination.
+type Notifier interface {
+	Notify(e Event) error
+}
+
+// Config sets where and how events are posted
+type Config struct {
+	URL string
+	// Format is json or slack
+	Format string
+	// Template is a text/template rendered with the Event
+	Template string
+	// Interval and Burst rate limit the events sent. Events over the limit
+	// are dropped and counted in the next event sent, except for failed
+	// cycles and halted rollouts which are always sent. Disabled when
+	// Interval is 0
+	Interval time.Duration
+	Burst    int
+}
+
+// Validate tells whether the webhook is usable
+func (conf Config) Validate() error {
+	if conf.URL == "" {
+		return fmt.Errorf("webhook url is required")
+	}
+	switch conf.Format {
+	case FormatJSON, FormatSlack:
+	default:
+		return fmt.Errorf("invalid webhook format %q, expected %s or %s", conf.Format, FormatJSON, FormatSlack)
+	}
+	if _, err := template.New("webhook").Parse(conf.Template); err != nil {
+		return fmt.Errorf("invalid webhook template: %v", err)
+	}
+	if conf.Interval > 0 && conf.Burst < 1 {
+		return fmt.Errorf("webhook burst must be at least 1, got %d", conf.Burst)
+	}
+	return nil
+}
+
+var notificationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kube_node_cycle_operator_notifications_total",
+	Help: "Number of notifications by event type and result: sent, failed or dropped",
+}, []string{"type", "result"})
+
+func init() {
+	prometheus.MustRegister(notificationsTotal)
+}
+
+// Webhook posts events to a url. Events are queued and posted in the
+// background so that a slow webhook never holds up the caller.
+type Webhook struct {
+	url      string
+	format   string
+	template *template.Template
+	limiter  *rate.Limiter
+	client   *http.Client
+	queue    chan Event
+	done     chan struct{}
+
+	mu      sync.Mutex
+	dropped int
+	closed  bool
+}
+
+// NewWebhook returns a webhook notifier for conf and starts posting its
+// events. An empty template defaults to DefaultTemplate.
+func NewWebhook(conf Config) (*Webhook, error) {
+	if conf.Template == "" {
+		conf.Template = DefaultTemplate
+	}
+	if err := conf.Validate(); err != nil {
+		return nil, err
+	}
+	w := &Webhook{
+		url:      conf.URL,
+		format:   conf.Format,
+		template: template.Must(template.New("webhook").Parse(conf.Template)),
+		client:   &http.Client{Timeout: webhookTimeout},
+		queue:    make(chan Event, queueSize),
+		done:     make(chan struct{}),
+	}
+	if conf.Interval > 0 {
+		w.limiter = rate.NewLimiter(rate.Every(conf.Interval), conf.Burst)
+	}
+	go w.run()
+	return w, nil
+}
+
+// Notify queues e to be posted. Events over the rate limit are dropped,
+// unless they report a failure, and so are events that find the queue full.
+func (w *Webhook) Notify(e Event) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return fmt.Errorf("webhook closed, %s event dropped", e.Type)
+	}
+	if w.limiter != nil && !exempt(e.Type) && !w.limiter.Allow() {
+		w.dropped++
+		notificationsTotal.WithLabelValues(string(e.Type), "dropped").Inc()
+		return nil
+	}
+	select {
+	case w.queue <- e:
+		return nil
+	default:
+		w.dropped++
+		notificationsTotal.WithLabelValues(string(e.Type), "dropped").Inc()
+		return fmt.Errorf("webhook queue full, %s event dropped", e.Type)
+	}
+}
+
+// Close stops accepting events and waits for the queued ones to be posted
+func (w *Webhook) Close() {
+	w.mu.Lock()
+	if !w.closed {
+		w.closed = true
+		close(w.queue)
+	}
+	w.mu.Unlock()
+	<-w.done
+}
+
+// exempt tells whether events of type t are sent regardless of the rate
+// limit: failures are never dropped
+func exempt(t EventType) bool {
+	return t == CycleFailed || t == RolloutHalted
+}
+
+// run posts the queued events until the webhook is closed
+func (w *Webhook) run() {
+	defer close(w.done)
+	for e := range w.queue {
+		w.mu.Lock()
+		e.Dropped = w.dropped
+		w.mu.Unlock()
+
+		if err := w.post(e); err != nil {
+			notificationsTotal.WithLabelValues(string(e.Type), "failed").Inc()
+			log.Println(fmt.Sprintf("[ERROR] failed to send %s notification: %v", e.Type, err))
+			continue
+		}
+		w.mu.Lock()
+		w.dropped -= e.Dropped
+		w.mu.Unlock()
+		notificationsTotal.WithLabelValues(string(e.Type), "sent").Inc()
+	}
+}
+
+// post sends e to the webhook
+func (w *Webhook) post(e Event) error {
+	body, err := w.payload(e)
+	if err != nil {
+		return err
+	}
+	resp, err := w.client.Post(w.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("webhook returned status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// payload renders e in the format of the webhook
+func (w *Webhook) payload(e Event) ([]byte, error) {
+	text := &bytes.Buffer{}
+	if err := w.template.Execute(text, e); err != nil {
+		return nil, fmt.Errorf("failed to render %s event: %v", e.Type, err)
+	}
+
+	if w.format == FormatSlack {
+		return json.Marshal(struct {
+			Text string `json:"text"`
+		}{text.String()})
+	}
+	return json.Marshal(struct {
+		Event
+		Text string `json:"text"`
+	}{e, text.String()})
+}
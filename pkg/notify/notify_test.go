@@ -0,0 +1,146 @@
+package notify
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func testServer(t *testing.T) (*httptest.Server, chan map[string]interface{}) {
+	bodies := make(chan map[string]interface{}, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		body := map[string]interface{}{}
+		if err := json.Unmarshal(raw, &body); err != nil {
+			t.Error(err)
+		}
+		bodies <- body
+	}))
+	return srv, bodies
+}
+
+func TestWebhookFormats(t *testing.T) {
+	srv, bodies := testServer(t)
+	defer srv.Close()
+
+	e := Event{Type: NodeCycled, Pool: "worker", Node: "node-a", Message: "node-a cycled"}
+
+	slack, err := NewWebhook(Config{URL: srv.URL, Format: FormatSlack, Template: ":recycle: {{.Node}} ({{.Pool}}): {{.Message}}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := slack.Notify(e); err != nil {
+		t.Fatal(err)
+	}
+	body := <-bodies
+	if len(body) != 1 || body["text"] != ":recycle: node-a (worker): node-a cycled" {
+		t.Errorf("unexpected slack payload %v", body)
+	}
+
+	generic, err := NewWebhook(Config{URL: srv.URL, Format: FormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := generic.Notify(e); err != nil {
+		t.Fatal(err)
+	}
+	body = <-bodies
+	if body["type"] != string(NodeCycled) || body["node"] != "node-a" || body["text"] != "node-a cycled" {
+		t.Errorf("unexpected json payload %v", body)
+	}
+}
+
+func TestWebhookRateLimit(t *testing.T) {
+	srv, bodies := testServer(t)
+	defer srv.Close()
+
+	w, err := NewWebhook(Config{URL: srv.URL, Format: FormatJSON, Interval: time.Hour, Burst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := w.Notify(Event{Type: NodeCycled, Message: "cycled"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Failures are sent over the limit
+	if err := w.Notify(Event{Type: CycleFailed, Message: "failed"}); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if len(bodies) != 3 {
+		t.Fatalf("expected 2 notifications within the burst and the failure, got %d", len(bodies))
+	}
+	// Drops are reported by whichever notification is sent next
+	dropped := 0.0
+	failed := false
+	for i := 0; i < 3; i++ {
+		body := <-bodies
+		d, _ := body["dropped"].(float64)
+		dropped += d
+		failed = failed || body["type"] == string(CycleFailed)
+	}
+	if !failed || dropped != 3 {
+		t.Errorf("expected the failure sent and 3 dropped notifications reported, got failure %v and %v dropped", failed, dropped)
+	}
+}
+
+func TestWebhookQueue(t *testing.T) {
+	release := make(chan struct{})
+	var sent int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		atomic.AddInt32(&sent, 1)
+	}))
+	defer srv.Close()
+
+	w, err := NewWebhook(Config{URL: srv.URL, Format: FormatJSON})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first event is taken by the sender, which is stuck posting it
+	if err := w.Notify(Event{Type: NodeCycled}); err != nil {
+		t.Fatal(err)
+	}
+	for len(w.queue) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+	for i := 0; i < queueSize; i++ {
+		if err := w.Notify(Event{Type: NodeCycled}); err != nil {
+			t.Fatalf("unexpected error while queueing: %v", err)
+		}
+	}
+	if err := w.Notify(Event{Type: CycleFailed}); err == nil {
+		t.Error("expected an error with the queue full")
+	}
+
+	close(release)
+	w.Close()
+	if sent := atomic.LoadInt32(&sent); sent != queueSize+1 {
+		t.Errorf("expected %d notifications sent, got %d", queueSize+1, sent)
+	}
+	if w.dropped != 0 {
+		t.Errorf("expected the dropped notification to be reported, got %d left", w.dropped)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	for _, conf := range []Config{
+		{Format: FormatJSON},
+		{URL: "http://example.com", Format: "xml"},
+		{URL: "http://example.com", Format: FormatSlack, Template: "{{.Message"},
+		{URL: "http://example.com", Format: FormatSlack, Interval: time.Minute},
+	} {
+		if err := conf.Validate(); err == nil {
+			t.Errorf("expected %+v to be invalid", conf)
+		}
+	}
+}
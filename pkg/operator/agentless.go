@@ -0,0 +1,195 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"k8s.io/api/core/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/kube/k8sutil"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+// In agentless mode the operator does the job of the agents: it detects the
+// nodes that need updating through the fleet provider and cycles the approved
+// ones itself, so that no credentials are needed on the nodes.
+
+const operationPollInterval = 5 * time.Second
+
+// detectUpdates moves outdated nodes to UpdateNeeded and back to Idle nodes
+// that no longer need updating, e.g. after a group template rollback
+func (op *Operator) detectUpdates(ctx context.Context, nodes []v1.Node) error {
+	outdated, err := op.fleet.OutdatedInstances(ctx)
+	if err != nil {
+		return err
+	}
+
+	for _, n := range nodes {
+		st := op.nodeState(n)
+		reason, needsUpdate := outdated[n.Spec.ProviderID]
+
+		if needsUpdate && st.Phase == nodestate.Idle {
+			log.Println(fmt.Sprintf("[INFO] update needed for node %s: %s", n.Name, reason))
+			if _, err := nodestate.Update(op.nc, n.Name, func(s *nodestate.State) error {
+				s.Reason = reason
+				return s.Transition(nodestate.UpdateNeeded, reason)
+			}); err != nil {
+				log.Println("[ERROR] failed to request update:", err)
+			}
+		}
+
+		if !needsUpdate && st.Phase == nodestate.UpdateNeeded {
+			log.Println("[INFO] update no longer needed for node", n.Name)
+			if _, err := nodestate.Transition(op.nc, n.Name, nodestate.Idle, "update no longer needed"); err != nil {
+				log.Println("[ERROR] failed to clear update request:", err)
+			}
+		}
+	}
+	return nil
+}
+
+// startWorkers cycles every approved node, and every node left mid cycle by a
+// restart or an error, that is not being cycled already
+func (op *Operator) startWorkers(ctx context.Context, nodes []v1.Node) {
+	for _, n := range nodes {
+		st := op.nodeState(n)
+		if st.Phase != nodestate.Approved && st.Phase != nodestate.Draining && st.Phase != nodestate.Terminating {
+			continue
+		}
+
+		op.workersMu.Lock()
+		running := op.workers[n.Name]
+		op.workers[n.Name] = true
+		op.workersMu.Unlock()
+		if running {
+			continue
+		}
+
+		op.workersWg.Add(1)
+		go func(n v1.Node, from nodestate.Phase) {
+			defer op.workersWg.Done()
+			if err := op.cycleNode(ctx, n, from); err != nil {
+				log.Println(fmt.Sprintf("[ERROR] cycle of node %s stopped: %v", n.Name, err))
+			}
+			op.workersMu.Lock()
+			delete(op.workers, n.Name)
+			op.workersMu.Unlock()
+		}(n, st.Phase)
+	}
+}
+
+// cycleNode drains a node and recreates its instance, starting from phase
+// `from`. On error the node is left in its current phase, with the error
+// reported, for the next reconcile to start over from there. As with agents,
+// only a Failed node fails the cycle and the next step clears the error.
+func (op *Operator) cycleNode(ctx context.Context, n v1.Node, from nodestate.Phase) error {
+	if from == nodestate.Approved {
+		log.Println("[INFO] draining node", n.Name)
+		if _, err := nodestate.Update(op.nc, n.Name, func(s *nodestate.State) error {
+			s.BootID = n.Status.NodeInfo.BootID
+			return s.Transition(nodestate.Draining, "draining node")
+		}); err != nil {
+			return err
+		}
+	}
+
+	if from != nodestate.Terminating {
+		if err := op.drainer.Drain(ctx, n.Name); err != nil {
+			if ctx.Err() == nil {
+				op.reportError(n.Name, fmt.Errorf("drain failed: %v", err))
+			}
+			return err
+		}
+		log.Println("[INFO] node drained:", n.Name)
+		if _, err := nodestate.Transition(op.nc, n.Name, nodestate.Terminating, "terminating node"); err != nil {
+			return err
+		}
+	}
+
+	st, err := nodestate.Get(op.nc, n.Name)
+	if err != nil {
+		return err
+	}
+	operation := st.Operation
+	if operation == "" {
+		operation, err = op.fleet.RecreateInstance(ctx, n.Spec.ProviderID)
+		if err != nil {
+			return op.terminationFailed(n.Name, err)
+		}
+		log.Println(fmt.Sprintf("[INFO] recreating instance of node %s, operation: %s", n.Name, operation))
+		if _, err := nodestate.Update(op.nc, n.Name, func(s *nodestate.State) error {
+			s.Operation = operation
+			return nil
+		}); err != nil {
+			return err
+		}
+	}
+
+	for {
+		done, err := op.fleet.OperationDone(ctx, operation)
+		if err != nil {
+			return op.terminationFailed(n.Name, err)
+		}
+		if done {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(operationPollInterval):
+		}
+	}
+
+	log.Println("[INFO] instance recreated for node", n.Name)
+	_, err = nodestate.Transition(op.nc, n.Name, nodestate.Done, "instance recreated")
+	return err
+}
+
+// terminationFailed reports a termination error and fails the node when it
+// is permanent
+func (op *Operator) terminationFailed(node string, err error) error {
+	op.reportError(node, fmt.Errorf("termination failed: %v", err))
+	if models.IsPermanent(err) {
+		if _, terr := nodestate.Transition(op.nc, node, nodestate.Failed, "termination failed"); terr != nil {
+			log.Println("[ERROR] failed to mark node as failed:", terr)
+		}
+	}
+	return err
+}
+
+// reportError records a cycle error in the node state
+func (op *Operator) reportError(node string, err error) {
+	if _, uerr := nodestate.Update(op.nc, node, func(s *nodestate.State) error {
+		s.Error = err.Error()
+		return nil
+	}); uerr != nil {
+		log.Println("[ERROR] failed to report error:", uerr)
+	}
+}
+
+// resetRecreated makes nodes whose instance was recreated under the same Node
+// object usable again: they come back with a new boot id, still cordoned and
+// in the Done phase
+func (op *Operator) resetRecreated(nodes []v1.Node) {
+	for _, n := range nodes {
+		st := op.nodeState(n)
+		if st.Phase != nodestate.Done || st.BootID == "" || st.BootID == n.Status.NodeInfo.BootID {
+			continue
+		}
+		if op.dryRun {
+			log.Println("[INFO] dry run: would reset the cycle state of recreated node", n.Name)
+			continue
+		}
+		log.Println("[INFO] instance of node recreated, resetting cycle state:", n.Name)
+		if _, err := nodestate.Reset(op.nc, n.Name, "instance recreated"); err != nil {
+			log.Println("[ERROR] failed to reset node state:", err)
+			continue
+		}
+		if err := k8sutil.Unschedulable(op.nc, n.Name, false); err != nil {
+			log.Println("[ERROR] failed to make node schedulable:", err)
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	cloudfake "github.com/utilitywarehouse/kube-node-cycle-operator/cloud/fake"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+// testFleet recreates instances without touching the cluster and reports every
+// operation done. Calls fail with the queued errors first.
+type testFleet struct {
+	recreateErrs []error
+	doneErrs     []error
+	recreated    []string
+}
+
+func (f *testFleet) OutdatedInstances(ctx context.Context) (map[string]string, error) {
+	return map[string]string{}, nil
+}
+
+func (f *testFleet) RecreateInstance(ctx context.Context, providerID string) (string, error) {
+	if len(f.recreateErrs) > 0 {
+		err := f.recreateErrs[0]
+		f.recreateErrs = f.recreateErrs[1:]
+		return "", err
+	}
+	f.recreated = append(f.recreated, providerID)
+	return "operation/" + providerID, nil
+}
+
+func (f *testFleet) OperationDone(ctx context.Context, operation string) (bool, error) {
+	if len(f.doneErrs) > 0 {
+		err := f.doneErrs[0]
+		f.doneErrs = f.doneErrs[1:]
+		return false, err
+	}
+	return true, nil
+}
+
+func stateOf(t *testing.T, op *Operator, node string) nodestate.State {
+	st, err := nodestate.Get(op.nc, node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st
+}
+
+func TestDetectUpdates(t *testing.T) {
+	outdated := &v1.ConfigMap{
+		ObjectMeta: v1meta.ObjectMeta{Name: "outdated", Namespace: "kube-system"},
+		Data:       map[string]string{"node-a": "template changed"},
+	}
+	op, kc, _ := newTestCluster(t, testConf(), State{}, outdated,
+		clusterNode(t, "node-a", nodestate.Idle), clusterNode(t, "node-b", nodestate.UpdateNeeded))
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+	op.fleet = cloudfake.New(kc, cloudfake.NewConfigMapSource(kc, "kube-system", "outdated"))
+
+	nodes, err := kc.CoreV1().Nodes().List(v1meta.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := op.detectUpdates(context.Background(), nodes.Items); err != nil {
+		t.Fatal(err)
+	}
+	if st := stateOf(t, op, "node-a"); st.Phase != nodestate.UpdateNeeded || st.Reason != "template changed" {
+		t.Errorf("expected node-a to need an update, got %s (%s)", st.Phase, st.Reason)
+	}
+	// The group template was rolled back
+	if p := phaseOf(t, kc, "node-b"); p != nodestate.Idle {
+		t.Errorf("expected node-b to be idle, got %s", p)
+	}
+}
+
+func TestCycleNodeErrors(t *testing.T) {
+	transient := errors.New("connection reset")
+	permanent := &models.PermanentError{Err: errors.New("group not found")}
+
+	tests := []struct {
+		name  string
+		fleet *testFleet
+		// after the first run
+		phase nodestate.Phase
+		error string
+		cycle CyclePhase
+		// after the retry, if any
+		retried   bool
+		recreated int
+	}{
+		{
+			name:      "transient recreate error",
+			fleet:     &testFleet{recreateErrs: []error{transient}},
+			phase:     nodestate.Terminating,
+			error:     "termination failed: connection reset",
+			cycle:     CycleStarted,
+			retried:   true,
+			recreated: 1,
+		},
+		{
+			name:      "transient operation error",
+			fleet:     &testFleet{doneErrs: []error{transient}},
+			phase:     nodestate.Terminating,
+			error:     "termination failed: connection reset",
+			cycle:     CycleStarted,
+			retried:   true,
+			recreated: 1,
+		},
+		{
+			name:  "permanent recreate error",
+			fleet: &testFleet{recreateErrs: []error{permanent}},
+			phase: nodestate.Failed,
+			error: "termination failed: group not found",
+			cycle: CycleFailed,
+		},
+	}
+
+	for _, test := range tests {
+		node := clusterNode(t, "node-a", nodestate.Approved)
+		op, kc, _ := newTestCluster(t, testConf(), State{}, node)
+		op.fleet = test.fleet
+		if err := op.startCycle(*node, 0); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := op.cycleNode(context.Background(), *node, nodestate.Approved); err == nil {
+			t.Errorf("%s: expected an error", test.name)
+		}
+		if st := stateOf(t, op, "node-a"); st.Phase != test.phase || st.Error != test.error {
+			t.Errorf("%s: expected phase %s with error %q, got %s with %q", test.name, test.phase, test.error, st.Phase, st.Error)
+		}
+		nodes, err := kc.CoreV1().Nodes().List(v1meta.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := op.trackCycle(context.Background(), nodes.Items); err != nil {
+			t.Fatal(err)
+		}
+		s, err := op.loadState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := s.Cycle
+		if c == nil {
+			c = s.LastCycle
+		}
+		if c.Phase != test.cycle {
+			t.Errorf("%s: expected the cycle to be %s, got %s (%s)", test.name, test.cycle, c.Phase, c.Message)
+		}
+
+		if test.retried {
+			// The next reconcile starts a worker over from the recorded phase
+			if err := op.cycleNode(context.Background(), *node, test.phase); err != nil {
+				t.Errorf("%s: unexpected error on retry: %v", test.name, err)
+			}
+			if st := stateOf(t, op, "node-a"); st.Phase != nodestate.Done || st.Error != "" {
+				t.Errorf("%s: expected done with the error cleared, got %s with %q", test.name, st.Phase, st.Error)
+			}
+			if len(test.fleet.recreated) != test.recreated {
+				t.Errorf("%s: expected %d recreations, got %v", test.name, test.recreated, test.fleet.recreated)
+			}
+		}
+		os.RemoveAll(filepath.Dir(op.statePath))
+	}
+}
+
+func TestResetRecreated(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		// node-a came back under the same Node object with a new boot id
+		node := clusterNode(t, "node-a", nodestate.Done)
+		st := nodestate.New()
+		st.Phase = nodestate.Done
+		st.BootID = "node-a-old-boot"
+		raw, err := st.Encode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		node.Annotations[annotations.State] = raw
+		node.Spec.Unschedulable = true
+
+		conf := testConf()
+		conf.DryRun = dryRun
+		op, kc, _ := newTestCluster(t, conf, State{}, node)
+		op.resetRecreated([]v1.Node{*node})
+
+		expected := nodestate.Idle
+		if dryRun {
+			expected = nodestate.Done
+		}
+		if p := phaseOf(t, kc, "node-a"); p != expected {
+			t.Errorf("dry run %v: expected node-a %s, got %s", dryRun, expected, p)
+		}
+		n, err := kc.CoreV1().Nodes().Get("node-a", v1meta.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n.Spec.Unschedulable != dryRun {
+			t.Errorf("dry run %v: expected node-a unschedulable %v", dryRun, dryRun)
+		}
+		os.RemoveAll(filepath.Dir(op.statePath))
+	}
+}
@@ -0,0 +1,73 @@
+package operator
+
+import (
+	"fmt"
+	"log"
+
+	"k8s.io/api/core/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/notify"
+)
+
+// recordFailure accounts for a failed cycle against the failure budget of its
+// pool and halts the pool once the budget is exhausted. Halted pools are only
+// resumed manually.
+func (op *Operator) recordFailure(s *State, c *Cycle) {
+	ref := &v1.ObjectReference{Kind: "Node", Name: c.Node, UID: c.NodeUID}
+	op.recorder.Eventf(ref, v1.EventTypeWarning, "CycleFailed", "Cycle of node %s failed: %s", c.Node, c.Message)
+
+	if op.failureBudget <= 0 {
+		return
+	}
+
+	if s.Failures == nil {
+		s.Failures = map[string]int{}
+	}
+	s.Failures[c.Pool]++
+	log.Println(fmt.Sprintf("[ERROR] pool %s failed cycles: %d/%d", c.Pool, s.Failures[c.Pool], op.failureBudget))
+	if s.Failures[c.Pool] < op.failureBudget {
+		return
+	}
+
+	if err := op.ctl.HaltPool(c.Pool); err != nil {
+		// Keep the count so the halt is retried on the next failure
+		log.Println("[ERROR] failed to halt pool:", err)
+		return
+	}
+	delete(s.Failures, c.Pool)
+	log.Println(fmt.Sprintf("[ERROR] pool %s halted after %d failed cycles", c.Pool, op.failureBudget))
+	op.recorder.Eventf(ref, v1.EventTypeWarning, "RolloutHalted",
+		"Rollout of pool %s halted after %d failed cycles, manual resume required", c.Pool, op.failureBudget)
+	op.notify(notify.Event{
+		Type:    notify.RolloutHalted,
+		Pool:    c.Pool,
+		Node:    c.Node,
+		Message: fmt.Sprintf("Rollout of pool %s halted after %d failed cycles, manual resume required", c.Pool, op.failureBudget),
+	})
+}
+
+// resetFailures clears the failure counts once a rollout is over
+func (op *Operator) resetFailures() error {
+	s, err := op.loadState()
+	if err != nil || len(s.Failures) == 0 {
+		return err
+	}
+	s.Failures = nil
+	return op.saveState(s)
+}
+
+// excludeHalted filters out nodes that belong to halted pools
+func (op *Operator) excludeHalted(nodes []v1.Node, halted []string) []v1.Node {
+	isHalted := map[string]bool{}
+	for _, p := range halted {
+		isHalted[p] = true
+	}
+
+	res := []v1.Node{}
+	for _, n := range nodes {
+		if !isHalted[op.poolOf(n)] {
+			res = append(res, n)
+		}
+	}
+	return res
+}
@@ -0,0 +1,349 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+const defaultCycleTimeout = 30 * time.Minute
+
+// CyclePhase is the progress of a node cycle as observed by the operator
+type CyclePhase string
+
+const (
+	// CycleStarted: permission given, waiting for the old node to go away
+	CycleStarted CyclePhase = "started"
+	// CycleOldNodeRemoved: the old Node object is gone, waiting for a replacement
+	CycleOldNodeRemoved CyclePhase = "old-node-removed"
+	// CycleReplacementRegistered: a replacement joined, waiting for it to be Ready
+	CycleReplacementRegistered CyclePhase = "replacement-registered"
+	// CycleReplacementReady: the replacement is Ready, waiting for its DaemonSets
+	CycleReplacementReady CyclePhase = "replacement-ready"
+	// CycleEtcdMemberJoining: the replacement of a master is up, waiting for
+	// every etcd member to be healthy
+	CycleEtcdMemberJoining CyclePhase = "etcd-member-joining"
+	CycleSucceeded         CyclePhase = "succeeded"
+	CycleFailed            CyclePhase = "failed"
+	// CycleCancelled: permission was revoked before the node started updating
+	CycleCancelled CyclePhase = "cancelled"
+)
+
+// Cycle tracks the replacement of a node end to end
+type Cycle struct {
+	Node    string    `json:"node"`
+	NodeUID types.UID `json:"nodeUID"`
+	// BootID of the node when the cycle started. Instances recreated under the
+	// same Node object come back with a new one
+	BootID        string `json:"bootID,omitempty"`
+	Pool          string `json:"pool"`
+	Zone          string `json:"zone,omitempty"`
+	DaemonSetPods int    `json:"daemonSetPods"`
+	// EtcdMembers is the size of the etcd cluster when a master was granted,
+	// 0 for other nodes
+	EtcdMembers int        `json:"etcdMembers,omitempty"`
+	Phase       CyclePhase `json:"phase"`
+	Replacement string     `json:"replacement,omitempty"`
+	// Operation is the cloud operation terminating the node, as recorded by the agent
+	Operation  string    `json:"operation,omitempty"`
+	Message    string    `json:"message,omitempty"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt,omitempty"`
+}
+
+func (c *Cycle) finished() bool {
+	return c.Phase == CycleSucceeded || c.Phase == CycleFailed || c.Phase == CycleCancelled
+}
+
+var cyclesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "kube_node_cycle_operator_cycles_total",
+	Help: "Number of finished node cycles by pool and result",
+}, []string{"pool", "result"})
+
+func init() {
+	prometheus.MustRegister(cyclesTotal)
+}
+
+// daemonSetPods returns the pods on a node that are owned by a DaemonSet
+func (op *Operator) daemonSetPods(node string) ([]v1.Pod, error) {
+	podList, err := op.kc.CoreV1().Pods(v1.NamespaceAll).List(v1meta.ListOptions{
+		FieldSelector: fields.SelectorFromSet(fields.Set{"spec.nodeName": node}).String(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pods := []v1.Pod{}
+	for _, pod := range podList.Items {
+		if pod.Spec.NodeName != node {
+			continue
+		}
+		for _, ownerRef := range pod.OwnerReferences {
+			if ownerRef.Kind == "DaemonSet" {
+				pods = append(pods, pod)
+				break
+			}
+		}
+	}
+	return pods, nil
+}
+
+// startCycle begins tracking the cycle of a node that was given permission.
+// Cycles of etcd masters only succeed once etcd is back to etcdMembers.
+func (op *Operator) startCycle(n v1.Node, etcdMembers int) error {
+	dsPods, err := op.daemonSetPods(n.Name)
+	if err != nil {
+		return err
+	}
+
+	s, err := op.loadState()
+	if err != nil {
+		return err
+	}
+	s.Cycle = &Cycle{
+		Node:          n.Name,
+		NodeUID:       n.UID,
+		BootID:        n.Status.NodeInfo.BootID,
+		Pool:          op.poolOf(n),
+		Zone:          zoneOf(n),
+		DaemonSetPods: len(dsPods),
+		EtcdMembers:   etcdMembers,
+		Phase:         CycleStarted,
+		StartedAt:     op.now(),
+	}
+	return op.saveState(s)
+}
+
+// trackCycle moves the current cycle forward based on the nodes in the
+// cluster. It returns the cycle still in progress, if any.
+func (op *Operator) trackCycle(ctx context.Context, nodes []v1.Node) (*Cycle, error) {
+	s, err := op.loadState()
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if s.Cycle == nil {
+		return nil, nil
+	}
+	c := s.Cycle
+	phase := c.Phase
+
+	if err := op.advanceCycle(ctx, c, nodes); err != nil {
+		return nil, err
+	}
+
+	if c.Phase != phase {
+		log.Println(fmt.Sprintf("[INFO] cycle of node %s: %s -> %s", c.Node, phase, c.Phase))
+	}
+
+	if c.finished() {
+		op.finishCycle(c)
+		op.cycleFinished(s, c)
+		if c.Phase == CycleFailed {
+			op.recordFailure(s, c)
+		}
+		// Replacements may land in another zone
+		if c.Phase == CycleSucceeded && s.ZoneNodeCounts != nil {
+			s.ZoneNodeCounts = zoneNodeCounts(nodes)
+		}
+		s.LastCycle = c
+		s.Cycle = nil
+	}
+	if err := op.saveState(s); err != nil {
+		return nil, err
+	}
+	return s.Cycle, nil
+}
+
+// advanceCycle runs through as many phases as the cluster state allows
+func (op *Operator) advanceCycle(ctx context.Context, c *Cycle, nodes []v1.Node) error {
+	if c.finished() {
+		return nil
+	}
+
+	if op.now().Sub(c.StartedAt) > op.cycleTimeout {
+		c.Message = fmt.Sprintf("cycle did not complete within %v, last phase: %s", op.cycleTimeout, c.Phase)
+		c.Phase = CycleFailed
+		return nil
+	}
+
+	var replacement *v1.Node
+	if c.Phase == CycleStarted {
+		for i, n := range nodes {
+			// Recreated instances may register with the same name but a new uid
+			if n.Name == c.Node && n.UID == c.NodeUID {
+				// or reuse the Node object altogether
+				if c.BootID != "" && n.Status.NodeInfo.BootID != "" && n.Status.NodeInfo.BootID != c.BootID {
+					replacement = &nodes[i]
+					break
+				}
+				// Drain and cloud errors are reported by the agent, which
+				// retries until it gives up and moves the node to Failed
+				st := op.nodeState(n)
+				if st.Phase == nodestate.Failed {
+					c.Phase = CycleFailed
+					c.Message = fmt.Sprintf("agent reported: %s", st.Error)
+					return nil
+				}
+				c.Message = ""
+				if st.Error != "" {
+					c.Message = fmt.Sprintf("agent retrying: %s", st.Error)
+				}
+				c.Operation = st.Operation
+				return op.checkOperation(ctx, c)
+			}
+		}
+		if replacement != nil {
+			c.Replacement = replacement.Name
+			c.Phase = CycleReplacementRegistered
+		} else {
+			c.Phase = CycleOldNodeRemoved
+		}
+	}
+
+	if c.Phase == CycleOldNodeRemoved {
+		for i, n := range nodes {
+			if op.poolOf(n) != c.Pool || n.CreationTimestamp.Time.Before(c.StartedAt) {
+				continue
+			}
+			if replacement == nil || n.CreationTimestamp.After(replacement.CreationTimestamp.Time) {
+				replacement = &nodes[i]
+			}
+		}
+		if replacement == nil {
+			return nil
+		}
+		c.Replacement = replacement.Name
+		c.Phase = CycleReplacementRegistered
+	}
+
+	if replacement == nil {
+		for i, n := range nodes {
+			if n.Name == c.Replacement {
+				replacement = &nodes[i]
+				break
+			}
+		}
+		if replacement == nil {
+			c.Phase = CycleFailed
+			c.Message = fmt.Sprintf("replacement node %s disappeared", c.Replacement)
+			return nil
+		}
+	}
+
+	if c.Phase == CycleReplacementRegistered {
+		if !isReady(*replacement) {
+			return nil
+		}
+		c.Phase = CycleReplacementReady
+	}
+
+	if c.Phase == CycleReplacementReady {
+		pods, err := op.daemonSetPods(replacement.Name)
+		if err != nil {
+			return err
+		}
+		ready := 0
+		for _, p := range pods {
+			if podReady(p) {
+				ready++
+			}
+		}
+		if ready < c.DaemonSetPods || ready < len(pods) {
+			return nil
+		}
+		if c.EtcdMembers > 0 && op.etcd != nil {
+			c.Phase = CycleEtcdMemberJoining
+		} else {
+			c.Phase = CycleSucceeded
+			c.Message = fmt.Sprintf("replaced by %s", replacement.Name)
+		}
+	}
+
+	if c.Phase == CycleEtcdMemberJoining {
+		joined, reason, err := op.etcdRejoined(ctx, c.EtcdMembers)
+		if err != nil {
+			return err
+		}
+		if !joined {
+			c.Message = fmt.Sprintf("waiting for etcd: %s", reason)
+			return nil
+		}
+		c.Phase = CycleSucceeded
+		c.Message = fmt.Sprintf("replaced by %s, etcd healthy", replacement.Name)
+	}
+	return nil
+}
+
+// checkOperation fails the cycle if its termination operation failed. The
+// agent may not live long enough to see it, going down with its instance.
+// Failures to look the operation up are only logged and the operation is
+// checked again on the next reconcile.
+func (op *Operator) checkOperation(ctx context.Context, c *Cycle) error {
+	if op.cloud == nil || c.Operation == "" {
+		return nil
+	}
+	done, err := op.cloud.OperationDone(ctx, c.Operation)
+	if done && err != nil {
+		c.Phase = CycleFailed
+		c.Message = fmt.Sprintf("termination operation failed: %v", err)
+		return nil
+	}
+	if err != nil {
+		log.Println("[ERROR] failed to check termination operation:", err)
+	}
+	return nil
+}
+
+// finishCycle logs and accounts for a finished cycle
+func (op *Operator) finishCycle(c *Cycle) {
+	c.FinishedAt = op.now()
+	cyclesTotal.WithLabelValues(c.Pool, string(c.Phase)).Inc()
+	switch c.Phase {
+	case CycleSucceeded:
+		log.Println(fmt.Sprintf("[INFO] cycle of node %s succeeded: %s", c.Node, c.Message))
+	default:
+		log.Println(fmt.Sprintf("[ERROR] cycle of node %s %s: %s", c.Node, c.Phase, c.Message))
+	}
+}
+
+// cancelCycle stops tracking the cycle of a node whose permission was revoked
+func (op *Operator) cancelCycle(node string) error {
+	s, err := op.loadState()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if s.Cycle == nil || s.Cycle.Node != node {
+		return nil
+	}
+	s.Cycle.Phase = CycleCancelled
+	s.Cycle.Message = "permission revoked"
+	op.finishCycle(s.Cycle)
+	s.LastCycle = s.Cycle
+	s.Cycle = nil
+	return op.saveState(s)
+}
+
+func podReady(p v1.Pod) bool {
+	for _, c := range p.Status.Conditions {
+		if c.Type == v1.PodReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
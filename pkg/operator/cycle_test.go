@@ -0,0 +1,284 @@
+package operator
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+// erroredNode returns a node whose agent reported an error in phase
+func erroredNode(t *testing.T, name string, phase nodestate.Phase, message string) *v1.Node {
+	n := clusterNode(t, name, phase)
+	st := nodestate.New()
+	st.Phase = phase
+	st.Error = message
+	raw, err := st.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Annotations[annotations.State] = raw
+	return n
+}
+
+// replacementNode returns a node registered after the cycle started
+func replacementNode(t *testing.T, name, pool string, ready bool, age time.Duration) *v1.Node {
+	n := clusterNode(t, name, nodestate.Idle)
+	n.UID = types.UID(name + "-new-uid")
+	n.Labels["role"] = pool
+	n.CreationTimestamp = v1meta.NewTime(epoch.Add(age))
+	n.Status.NodeInfo.BootID = name + "-new-boot"
+	if !ready {
+		n.Status.Conditions[0].Status = v1.ConditionFalse
+	}
+	return n
+}
+
+func dsPod(name, node string, ready bool) *v1.Pod {
+	status := v1.ConditionFalse
+	if ready {
+		status = v1.ConditionTrue
+	}
+	return &v1.Pod{
+		ObjectMeta: v1meta.ObjectMeta{
+			Name:            name,
+			Namespace:       "kube-system",
+			OwnerReferences: []v1meta.OwnerReference{{Kind: "DaemonSet", Name: name}},
+		},
+		Spec:   v1.PodSpec{NodeName: node},
+		Status: v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: status}}},
+	}
+}
+
+func TestTrackCycle(t *testing.T) {
+	started := func(phase CyclePhase, dsPods int) *Cycle {
+		return &Cycle{
+			Node:          "node-a",
+			NodeUID:       "node-a-uid",
+			BootID:        "node-a-boot",
+			Pool:          "worker",
+			DaemonSetPods: dsPods,
+			Phase:         phase,
+			StartedAt:     epoch,
+		}
+	}
+	// the same Node object, back with a new boot id
+	reused := clusterNode(t, "node-a", nodestate.Idle)
+	reused.Status.NodeInfo.BootID = "node-a-new-boot"
+
+	tests := []struct {
+		name        string
+		cycle       *Cycle
+		elapsed     time.Duration
+		objects     []runtime.Object
+		phase       CyclePhase
+		replacement string
+		message     string
+	}{
+		{
+			name:    "old node still up",
+			cycle:   started(CycleStarted, 0),
+			objects: []runtime.Object{clusterNode(t, "node-a", nodestate.Terminating)},
+			phase:   CycleStarted,
+		},
+		{
+			name:    "agent retrying a transient error",
+			cycle:   started(CycleStarted, 0),
+			objects: []runtime.Object{erroredNode(t, "node-a", nodestate.Draining, "drain failed: eviction refused")},
+			phase:   CycleStarted,
+			message: "agent retrying: drain failed: eviction refused",
+		},
+		{
+			name:    "agent failed",
+			cycle:   started(CycleStarted, 0),
+			objects: []runtime.Object{erroredNode(t, "node-a", nodestate.Failed, "termination failed: quota exceeded")},
+			phase:   CycleFailed,
+			message: "agent reported: termination failed: quota exceeded",
+		},
+		{
+			name:        "node object reused with a new boot id",
+			cycle:       started(CycleStarted, 0),
+			objects:     []runtime.Object{reused},
+			phase:       CycleSucceeded,
+			replacement: "node-a",
+		},
+		{
+			name:    "old node removed",
+			cycle:   started(CycleStarted, 0),
+			objects: []runtime.Object{clusterNode(t, "node-b", nodestate.Idle)},
+			phase:   CycleOldNodeRemoved,
+		},
+		{
+			name:  "replacement picked by pool and creation time",
+			cycle: started(CycleStarted, 0),
+			objects: []runtime.Object{
+				clusterNode(t, "node-b", nodestate.Idle),
+				replacementNode(t, "infra-new", "infra", true, 3*time.Minute),
+				replacementNode(t, "node-c", "worker", false, time.Minute),
+				replacementNode(t, "node-d", "worker", false, 2*time.Minute),
+				replacementNode(t, "node-old", "worker", false, -time.Minute),
+			},
+			phase:       CycleReplacementRegistered,
+			replacement: "node-d",
+		},
+		{
+			name:  "replacement recreated under the same name",
+			cycle: started(CycleStarted, 0),
+			objects: []runtime.Object{
+				replacementNode(t, "node-a", "worker", false, time.Minute),
+			},
+			phase:       CycleReplacementRegistered,
+			replacement: "node-a",
+		},
+		{
+			name:  "daemonsets not ready",
+			cycle: started(CycleStarted, 2),
+			objects: []runtime.Object{
+				replacementNode(t, "node-c", "worker", true, time.Minute),
+				dsPod("proxy", "node-c", true),
+				dsPod("logs", "node-c", false),
+			},
+			phase:       CycleReplacementReady,
+			replacement: "node-c",
+		},
+		{
+			name:  "fewer daemonsets than the old node ran",
+			cycle: started(CycleStarted, 2),
+			objects: []runtime.Object{
+				replacementNode(t, "node-c", "worker", true, time.Minute),
+				dsPod("proxy", "node-c", true),
+			},
+			phase:       CycleReplacementReady,
+			replacement: "node-c",
+		},
+		{
+			name:  "daemonsets ready",
+			cycle: started(CycleStarted, 2),
+			objects: []runtime.Object{
+				replacementNode(t, "node-c", "worker", true, time.Minute),
+				dsPod("proxy", "node-c", true),
+				dsPod("logs", "node-c", true),
+				// pods of other nodes do not count
+				dsPod("other", "node-b", false),
+			},
+			phase:       CycleSucceeded,
+			replacement: "node-c",
+		},
+		{
+			name:        "replacement disappeared",
+			cycle:       &Cycle{Node: "node-a", Pool: "worker", Phase: CycleReplacementRegistered, Replacement: "node-c", StartedAt: epoch},
+			objects:     []runtime.Object{clusterNode(t, "node-b", nodestate.Idle)},
+			phase:       CycleFailed,
+			replacement: "node-c",
+		},
+		{
+			name:    "timeout",
+			cycle:   started(CycleStarted, 0),
+			elapsed: 31 * time.Minute,
+			objects: []runtime.Object{clusterNode(t, "node-a", nodestate.Terminating)},
+			phase:   CycleFailed,
+		},
+	}
+
+	for _, test := range tests {
+		op, kc, clock := newTestCluster(t, testConf(), State{Cycle: test.cycle}, test.objects...)
+		clock.now = epoch.Add(5 * time.Minute)
+		if test.elapsed > 0 {
+			clock.now = epoch.Add(test.elapsed)
+		}
+
+		nodes, err := kc.CoreV1().Nodes().List(v1meta.ListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		current, err := op.trackCycle(context.Background(), nodes.Items)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %v", test.name, err)
+		}
+		s, err := op.loadState()
+		if err != nil {
+			t.Fatal(err)
+		}
+		os.RemoveAll(filepath.Dir(op.statePath))
+
+		c := current
+		if c == nil {
+			c = s.LastCycle
+			if c == nil || !c.finished() {
+				t.Errorf("%s: expected a finished cycle, got %+v", test.name, c)
+				continue
+			}
+		}
+		if c.Phase != test.phase || c.Replacement != test.replacement {
+			t.Errorf("%s: expected phase %s with replacement %q, got %s with %q (%s)",
+				test.name, test.phase, test.replacement, c.Phase, c.Replacement, c.Message)
+		}
+		if test.message != "" && c.Message != test.message {
+			t.Errorf("%s: expected message %q, got %q", test.name, test.message, c.Message)
+		}
+	}
+}
+
+func TestCancelCycle(t *testing.T) {
+	op, _, _ := newTestCluster(t, testConf(), State{Cycle: &Cycle{Node: "node-a", Pool: "worker", Phase: CycleStarted, StartedAt: epoch}})
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+
+	// Revoking another node leaves the cycle alone
+	if err := op.cancelCycle("node-b"); err != nil {
+		t.Fatal(err)
+	}
+	s, err := op.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Cycle == nil {
+		t.Fatalf("expected the cycle of node-a to be tracked still")
+	}
+
+	if err := op.cancelCycle("node-a"); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = op.loadState(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Cycle != nil || s.LastCycle == nil || s.LastCycle.Phase != CycleCancelled || !s.LastCycle.FinishedAt.Equal(epoch) {
+		t.Errorf("expected the cycle to be cancelled, got %+v %+v", s.Cycle, s.LastCycle)
+	}
+}
+
+func TestCheckOperation(t *testing.T) {
+	tests := []struct {
+		name  string
+		cloud *testCloud
+		phase CyclePhase
+	}{
+		{"running", &testCloud{}, CycleStarted},
+		{"succeeded", &testCloud{done: true}, CycleStarted},
+		{"failed", &testCloud{done: true, opErr: &models.PermanentError{Err: errors.New("quota exceeded")}}, CycleFailed},
+		// Lookup errors, even permanent ones, are retried on the next reconcile
+		{"lookup forbidden", &testCloud{opErr: &models.PermanentError{Err: errors.New("forbidden")}}, CycleStarted},
+		{"lookup failed", &testCloud{opErr: errors.New("connection reset")}, CycleStarted},
+	}
+
+	for _, test := range tests {
+		op := &Operator{cloud: test.cloud}
+		c := &Cycle{Node: "node-a", Phase: CycleStarted, Operation: "operation-a"}
+		if err := op.checkOperation(context.Background(), c); err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if c.Phase != test.phase {
+			t.Errorf("%s: expected the cycle %s, got %s (%s)", test.name, test.phase, c.Phase, c.Message)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+package operator
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DecisionType is the outcome of a single reconcile
+type DecisionType string
+
+const (
+	// DecisionGrant: a node was given permission to terminate
+	DecisionGrant DecisionType = "grant"
+	// DecisionWait: nothing to do for now, things are progressing as expected
+	DecisionWait DecisionType = "wait"
+	// DecisionBlocked: a node would be granted but something prevents it
+	DecisionBlocked DecisionType = "blocked"
+)
+
+// Reason explains why a decision was taken
+type Reason string
+
+const (
+	ReasonGranted          Reason = "granted"
+	ReasonNoUpdateNeeded   Reason = "no-update-needed"
+	ReasonUpdateInProgress Reason = "update-in-progress"
+	ReasonCycleInProgress  Reason = "cycle-in-progress"
+	ReasonPaused           Reason = "paused"
+	ReasonAborted          Reason = "aborted"
+	ReasonNotReadyNodes    Reason = "not-ready-nodes"
+	ReasonStaleNodeRemoved Reason = "stale-node-removed"
+	ReasonBelowNodeCount   Reason = "below-node-count"
+	ReasonUnhealthy        Reason = "unhealthy"
+	ReasonHalted           Reason = "halted"
+	ReasonError            Reason = "error"
+	ReasonDryRun           Reason = "dry-run"
+	ReasonZoneDegraded     Reason = "zone-degraded"
+	ReasonEtcdQuorum       Reason = "etcd-quorum"
+)
+
+// Decision is the typed result of a reconcile
+type Decision struct {
+	Type    DecisionType `json:"type"`
+	Reason  Reason       `json:"reason"`
+	Message string       `json:"message"`
+	Node    string       `json:"node,omitempty"`
+	Time    time.Time    `json:"time"`
+}
+
+func (d Decision) String() string {
+	s := fmt.Sprintf("%s (%s)", d.Type, d.Reason)
+	if d.Message != "" {
+		s = fmt.Sprintf("%s: %s", s, d.Message)
+	}
+	return s
+}
+
+// sameAs tells whether two decisions only differ in their details
+func (d Decision) sameAs(other Decision) bool {
+	return d.Type == other.Type && d.Reason == other.Reason && d.Node == other.Node
+}
+
+func grantDecision(node string) Decision {
+	return Decision{
+		Type:    DecisionGrant,
+		Reason:  ReasonGranted,
+		Message: fmt.Sprintf("permission given to node %s", node),
+		Node:    node,
+	}
+}
+
+// dryRunDecision is the grant of node that a dry run did not make
+func dryRunDecision(node string) Decision {
+	return Decision{
+		Type:    DecisionWait,
+		Reason:  ReasonDryRun,
+		Message: fmt.Sprintf("dry run, would give permission to node %s", node),
+		Node:    node,
+	}
+}
+
+func waitDecision(reason Reason, format string, a ...interface{}) Decision {
+	return Decision{Type: DecisionWait, Reason: reason, Message: fmt.Sprintf(format, a...)}
+}
+
+func blockedDecision(reason Reason, format string, a ...interface{}) Decision {
+	return Decision{Type: DecisionBlocked, Reason: reason, Message: fmt.Sprintf(format, a...)}
+}
+
+var (
+	decisionGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "kube_node_cycle_operator_decision",
+		Help: "Last decision taken by the operator, set to 1 for the current type and reason",
+	}, []string{"type", "reason"})
+
+	decisionsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "kube_node_cycle_operator_decisions_total",
+		Help: "Number of decisions taken by the operator by type and reason",
+	}, []string{"type", "reason"})
+)
+
+func init() {
+	prometheus.MustRegister(decisionGauge, decisionsTotal)
+}
+
+// recordDecision stores the outcome of the last reconcile in the served
+// status, updates metrics and logs it when it differs from the previous one
+func (op *Operator) recordDecision(d Decision) {
+	d.Time = op.now()
+
+	decisionGauge.Reset()
+	decisionGauge.WithLabelValues(string(d.Type), string(d.Reason)).Set(1)
+	decisionsTotal.WithLabelValues(string(d.Type), string(d.Reason)).Inc()
+
+	op.mu.Lock()
+	last := op.snapshot.LastDecision
+	op.snapshot.LastDecision = &d
+	op.mu.Unlock()
+
+	if last == nil || !last.sameAs(d) {
+		log.Println("[INFO] decision:", d)
+	}
+}
@@ -0,0 +1,119 @@
+package operator
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/control"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+func TestReconcileDecisions(t *testing.T) {
+	notReady := clusterNode(t, "node-b", nodestate.Idle)
+	notReady.Status.Conditions[0].Status = v1.ConditionFalse
+	halted := controlMap(control.RolloutRunning)
+	halted.Data[control.HaltedKey] = "worker"
+	unreadyPod := &v1.Pod{ObjectMeta: v1meta.ObjectMeta{Name: "dns", Namespace: "kube-system"}}
+
+	tests := []struct {
+		name    string
+		conf    func(*Config)
+		state   State
+		objects []runtime.Object
+		typ     DecisionType
+		reason  Reason
+	}{
+		{
+			name:    "no update needed",
+			objects: []runtime.Object{clusterNode(t, "node-a", nodestate.Idle)},
+			typ:     DecisionWait, reason: ReasonNoUpdateNeeded,
+		},
+		{
+			name:    "grant",
+			objects: []runtime.Object{clusterNode(t, "node-a", nodestate.UpdateNeeded)},
+			typ:     DecisionGrant, reason: ReasonGranted,
+		},
+		{
+			name:    "paused",
+			objects: []runtime.Object{controlMap(control.RolloutPaused), clusterNode(t, "node-a", nodestate.UpdateNeeded)},
+			typ:     DecisionWait, reason: ReasonPaused,
+		},
+		{
+			name:    "aborted",
+			objects: []runtime.Object{controlMap(control.RolloutAbort), clusterNode(t, "node-a", nodestate.UpdateNeeded)},
+			typ:     DecisionWait, reason: ReasonAborted,
+		},
+		{
+			name:    "invalid rollout mode",
+			objects: []runtime.Object{controlMap("pause"), clusterNode(t, "node-a", nodestate.UpdateNeeded)},
+			typ:     DecisionBlocked, reason: ReasonError,
+		},
+		{
+			name:    "not ready node",
+			objects: []runtime.Object{clusterNode(t, "node-a", nodestate.UpdateNeeded), notReady},
+			typ:     DecisionBlocked, reason: ReasonNotReadyNodes,
+		},
+		{
+			name:    "permission given",
+			objects: []runtime.Object{clusterNode(t, "node-a", nodestate.UpdateNeeded), clusterNode(t, "node-b", nodestate.Approved)},
+			typ:     DecisionWait, reason: ReasonUpdateInProgress,
+		},
+		{
+			name:    "node draining",
+			objects: []runtime.Object{clusterNode(t, "node-a", nodestate.UpdateNeeded), clusterNode(t, "node-b", nodestate.Draining)},
+			typ:     DecisionWait, reason: ReasonUpdateInProgress,
+		},
+		{
+			name:    "cycle in progress",
+			state:   State{Cycle: &Cycle{Node: "node-x", Pool: "worker", Phase: CycleOldNodeRemoved, StartedAt: epoch}},
+			objects: []runtime.Object{clusterNode(t, "node-a", nodestate.UpdateNeeded)},
+			typ:     DecisionWait, reason: ReasonCycleInProgress,
+		},
+		{
+			name:    "pool halted",
+			objects: []runtime.Object{halted, clusterNode(t, "node-a", nodestate.UpdateNeeded)},
+			typ:     DecisionBlocked, reason: ReasonHalted,
+		},
+		{
+			name:    "below node count",
+			state:   State{NodeCount: 3},
+			objects: []runtime.Object{clusterNode(t, "node-a", nodestate.UpdateNeeded)},
+			typ:     DecisionBlocked, reason: ReasonBelowNodeCount,
+		},
+		{
+			name:    "unhealthy",
+			conf:    func(c *Config) { c.Health.KubeSystemPods = true },
+			objects: []runtime.Object{unreadyPod, clusterNode(t, "node-a", nodestate.UpdateNeeded)},
+			typ:     DecisionBlocked, reason: ReasonUnhealthy,
+		},
+		{
+			name:    "dry run",
+			conf:    func(c *Config) { c.DryRun = true },
+			objects: []runtime.Object{clusterNode(t, "node-a", nodestate.UpdateNeeded)},
+			typ:     DecisionWait, reason: ReasonDryRun,
+		},
+	}
+
+	for _, test := range tests {
+		conf := testConf()
+		if test.conf != nil {
+			test.conf(&conf)
+		}
+		op, _, _ := newTestCluster(t, conf, test.state, test.objects...)
+		d := op.Reconcile(context.Background())
+		os.RemoveAll(filepath.Dir(op.statePath))
+
+		if d.Type != test.typ || d.Reason != test.reason {
+			t.Errorf("%s: expected %s (%s), got %s", test.name, test.typ, test.reason, d)
+		}
+		if last := op.snapshot.LastDecision; last == nil || !last.sameAs(d) || !last.Time.Equal(epoch) {
+			t.Errorf("%s: expected the decision to be recorded, got %v", test.name, last)
+		}
+	}
+}
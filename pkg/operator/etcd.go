@@ -0,0 +1,78 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+
+	"k8s.io/api/core/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/etcd"
+)
+
+// etcdMember returns the member running on a node, matched by name or by the
+// host of its peer urls, nil if none
+func etcdMember(members []etcd.Member, n v1.Node) *etcd.Member {
+	hosts := map[string]bool{n.Name: true}
+	for _, a := range n.Status.Addresses {
+		hosts[a.Address] = true
+	}
+	for i, m := range members {
+		if m.Name != "" && m.Name == n.Name {
+			return &members[i]
+		}
+		for _, p := range m.PeerURLs {
+			u, err := url.Parse(p)
+			if err != nil {
+				continue
+			}
+			host, _, err := net.SplitHostPort(u.Host)
+			if err != nil {
+				host = u.Host
+			}
+			if hosts[host] {
+				return &members[i]
+			}
+		}
+	}
+	return nil
+}
+
+// etcdSafe tells whether a master can be cycled without etcd losing its
+// quorum, and why not. It also returns the size of the cluster to wait for
+// once the master is replaced.
+func (op *Operator) etcdSafe(ctx context.Context, n v1.Node) (bool, string, int, error) {
+	members, err := op.etcd.Members(ctx)
+	if err != nil {
+		return false, "", 0, err
+	}
+	var id uint64
+	m := etcdMember(members, n)
+	if m != nil {
+		id = m.ID
+	}
+	ok, reason := etcd.CanLose(members, id)
+	if !ok && m == nil {
+		reason = fmt.Sprintf("no member matches node %s, assuming it runs a healthy one: %s", n.Name, reason)
+	}
+	return ok, reason, len(members), nil
+}
+
+// etcdRejoined tells whether the cluster is back to at least size members, all
+// of them healthy, and why not
+func (op *Operator) etcdRejoined(ctx context.Context, size int) (bool, string, error) {
+	members, err := op.etcd.Members(ctx)
+	if err != nil {
+		return false, "", err
+	}
+	if len(members) < size {
+		return false, fmt.Sprintf("%d of %d members", len(members), size), nil
+	}
+	for _, m := range members {
+		if !m.Healthy {
+			return false, fmt.Sprintf("member %q (%x) not healthy: %s", m.Name, m.ID, m.Error), nil
+		}
+	}
+	return true, "", nil
+}
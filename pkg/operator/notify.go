@@ -0,0 +1,101 @@
+package operator
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/notify"
+)
+
+// Rollout accounts for the nodes cycled from the first node found needing an
+// update until none does
+type Rollout struct {
+	StartedAt time.Time `json:"startedAt"`
+	// Nodes is the number of nodes needing an update when the rollout started
+	Nodes  int `json:"nodes"`
+	Cycled int `json:"cycled"`
+	Failed int `json:"failed"`
+}
+
+// notify sends e to the notifier, if any. Failures to notify never block the
+// rollout. Dry runs do not notify.
+func (op *Operator) notify(e notify.Event) {
+	if op.notifier == nil || op.dryRun {
+		return
+	}
+	e.Time = op.now()
+	if err := op.notifier.Notify(e); err != nil {
+		log.Println(fmt.Sprintf("[ERROR] failed to send %s notification: %v", e.Type, err))
+	}
+}
+
+// startRollout records the start of a rollout when nodes first need an update
+func (op *Operator) startRollout(updateNodes int) error {
+	s, err := op.loadState()
+	if err != nil {
+		return err
+	}
+	if s.Rollout != nil {
+		return nil
+	}
+	s.Rollout = &Rollout{StartedAt: op.now(), Nodes: updateNodes}
+	if err := op.saveState(s); err != nil {
+		return err
+	}
+	op.notify(notify.Event{
+		Type:    notify.RolloutStarted,
+		Message: fmt.Sprintf("Rollout started, %d nodes need an update", updateNodes),
+	})
+	return nil
+}
+
+// finishRollout records the end of the rollout in progress, if any, once no
+// node needs an update
+func (op *Operator) finishRollout() error {
+	s, err := op.loadState()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil || s.Rollout == nil {
+		return err
+	}
+	r := s.Rollout
+	s.Rollout = nil
+	if err := op.saveState(s); err != nil {
+		return err
+	}
+	op.notify(notify.Event{
+		Type: notify.RolloutFinished,
+		Message: fmt.Sprintf("Rollout finished in %v, %d nodes cycled, %d failed cycles",
+			op.now().Sub(r.StartedAt).Round(time.Second), r.Cycled, r.Failed),
+	})
+	return nil
+}
+
+// cycleFinished accounts for a finished cycle in the rollout in progress
+func (op *Operator) cycleFinished(s *State, c *Cycle) {
+	switch c.Phase {
+	case CycleSucceeded:
+		if s.Rollout != nil {
+			s.Rollout.Cycled++
+		}
+		op.notify(notify.Event{
+			Type:    notify.NodeCycled,
+			Pool:    c.Pool,
+			Node:    c.Node,
+			Message: fmt.Sprintf("Node %s of pool %s cycled in %v: %s", c.Node, c.Pool, c.FinishedAt.Sub(c.StartedAt).Round(time.Second), c.Message),
+		})
+	case CycleFailed:
+		if s.Rollout != nil {
+			s.Rollout.Failed++
+		}
+		op.notify(notify.Event{
+			Type:    notify.CycleFailed,
+			Pool:    c.Pool,
+			Node:    c.Node,
+			Message: fmt.Sprintf("Cycle of node %s of pool %s failed: %s", c.Node, c.Pool, c.Message),
+		})
+	}
+}
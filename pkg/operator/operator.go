@@ -1,33 +1,151 @@
 package operator
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"os"
+	"strings"
+	"sync"
 	"time"
 
-	"github.com/pkg/errors"
 	"k8s.io/api/core/v1"
 	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/util/wait"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
 	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 
 	"github.com/utilitywarehouse/kube-node-cycle-operator/kube/k8sutil"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/models"
 	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/control"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/drain"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/etcd"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/health"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/notify"
 )
 
-const defaultPollInterval = 10 * time.Second
+const (
+	defaultPollInterval = 10 * time.Second
+	// defaultReconcileInterval is the time between two reconciles
+	defaultReconcileInterval = 30 * time.Second
+	defaultMasterLabel       = "role=master"
+)
 
 type State struct {
-	NodeCount int `json:nodecount`
+	NodeCount int `json:"nodecount"`
+	// Cycle is the node cycle currently being tracked
+	Cycle *Cycle `json:"cycle,omitempty"`
+	// LastCycle is the last tracked cycle that finished
+	LastCycle *Cycle `json:"lastCycle,omitempty"`
+	// Failures counts failed cycles per pool during the current rollout
+	Failures map[string]int `json:"failures,omitempty"`
+	// ZoneNodeCounts is the number of Ready nodes per zone, recorded with the
+	// node count and after every successful cycle
+	ZoneNodeCounts map[string]int `json:"zoneNodeCounts,omitempty"`
+	// Rollout is the rollout in progress, if any
+	Rollout *Rollout `json:"rollout,omitempty"`
+}
+
+// Config holds the operator settings. PollInterval, PoolLabel, MasterLabel,
+// Order, PoolOrder, ZoneAware, CycleTimeout, FailureBudget, StaleNodeGrace, Health and DryRun can be
+// reloaded while the operator runs.
+type Config struct {
+	KubeConfig       string
+	StatePath        string
+	ControlNamespace string
+	ControlName      string
+	PoolLabel        string
+	// MasterLabel, as key=value, selects the master nodes cycled first
+	MasterLabel string
+	// PollInterval is the time between two reconciles
+	PollInterval time.Duration
+	// Order lists the strategies picking the next node, see ValidateOrder.
+	// Defaults to DefaultOrder
+	Order []string
+	// PoolOrder overrides Order within the pools it lists
+	PoolOrder map[string][]string
+	// CycleTimeout is how long a node cycle may take from permission to a
+	// healthy replacement before it is marked as failed
+	CycleTimeout time.Duration
+	// FailureBudget is the number of failed cycles after which a pool is
+	// halted until manually resumed. Disabled when 0
+	FailureBudget int
+	// Cloud is used to remove nodes whose instance is gone. Optional
+	Cloud models.CloudProviderInterface
+	// Etcd is checked before cycling a master so that etcd keeps its quorum,
+	// and after, until the replaced member rejoins. Optional
+	Etcd etcd.Cluster
+	// Notifier is sent rollout progress and failures. Optional
+	Notifier notify.Notifier
+	// StaleNodeGrace is how long a node must be NotReady before its instance
+	// is looked up
+	StaleNodeGrace time.Duration
+	Health         health.Config
+	// Fleet enables the agentless mode: the operator detects outdated nodes
+	// and cycles them itself. Optional
+	Fleet models.FleetProviderInterface
+	// KubeClient is used instead of building one from KubeConfig, e.g. a fake
+	// clientset in tests. Optional
+	KubeClient kubernetes.Interface
+	// ZoneAware rolls one zone after the other and stops granting while a
+	// zone is degraded
+	ZoneAware bool
+	// EvictionTimeout, DeletionTimeout and ExcludedOwners set how nodes are
+	// drained in agentless mode. The drainer defaults are used when unset
+	EvictionTimeout time.Duration
+	DeletionTimeout time.Duration
+	ExcludedOwners  []string
+	// DryRun computes the node that would be approved next without approving
+	// it, removing stale nodes, cycling nodes in agentless mode, applying an
+	// abort, writing the control configmap or notifying
+	DryRun bool
+	// Now tells the time, defaults to time.Now. Simulations drive a fake clock
+	// through it
+	Now func() time.Time
 }
 
 type Operator struct {
 	kc        kubernetes.Interface
 	nc        v1core.NodeInterface
+	ctl       *control.Control
+	recorder  record.EventRecorder
+	cloud     models.CloudProviderInterface
+	etcd      etcd.Cluster
+	notifier  notify.Notifier
+	checks    []health.Check
 	statePath string
+	poolLabel string
+	status    string
+
+	// masterKey and masterValue select the master nodes
+	masterKey      string
+	masterValue    string
+	order          []string
+	poolOrder      map[string][]string
+	zoneAware      bool
+	pollInterval   time.Duration
+	cycleTimeout   time.Duration
+	failureBudget  int
+	staleNodeGrace time.Duration
+	now            func() time.Time
+	dryRun         bool
+	reload         chan Config
+
+	mu       sync.RWMutex
+	snapshot Status
+
+	// agentless mode
+	fleet     models.FleetProviderInterface
+	drainer   *drain.Drainer
+	workersMu sync.Mutex
+	workers   map[string]bool
+	workersWg sync.WaitGroup
 }
 
 type OperatorInterface interface {
@@ -37,57 +155,206 @@ type OperatorInterface interface {
 	getReadyNodes() ([]v1.Node, error)
 	updateNeeded(nodes []v1.Node) (bool, []v1.Node)
 	nextToUpdate(updateNodes []v1.Node) (v1.Node, error)
+	orderNodes(nodes []v1.Node, order []string) ([]v1.Node, error)
+	setZoneNodeCounts(nodes []v1.Node) error
+	degradedZone(nodes []v1.Node) (string, string, error)
+	activeZone(updateNodes []v1.Node) ([]v1.Node, string, error)
 	updateInProgress(nodes []v1.Node) bool
 	updatePermissionGiven(nodes []v1.Node) bool
-	giveNodeUpdatePermission(nodeName string)
-	Run()
+	giveNodeUpdatePermission(ctx context.Context, nodeName string) error
+	nodeState(n v1.Node) nodestate.State
+	abortRollout(nodes []v1.Node)
+	setStatus(status string)
+	reconcile(ctx context.Context) Decision
+	Reconcile(ctx context.Context) Decision
+	updateSnapshot(rollout string, nodes []v1.Node)
+	startCycle(n v1.Node, etcdMembers int) error
+	trackCycle(ctx context.Context, nodes []v1.Node) (*Cycle, error)
+	checkOperation(ctx context.Context, c *Cycle) error
+	etcdSafe(ctx context.Context, n v1.Node) (bool, string, int, error)
+	etcdRejoined(ctx context.Context, size int) (bool, string, error)
+	notify(e notify.Event)
+	startRollout(updateNodes int) error
+	finishRollout() error
+	cycleFinished(s *State, c *Cycle)
+	cancelCycle(node string) error
+	recordFailure(s *State, c *Cycle)
+	resetFailures() error
+	removeStaleNode(ctx context.Context, nodes []v1.Node) (string, error)
+	recordDecision(d Decision)
+	detectUpdates(ctx context.Context, nodes []v1.Node) error
+	startWorkers(ctx context.Context, nodes []v1.Node)
+	cycleNode(ctx context.Context, n v1.Node, from nodestate.Phase) error
+	terminationFailed(node string, err error) error
+	reportError(node string, err error)
+	resetRecreated(nodes []v1.Node)
+	Run(ctx context.Context)
+	Reload(conf Config)
+	apply(conf Config) error
 }
 
-func New(kubeConfig, statePath string) (*Operator, error) {
+func New(conf Config) (*Operator, error) {
 	// kube client
-	kubeClient, err := k8sutil.GetClient(kubeConfig)
-	if err != nil {
-		return nil, err
+	kubeClient := conf.KubeClient
+	if kubeClient == nil {
+		var err error
+		if kubeClient, err = k8sutil.GetClient(conf.KubeConfig); err != nil {
+			return nil, err
+		}
 	}
 
 	// node interface
 	kubeNodeInterface := kubeClient.CoreV1().Nodes()
 
+	// events
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&v1core.EventSinkImpl{Interface: kubeClient.CoreV1().Events("")})
+	recorder := broadcaster.NewRecorder(scheme.Scheme, v1.EventSource{Component: "kube-node-cycle-operator"})
+
 	operator := &Operator{
 		kc:        kubeClient,
 		nc:        kubeNodeInterface,
-		statePath: statePath,
+		ctl:       control.New(kubeClient, conf.ControlNamespace, conf.ControlName),
+		recorder:  recorder,
+		cloud:     conf.Cloud,
+		etcd:      conf.Etcd,
+		notifier:  conf.Notifier,
+		statePath: conf.StatePath,
+		now:       conf.Now,
+		reload:    make(chan Config, 1),
+
+		fleet:   conf.Fleet,
+		drainer: drain.New(kubeClient),
+		workers: map[string]bool{},
+	}
+	if operator.now == nil {
+		operator.now = time.Now
+	}
+	if conf.EvictionTimeout > 0 {
+		operator.drainer.EvictionTimeout = conf.EvictionTimeout
+	}
+	if conf.DeletionTimeout > 0 {
+		operator.drainer.DeletionTimeout = conf.DeletionTimeout
+	}
+	if conf.ExcludedOwners != nil {
+		operator.drainer.ExcludedOwners = conf.ExcludedOwners
+	}
+	if err := operator.apply(conf); err != nil {
+		return nil, err
 	}
 	return operator, nil
 }
 
-func (op *Operator) getNodeCountFromJson() (int, error) {
+// apply sets the settings that can be reloaded while the operator runs
+func (op *Operator) apply(conf Config) error {
+	// pre-grant health checks, timed with the operator clock
+	healthConf := conf.Health
+	healthConf.Now = op.now
+	checks, err := health.New(op.kc, healthConf)
+	if err != nil {
+		return err
+	}
+
+	if conf.MasterLabel == "" {
+		conf.MasterLabel = defaultMasterLabel
+	}
+	master := strings.SplitN(conf.MasterLabel, "=", 2)
+	if len(master) != 2 {
+		return fmt.Errorf("invalid master label %q, expected key=value", conf.MasterLabel)
+	}
+
+	if len(conf.Order) == 0 {
+		conf.Order = DefaultOrder
+	}
+	if err := ValidateOrder(conf.Order); err != nil {
+		return err
+	}
+	for pool, order := range conf.PoolOrder {
+		if err := ValidateOrder(order); err != nil {
+			return fmt.Errorf("pool %s: %v", pool, err)
+		}
+	}
+
+	op.checks = checks
+	op.order = conf.Order
+	op.poolOrder = conf.PoolOrder
+	op.zoneAware = conf.ZoneAware
+	op.poolLabel = conf.PoolLabel
+	op.masterKey, op.masterValue = master[0], master[1]
+	op.pollInterval = conf.PollInterval
+	op.cycleTimeout = conf.CycleTimeout
+	op.failureBudget = conf.FailureBudget
+	op.staleNodeGrace = conf.StaleNodeGrace
+	op.dryRun = conf.DryRun
+	if op.pollInterval == 0 {
+		op.pollInterval = defaultReconcileInterval
+	}
+	if op.cycleTimeout == 0 {
+		op.cycleTimeout = defaultCycleTimeout
+	}
+	if op.staleNodeGrace == 0 {
+		op.staleNodeGrace = defaultStaleNodeGrace
+	}
+	return nil
+}
+
+// Reload replaces the reloadable settings of a running operator. They are
+// applied between two reconciles.
+func (op *Operator) Reload(conf Config) {
+	select {
+	case <-op.reload:
+		// superseded
+	default:
+	}
+	op.reload <- conf
+}
+
+// loadState reads the state file
+func (op *Operator) loadState() (*State, error) {
 	raw, err := ioutil.ReadFile(op.statePath)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
 	s := &State{}
 	if err := json.Unmarshal(raw, s); err != nil {
-		return 0, err
+		return nil, err
 	}
-	return s.NodeCount, nil
+	return s, nil
 }
 
-func (op *Operator) setNodeCountToJson(count int) error {
-	s := &State{
-		NodeCount: count,
-	}
-
+// saveState writes the state file. It is written aside and renamed so that
+// the operator being killed mid-write never leaves a truncated file behind.
+func (op *Operator) saveState(s *State) error {
 	raw, err := json.Marshal(s)
 	if err != nil {
 		return err
 	}
 
-	if err = ioutil.WriteFile(op.statePath, raw, 0644); err != nil {
+	tmp := op.statePath + ".tmp"
+	if err = ioutil.WriteFile(tmp, raw, 0644); err != nil {
 		return err
 	}
-	return nil
+	return os.Rename(tmp, op.statePath)
+}
+
+func (op *Operator) getNodeCountFromJson() (int, error) {
+	s, err := op.loadState()
+	if err != nil {
+		return 0, err
+	}
+	return s.NodeCount, nil
+}
+
+func (op *Operator) setNodeCountToJson(count int) error {
+	s, err := op.loadState()
+	if os.IsNotExist(err) {
+		s = &State{}
+	} else if err != nil {
+		return err
+	}
+	s.NodeCount = count
+	return op.saveState(s)
 }
 
 func (op *Operator) getNodes() ([]v1.Node, error) {
@@ -106,141 +373,355 @@ func (op *Operator) getReadyNodes() ([]v1.Node, error) {
 
 	readyNodes := []v1.Node{}
 	for _, n := range nodes {
-		for _, c := range n.Status.Conditions {
-			if c.Type == v1.NodeReady {
-				if c.Status == v1.ConditionTrue {
-					readyNodes = append(readyNodes, n)
-				}
-				break
-			}
+		if isReady(n) {
+			readyNodes = append(readyNodes, n)
 		}
 	}
 	return readyNodes, nil
 }
 
+// nodeState reads the cycle state of a node. Nodes with an unreadable state are
+// reported as Failed so that they are neither granted nor block others.
+func (op *Operator) nodeState(n v1.Node) nodestate.State {
+	st, err := nodestate.FromNode(n)
+	if err != nil {
+		log.Println(fmt.Sprintf("[ERROR] node %s: %v", n.Name, err))
+		return nodestate.State{Phase: nodestate.Failed, Error: err.Error()}
+	}
+	return st
+}
+
 func (op *Operator) updateNeeded(nodes []v1.Node) (updateNeeded bool, updateNodes []v1.Node) {
 	for _, n := range nodes {
-		if _, ok := n.Annotations[annotations.UpdateNeeded]; !ok {
-			log.Println(fmt.Sprintf("[INFO] node %s has no annotation %s", n.Name, annotations.UpdateNeeded))
-		} else {
-			if n.Annotations[annotations.UpdateNeeded] == annotations.AnnoTrue {
-				updateNeeded = true
-				updateNodes = append(updateNodes, n)
-			}
+		if n.Annotations[annotations.Skip] == annotations.AnnoTrue {
+			log.Println("[INFO] skipping node:", n.Name)
+			continue
+		}
+		if op.nodeState(n).Phase == nodestate.UpdateNeeded {
+			updateNeeded = true
+			updateNodes = append(updateNodes, n)
 		}
 	}
 	return updateNeeded, updateNodes
 }
 
-// nextToUpdate: gets a list of nodes and searches for `role=master` label. It returns the first `master`
-// it may find or else the first node in the list
-// errors on empty input list.
-func (op *Operator) nextToUpdate(updateNodes []v1.Node) (v1.Node, error) {
-
-	if len(updateNodes) <= 0 {
-		return v1.Node{}, errors.New("Empty list passed to nextToUpdate function")
-	}
-	for _, n := range updateNodes {
-		if _, ok := n.Labels["role"]; !ok {
-			log.Println("[WARN] node without role label:", n.Name)
-		} else {
-			if n.Labels["role"] == "master" {
-				log.Println("[INFO] found master node that needs updating: ", n.Name)
-				return n, nil
-			}
+func (op *Operator) updateInProgress(nodes []v1.Node) bool {
+	for _, n := range nodes {
+		if op.nodeState(n).InProgress() {
+			return true
 		}
 	}
-	log.Println("[INFO] next node to update:", updateNodes[0].Name)
-	return updateNodes[0], nil
+	return false
 }
 
-func (op *Operator) updateInProgress(nodes []v1.Node) bool {
+func (op *Operator) updatePermissionGiven(nodes []v1.Node) bool {
 	for _, n := range nodes {
-		if _, ok := n.Annotations[annotations.UpdateInProgress]; !ok {
-			log.Println(fmt.Sprintf("[INFO] node %s has no annotation %s", n.Name, annotations.UpdateInProgress))
-		} else {
-			if n.Annotations[annotations.UpdateInProgress] == annotations.AnnoTrue {
-				return true
-			}
+		if op.nodeState(n).Phase == nodestate.Approved {
+			return true
 		}
 	}
 	return false
 }
 
-func (op *Operator) updatePermissionGiven(nodes []v1.Node) bool {
+// giveNodeUpdatePermission approves a node, retrying until written or ctx is
+// cancelled. Invalid transitions, e.g. the node state changed meanwhile, are
+// not retried.
+func (op *Operator) giveNodeUpdatePermission(ctx context.Context, nodeName string) error {
+	var terr error
+	err := wait.PollImmediateUntil(defaultPollInterval, func() (bool, error) {
+		_, err := nodestate.Update(op.nc, nodeName, func(s *nodestate.State) error {
+			terr = s.Transition(nodestate.Approved, "permission given by operator")
+			return terr
+		})
+		if terr != nil {
+			return true, nil
+		}
+		return err == nil, nil
+	}, ctx.Done())
+	if terr != nil {
+		return terr
+	}
+	if err != nil {
+		return ctx.Err()
+	}
+	return nil
+}
+
+// abortRollout revokes termination permission from every node that has not
+// started updating yet. Nodes already in progress and forced terminations are
+// left to finish.
+func (op *Operator) abortRollout(nodes []v1.Node) {
 	for _, n := range nodes {
-		if _, ok := n.Annotations[annotations.CanStartTermination]; !ok {
-			log.Println(fmt.Sprintf("[INFO] node %s has no annotation %s", n.Name, annotations.CanStartTermination))
-		} else {
-			if n.Annotations[annotations.CanStartTermination] == annotations.AnnoTrue {
-				return true
-			}
+		st := op.nodeState(n)
+		if st.InProgress() {
+			log.Println("[INFO] abort: leaving in progress node to finish:", n.Name)
+			continue
+		}
+		if st.Phase != nodestate.Approved || st.Forced {
+			continue
+		}
+		if op.dryRun {
+			log.Println("[INFO] dry run: abort would revoke termination permission from node:", n.Name)
+			continue
+		}
+		log.Println("[INFO] abort: revoking termination permission from node:", n.Name)
+		if _, err := nodestate.Transition(op.nc, n.Name, nodestate.UpdateNeeded, "permission revoked by abort"); err != nil {
+			log.Println("[ERROR] abort: failed to revoke permission:", err)
+			continue
+		}
+		if err := op.cancelCycle(n.Name); err != nil {
+			log.Println("[ERROR] abort: failed to cancel cycle:", err)
 		}
 	}
-	return false
 }
 
-func (op *Operator) giveNodeUpdatePermission(nodeName string) {
-	anno := map[string]string{
-		annotations.CanStartTermination: annotations.AnnoTrue,
+// setStatus reflects the rollout status in the control configmap when it
+// changes. A dry run only keeps track of it.
+func (op *Operator) setStatus(status string) {
+	if op.status == status {
+		return
+	}
+	if op.dryRun {
+		op.status = status
+		return
 	}
+	if err := op.ctl.SetStatus(status); err != nil {
+		log.Println("[ERROR] failed to set rollout status:", err)
+		return
+	}
+	op.status = status
+}
 
-	wait.PollUntil(defaultPollInterval, func() (bool, error) {
-		if err := k8sutil.SetNodeAnnotations(op.nc, nodeName, anno); err != nil {
-			return false, nil
+// Run reconciles every poll interval, 30 seconds by default, until ctx is
+// cancelled. A pass in progress is always let to finish so that node states
+// and the state file are left consistent.
+func (op *Operator) Run(ctx context.Context) {
+	ticker := time.NewTicker(op.pollInterval)
+	defer func() { ticker.Stop() }()
+
+	for {
+		op.Reconcile(ctx)
+
+		select {
+		case <-ctx.Done():
+			// Let agentless cycles leave their node state consistent
+			op.workersWg.Wait()
+			log.Println("[INFO] operator stopped")
+			return
+		case conf := <-op.reload:
+			if err := op.apply(conf); err != nil {
+				log.Println("[ERROR] failed to apply reloaded configuration:", err)
+				continue
+			}
+			log.Println("[INFO] applied reloaded configuration")
+			ticker.Stop()
+			ticker = time.NewTicker(op.pollInterval)
+		case <-ticker.C:
 		}
-		return true, nil
-	}, wait.NeverStop)
+	}
+}
+
+// Reconcile runs a single pass of the operator loop and records the decision
+// taken, as Run does every 30 seconds
+func (op *Operator) Reconcile(ctx context.Context) Decision {
+	d := op.reconcile(ctx)
+	op.recordDecision(d)
+	return d
 }
 
-func (op *Operator) Run() {
-	for t := time.Tick(30 * time.Second); ; <-t {
+// reconcile runs a single pass of the operator loop and returns the decision taken
+func (op *Operator) reconcile(ctx context.Context) Decision {
+	rollout, err := op.ctl.Rollout()
+	if err != nil {
+		log.Println("[ERROR] error getting rollout mode:", err)
+		return blockedDecision(ReasonError, "error getting rollout mode: %v", err)
+	}
 
+	// Abort: revoke pending permissions and stay paused until resumed
+	if rollout == control.RolloutAbort {
 		allNodes, err := op.getNodes()
 		if err != nil {
 			log.Println("[ERROR] error getting nodes:", err)
-			continue
+			return blockedDecision(ReasonError, "error getting nodes: %v", err)
 		}
-
-		nodes, err := op.getReadyNodes()
-		if err != nil {
-			log.Println("[ERROR] error getting nodes:", err)
-			continue
+		op.abortRollout(allNodes)
+		if op.dryRun {
+			log.Println("[INFO] dry run: would pause the rollout after abort")
+			return waitDecision(ReasonAborted, "rollout aborted")
 		}
+		if err := op.ctl.SetRollout(control.RolloutPaused); err != nil {
+			log.Println("[ERROR] failed to pause rollout after abort:", err)
+			return blockedDecision(ReasonError, "failed to pause rollout after abort: %v", err)
+		}
+		op.setStatus(control.StatusAborted)
+		return waitDecision(ReasonAborted, "rollout aborted")
+	}
+	if rollout == control.RolloutRunning {
+		op.setStatus(control.StatusRunning)
+	} else if op.status != control.StatusAborted {
+		op.setStatus(control.StatusPaused)
+	}
 
-		// Check for Not Ready Nodes
-		if len(allNodes) > len(nodes) {
-			log.Println("[INFO] Not Ready nodes found, waiting..")
-			continue
+	allNodes, err := op.getNodes()
+	if err != nil {
+		log.Println("[ERROR] error getting nodes:", err)
+		return blockedDecision(ReasonError, "error getting nodes: %v", err)
+	}
+
+	// Agentless mode: detect outdated nodes and cycle approved ones
+	if op.fleet != nil {
+		op.resetRecreated(allNodes)
+		if err := op.detectUpdates(ctx, allNodes); err != nil {
+			log.Println("[ERROR] error detecting updates:", err)
+			return blockedDecision(ReasonError, "error detecting updates: %v", err)
 		}
+		if !op.dryRun {
+			op.startWorkers(ctx, allNodes)
+		}
+	}
 
-		// If no update is needed just update the node count with the current number and continue
-		updateNeeded, updateNodes := op.updateNeeded(nodes)
-		if !updateNeeded {
-			log.Println("[INFO] no updated needed, updating node count to:", len(nodes))
-			op.setNodeCountToJson(len(nodes))
-			continue
+	// Follow the node being cycled until its replacement is healthy
+	cycle, err := op.trackCycle(ctx, allNodes)
+	if err != nil {
+		log.Println("[ERROR] error tracking cycle:", err)
+		return blockedDecision(ReasonError, "error tracking cycle: %v", err)
+	}
+	op.updateSnapshot(rollout, allNodes)
+
+	nodes, err := op.getReadyNodes()
+	if err != nil {
+		log.Println("[ERROR] error getting nodes:", err)
+		return blockedDecision(ReasonError, "error getting nodes: %v", err)
+	}
+
+	// Check for Not Ready Nodes
+	if len(allNodes) > len(nodes) {
+		// Nodes left behind by recreated instances would block us forever
+		removed, err := op.removeStaleNode(ctx, allNodes)
+		if err != nil {
+			log.Println("[ERROR] error removing stale nodes:", err)
+			return blockedDecision(ReasonError, "error removing stale nodes: %v", err)
 		}
+		if removed != "" {
+			return waitDecision(ReasonStaleNodeRemoved, "removed stale node %s", removed)
+		}
+		return blockedDecision(ReasonNotReadyNodes, "%d not ready nodes found", len(allNodes)-len(nodes))
+	}
 
-		// Update needed.
-		// If update is in progress or permission already given just wait
-		if op.updateInProgress(nodes) || op.updatePermissionGiven(nodes) {
-			log.Println("[INFO] updating in progress")
-			continue
+	// If no update is needed just update the node count with the current number and continue
+	updateNeeded, updateNodes := op.updateNeeded(nodes)
+	if !updateNeeded {
+		op.setNodeCountToJson(len(nodes))
+		if err := op.setZoneNodeCounts(nodes); err != nil {
+			log.Println("[ERROR] failed to set zone node counts:", err)
+		}
+		if err := op.resetFailures(); err != nil {
+			log.Println("[ERROR] failed to reset failure counts:", err)
+		}
+		// The rollout is over once the last cycle is
+		if cycle == nil {
+			if err := op.finishRollout(); err != nil {
+				log.Println("[ERROR] failed to record the end of the rollout:", err)
+			}
 		}
+		return waitDecision(ReasonNoUpdateNeeded, "no update needed, node count set to %d", len(nodes))
+	}
+
+	// Update needed.
+	if err := op.startRollout(len(updateNodes)); err != nil {
+		log.Println("[ERROR] failed to record the start of the rollout:", err)
+	}
+
+	// If update is in progress or permission already given just wait
+	if op.updateInProgress(nodes) || op.updatePermissionGiven(nodes) {
+		return waitDecision(ReasonUpdateInProgress, "update in progress")
+	}
+	if cycle != nil {
+		return waitDecision(ReasonCycleInProgress, "cycle of node %s is %s", cycle.Node, cycle.Phase)
+	}
+
+	// Check the pause switch before every grant
+	if rollout == control.RolloutPaused {
+		return waitDecision(ReasonPaused, "rollout paused, not granting permissions")
+	}
+
+	// Pools that exhausted their failure budget wait for a manual resume
+	halted, err := op.ctl.HaltedPools()
+	if err != nil {
+		log.Println("[ERROR] error getting halted pools:", err)
+		return blockedDecision(ReasonError, "error getting halted pools: %v", err)
+	}
+	updateNodes = op.excludeHalted(updateNodes, halted)
+	if len(updateNodes) == 0 {
+		return blockedDecision(ReasonHalted, "pools halted: %s", strings.Join(halted, ","))
+	}
+
+	nodeCount, err := op.getNodeCountFromJson()
+	if err != nil {
+		log.Fatal("Failed to get node count, exiting")
+	}
+
+	// Only give permission to start updating if we have enough nodes
+	if len(nodes) < nodeCount {
+		return blockedDecision(ReasonBelowNodeCount, "%d ready nodes, waiting for %d", len(nodes), nodeCount)
+	}
 
-		nodeCount, err := op.getNodeCountFromJson()
+	// Roll one zone at a time, never on top of a degraded zone
+	if op.zoneAware {
+		zone, reason, err := op.degradedZone(nodes)
 		if err != nil {
-			log.Fatal("Failed to get node count, exiting")
+			log.Println("[ERROR] error checking zones:", err)
+			return blockedDecision(ReasonError, "error checking zones: %v", err)
+		}
+		if zone != "" {
+			return blockedDecision(ReasonZoneDegraded, "zone %q degraded: %s", zone, reason)
+		}
+		if updateNodes, _, err = op.activeZone(updateNodes); err != nil {
+			log.Println("[ERROR] error selecting zone:", err)
+			return blockedDecision(ReasonError, "error selecting zone: %v", err)
 		}
+	}
 
-		// If we have enough nodes give permission to start updating
-		if len(nodes) >= nodeCount {
-			n, err := op.nextToUpdate(updateNodes)
-			if err != nil {
-				log.Println("[ERROR] error while searching for next node to update:", err)
-			}
-			op.giveNodeUpdatePermission(n.Name)
+	// Do not cycle the next node while the cluster is still recovering
+	healthy, reason, err := health.Run(op.checks)
+	if err != nil {
+		log.Println("[ERROR] error running health checks:", err)
+		return blockedDecision(ReasonError, "error running health checks: %v", err)
+	}
+	if !healthy {
+		return blockedDecision(ReasonUnhealthy, "%s", reason)
+	}
+
+	n, err := op.nextToUpdate(updateNodes)
+	if err != nil {
+		log.Println("[ERROR] error while searching for next node to update:", err)
+		return blockedDecision(ReasonError, "error while searching for next node to update: %v", err)
+	}
+
+	// Masters run etcd, which must keep its quorum while one of them is down
+	etcdMembers := 0
+	if op.etcd != nil && op.isMaster(n) {
+		safe, reason, members, err := op.etcdSafe(ctx, n)
+		if err != nil {
+			log.Println("[ERROR] error checking etcd members:", err)
+			return blockedDecision(ReasonError, "error checking etcd members: %v", err)
 		}
+		if !safe {
+			return blockedDecision(ReasonEtcdQuorum, "cycling master %s would lose etcd quorum: %s", n.Name, reason)
+		}
+		etcdMembers = members
+	}
+
+	if op.dryRun {
+		log.Println("[INFO] dry run: would give permission to node", n.Name)
+		return dryRunDecision(n.Name)
+	}
+	if err := op.giveNodeUpdatePermission(ctx, n.Name); err != nil {
+		log.Println("[ERROR] failed to give permission:", err)
+		return blockedDecision(ReasonError, "failed to give permission to node %s: %v", n.Name, err)
+	}
+	if err := op.startCycle(n, etcdMembers); err != nil {
+		log.Println("[ERROR] failed to start tracking cycle:", err)
 	}
+	return grantDecision(n.Name)
 }
@@ -0,0 +1,218 @@
+package operator
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/control"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+type testClock struct {
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	return c.now
+}
+
+// newTestCluster returns an operator over a fake cluster holding objects, with
+// a clock starting at epoch and the given state. Callers remove the state
+// directory.
+func newTestCluster(t *testing.T, conf Config, s State, objects ...runtime.Object) (*Operator, *fake.Clientset, *testClock) {
+	dir, err := ioutil.TempDir("", "operator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf.StatePath = filepath.Join(dir, "state.json")
+	if err := ioutil.WriteFile(conf.StatePath, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	kc := fake.NewSimpleClientset(objects...)
+	clock := &testClock{now: epoch}
+	conf.KubeClient = kc
+	conf.Now = clock.Now
+	if conf.PoolLabel == "" {
+		conf.PoolLabel = "role"
+	}
+	op, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return op, kc, clock
+}
+
+// clusterNode returns a Ready worker node in phase
+func clusterNode(t *testing.T, name string, phase nodestate.Phase) *v1.Node {
+	st := nodestate.New()
+	st.Phase = phase
+	raw, err := st.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &v1.Node{
+		ObjectMeta: v1meta.ObjectMeta{
+			Name:              name,
+			UID:               types.UID(name + "-uid"),
+			Labels:            map[string]string{"role": "worker"},
+			Annotations:       map[string]string{annotations.State: raw},
+			CreationTimestamp: v1meta.NewTime(epoch.Add(-time.Hour)),
+		},
+		Spec: v1.NodeSpec{ProviderID: "fake://" + name},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}},
+			NodeInfo:   v1.NodeSystemInfo{BootID: name + "-boot"},
+		},
+	}
+}
+
+func controlMap(rollout string) *v1.ConfigMap {
+	return &v1.ConfigMap{
+		ObjectMeta: v1meta.ObjectMeta{Name: control.DefaultName, Namespace: control.DefaultNamespace},
+		Data:       map[string]string{control.RolloutKey: rollout},
+	}
+}
+
+func phaseOf(t *testing.T, kc *fake.Clientset, node string) nodestate.Phase {
+	st, err := nodestate.Get(kc.CoreV1().Nodes(), node)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return st.Phase
+}
+
+func expectDecision(t *testing.T, d Decision, typ DecisionType, reason Reason) {
+	if d.Type != typ || d.Reason != reason {
+		t.Errorf("expected %s (%s), got %s", typ, reason, d)
+	}
+}
+
+func testConf() Config {
+	return Config{ControlNamespace: control.DefaultNamespace, ControlName: control.DefaultName}
+}
+
+func TestPauseAndResume(t *testing.T) {
+	op, kc, _ := newTestCluster(t, testConf(), State{},
+		controlMap(control.RolloutPaused), clusterNode(t, "node-a", nodestate.UpdateNeeded))
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+
+	expectDecision(t, op.Reconcile(context.Background()), DecisionWait, ReasonPaused)
+	if p := phaseOf(t, kc, "node-a"); p != nodestate.UpdateNeeded {
+		t.Errorf("expected no permission while paused, got %s", p)
+	}
+	if status, _ := op.ctl.Status(); status != control.StatusPaused {
+		t.Errorf("expected the paused status to be reported, got %q", status)
+	}
+
+	if err := op.ctl.SetRollout(control.RolloutRunning); err != nil {
+		t.Fatal(err)
+	}
+	expectDecision(t, op.Reconcile(context.Background()), DecisionGrant, ReasonGranted)
+	if p := phaseOf(t, kc, "node-a"); p != nodestate.Approved {
+		t.Errorf("expected permission once resumed, got %s", p)
+	}
+}
+
+func TestDryRunAbort(t *testing.T) {
+	conf := testConf()
+	conf.DryRun = true
+	op, kc, _ := newTestCluster(t, conf, State{},
+		controlMap(control.RolloutAbort), clusterNode(t, "node-a", nodestate.Approved))
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+	kc.ClearActions()
+
+	expectDecision(t, op.Reconcile(context.Background()), DecisionWait, ReasonAborted)
+	for _, a := range kc.Actions() {
+		if a.GetVerb() != "get" && a.GetVerb() != "list" {
+			t.Errorf("expected a dry run to leave the cluster alone, got %s %s", a.GetVerb(), a.GetResource().Resource)
+		}
+	}
+	if p := phaseOf(t, kc, "node-a"); p != nodestate.Approved {
+		t.Errorf("expected the permission of node-a to be kept, got %s", p)
+	}
+}
+
+func TestZoneBaselineMidRollout(t *testing.T) {
+	conf := testConf()
+	conf.ZoneAware = true
+	a := clusterNode(t, "node-a", nodestate.UpdateNeeded)
+	a.Labels[LabelZone] = "zone-a"
+	b := clusterNode(t, "node-b", nodestate.Idle)
+	b.Labels[LabelZone] = "zone-b"
+	// Zone awareness was turned on after the node count was recorded
+	op, _, _ := newTestCluster(t, conf, State{NodeCount: 2}, a, b)
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+
+	expectDecision(t, op.Reconcile(context.Background()), DecisionGrant, ReasonGranted)
+	s, err := op.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.ZoneNodeCounts) != 2 || s.ZoneNodeCounts["zone-a"] != 1 || s.ZoneNodeCounts["zone-b"] != 1 {
+		t.Errorf("expected the zone baseline to be recorded, got %v", s.ZoneNodeCounts)
+	}
+}
+
+func TestAbortRevokesGrant(t *testing.T) {
+	op, kc, _ := newTestCluster(t, testConf(), State{},
+		clusterNode(t, "node-a", nodestate.UpdateNeeded), clusterNode(t, "node-b", nodestate.Draining))
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+
+	// node-b is draining so node-a is held back, grant it by hand
+	if err := op.giveNodeUpdatePermission(context.Background(), "node-a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := op.startCycle(*clusterNode(t, "node-a", nodestate.Approved), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := op.ctl.SetRollout(control.RolloutAbort); err != nil {
+		t.Fatal(err)
+	}
+	expectDecision(t, op.Reconcile(context.Background()), DecisionWait, ReasonAborted)
+
+	if p := phaseOf(t, kc, "node-a"); p != nodestate.UpdateNeeded {
+		t.Errorf("expected the permission of node-a to be revoked, got %s", p)
+	}
+	if p := phaseOf(t, kc, "node-b"); p != nodestate.Draining {
+		t.Errorf("expected node-b to be left draining, got %s", p)
+	}
+	if rollout, _ := op.ctl.Rollout(); rollout != control.RolloutPaused {
+		t.Errorf("expected the rollout to stay paused after abort, got %s", rollout)
+	}
+	if status, _ := op.ctl.Status(); status != control.StatusAborted {
+		t.Errorf("expected the aborted status to be reported, got %q", status)
+	}
+	s, err := op.loadState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Cycle != nil || s.LastCycle == nil || s.LastCycle.Phase != CycleCancelled {
+		t.Errorf("expected the cycle of node-a to be cancelled, got %+v", s.LastCycle)
+	}
+
+	// Nothing is granted until resumed
+	if d := op.Reconcile(context.Background()); d.Type == DecisionGrant {
+		t.Errorf("expected no grant after abort, got %s", d)
+	}
+	if status, _ := op.ctl.Status(); status != control.StatusAborted {
+		t.Errorf("expected the aborted status to stick until resumed, got %q", status)
+	}
+}
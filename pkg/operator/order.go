@@ -0,0 +1,298 @@
+package operator
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+)
+
+// Strategies ordering the nodes that need updating. A list of strategies is
+// applied in turn, later ones breaking the ties of earlier ones.
+const (
+	OrderMastersFirst = "masters-first"
+	OrderMastersLast  = "masters-last"
+	// OrderOldest cycles the nodes created first first
+	OrderOldest = "oldest"
+	// OrderFewestPods cycles the nodes running the fewest pods first
+	OrderFewestPods = "fewest-pods"
+	// OrderZoneRoundRobin cycles a node of the next zone after the zone of
+	// the last cycled node, spreading disruption across zones
+	OrderZoneRoundRobin = "zone-round-robin"
+	// OrderLeastUtilized cycles the nodes with the lowest share of their
+	// allocatable cpu or memory requested by pods first
+	OrderLeastUtilized = "least-utilized"
+	// OrderPriority cycles the nodes with the highest annotations.Priority
+	// first. Nodes without one have priority 0
+	OrderPriority = "priority"
+)
+
+// DefaultOrder picks masters first, then follows the order nodes are listed in
+var DefaultOrder = []string{OrderMastersFirst}
+
+// Zone labels, the deprecated one is read when the current one is missing
+const (
+	LabelZone           = "topology.kubernetes.io/zone"
+	LabelZoneDeprecated = "failure-domain.beta.kubernetes.io/zone"
+)
+
+// zoneOf returns the zone of a node, empty when unknown
+func zoneOf(n v1.Node) string {
+	if z := n.Labels[LabelZone]; z != "" {
+		return z
+	}
+	return n.Labels[LabelZoneDeprecated]
+}
+
+// ValidateOrder checks that every strategy of order is known
+func ValidateOrder(order []string) error {
+	for _, o := range order {
+		switch o {
+		case OrderMastersFirst, OrderMastersLast, OrderOldest, OrderFewestPods,
+			OrderZoneRoundRobin, OrderLeastUtilized, OrderPriority:
+		default:
+			return fmt.Errorf("unknown order %q", o)
+		}
+	}
+	return nil
+}
+
+// compareFunc returns a negative number when a should be cycled before b, a
+// positive one when after and 0 when it makes no difference
+type compareFunc func(a, b v1.Node) int
+
+// orderNodes returns nodes sorted by the strategies of order. List order is
+// kept between nodes the strategies do not tell apart.
+func (op *Operator) orderNodes(nodes []v1.Node, order []string) ([]v1.Node, error) {
+	cmps := []compareFunc{}
+	for _, o := range order {
+		cmp, err := op.comparator(o, nodes)
+		if err != nil {
+			return nil, err
+		}
+		cmps = append(cmps, cmp)
+	}
+
+	sorted := append([]v1.Node{}, nodes...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		for _, cmp := range cmps {
+			if c := cmp(sorted[i], sorted[j]); c != 0 {
+				return c < 0
+			}
+		}
+		return false
+	})
+	return sorted, nil
+}
+
+// comparator returns the comparison of a strategy, looking up what it needs
+// about nodes
+func (op *Operator) comparator(order string, nodes []v1.Node) (compareFunc, error) {
+	switch order {
+	case OrderMastersFirst, OrderMastersLast:
+		sign := 1
+		if order == OrderMastersLast {
+			sign = -1
+		}
+		return func(a, b v1.Node) int {
+			return sign * (boolRank(op.isMaster(b)) - boolRank(op.isMaster(a)))
+		}, nil
+	case OrderOldest:
+		return func(a, b v1.Node) int {
+			switch {
+			case a.CreationTimestamp.Before(&b.CreationTimestamp):
+				return -1
+			case b.CreationTimestamp.Before(&a.CreationTimestamp):
+				return 1
+			}
+			return 0
+		}, nil
+	case OrderPriority:
+		return func(a, b v1.Node) int {
+			return priorityOf(b) - priorityOf(a)
+		}, nil
+	case OrderFewestPods:
+		pods, err := op.podsByNode()
+		if err != nil {
+			return nil, err
+		}
+		return func(a, b v1.Node) int {
+			return len(pods[a.Name]) - len(pods[b.Name])
+		}, nil
+	case OrderLeastUtilized:
+		pods, err := op.podsByNode()
+		if err != nil {
+			return nil, err
+		}
+		util := map[string]float64{}
+		for _, n := range nodes {
+			util[n.Name] = utilization(n, pods[n.Name])
+		}
+		return func(a, b v1.Node) int {
+			switch {
+			case util[a.Name] < util[b.Name]:
+				return -1
+			case util[a.Name] > util[b.Name]:
+				return 1
+			}
+			return 0
+		}, nil
+	case OrderZoneRoundRobin:
+		rank, err := op.zoneRanks(nodes)
+		if err != nil {
+			return nil, err
+		}
+		return func(a, b v1.Node) int {
+			return rank[zoneOf(a)] - rank[zoneOf(b)]
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown order %q", order)
+}
+
+func (op *Operator) isMaster(n v1.Node) bool {
+	v, ok := n.Labels[op.masterKey]
+	return ok && v == op.masterValue
+}
+
+func boolRank(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// priorityOf reads the priority annotation of a node, 0 when unset or invalid
+func priorityOf(n v1.Node) int {
+	v, ok := n.Annotations[annotations.Priority]
+	if !ok {
+		return 0
+	}
+	p, err := strconv.Atoi(v)
+	if err != nil {
+		log.Println(fmt.Sprintf("[WARN] invalid priority %q on node %s, using 0", v, n.Name))
+		return 0
+	}
+	return p
+}
+
+// podsByNode lists the running pods of the cluster by node name
+func (op *Operator) podsByNode() (map[string][]v1.Pod, error) {
+	podList, err := op.kc.CoreV1().Pods(v1.NamespaceAll).List(v1meta.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	pods := map[string][]v1.Pod{}
+	for _, p := range podList.Items {
+		if p.Spec.NodeName == "" || p.Status.Phase == v1.PodSucceeded || p.Status.Phase == v1.PodFailed {
+			continue
+		}
+		pods[p.Spec.NodeName] = append(pods[p.Spec.NodeName], p)
+	}
+	return pods, nil
+}
+
+// utilization returns the highest share of the allocatable cpu and memory of
+// a node requested by its pods
+func utilization(n v1.Node, pods []v1.Pod) float64 {
+	max := 0.0
+	for _, r := range []v1.ResourceName{v1.ResourceCPU, v1.ResourceMemory} {
+		allocatable, ok := n.Status.Allocatable[r]
+		if !ok || allocatable.IsZero() {
+			continue
+		}
+		var requested int64
+		for _, p := range pods {
+			for _, c := range p.Spec.Containers {
+				if q, ok := c.Resources.Requests[r]; ok {
+					requested += q.MilliValue()
+				}
+			}
+		}
+		if u := float64(requested) / float64(allocatable.MilliValue()); u > max {
+			max = u
+		}
+	}
+	return max
+}
+
+// zoneRanks ranks the zones of nodes starting from the one following the zone
+// of the last cycled node
+func (op *Operator) zoneRanks(nodes []v1.Node) (map[string]int, error) {
+	last := ""
+	s, err := op.loadState()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if s != nil && s.LastCycle != nil {
+		last = s.LastCycle.Zone
+	}
+
+	zones := []string{}
+	for _, n := range nodes {
+		zones = append(zones, zoneOf(n))
+	}
+	zones = sortedUnique(zones)
+
+	start := 0
+	for i, z := range zones {
+		if z > last {
+			start = i
+			break
+		}
+	}
+	rank := map[string]int{}
+	for i, z := range zones {
+		rank[z] = (i - start + len(zones)) % len(zones)
+	}
+	return rank, nil
+}
+
+// nextToUpdate returns the node to cycle next. The operator order picks the
+// pool of the node, the order of that pool, if set, picks the node within it.
+// It errors on an empty input list.
+func (op *Operator) nextToUpdate(updateNodes []v1.Node) (v1.Node, error) {
+	if len(updateNodes) <= 0 {
+		return v1.Node{}, errors.New("Empty list passed to nextToUpdate function")
+	}
+
+	sorted, err := op.orderNodes(updateNodes, op.order)
+	if err != nil {
+		return v1.Node{}, err
+	}
+	pool := op.poolOf(sorted[0])
+	if order, ok := op.poolOrder[pool]; ok {
+		candidates := []v1.Node{}
+		for _, n := range sorted {
+			if op.poolOf(n) == pool {
+				candidates = append(candidates, n)
+			}
+		}
+		if sorted, err = op.orderNodes(candidates, order); err != nil {
+			return v1.Node{}, err
+		}
+	}
+
+	log.Println(fmt.Sprintf("[INFO] next node to update: %s (pool %s)", sorted[0].Name, pool))
+	return sorted[0], nil
+}
+
+// sortedUnique returns the distinct values of s in order
+func sortedUnique(s []string) []string {
+	seen := map[string]bool{}
+	res := []string{}
+	for _, v := range s {
+		if !seen[v] {
+			seen[v] = true
+			res = append(res, v)
+		}
+	}
+	sort.Strings(res)
+	return res
+}
@@ -0,0 +1,167 @@
+package operator
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+)
+
+var epoch = time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func testNode(name string, age int, labels map[string]string) v1.Node {
+	return v1.Node{
+		ObjectMeta: v1meta.ObjectMeta{
+			Name:              name,
+			Labels:            labels,
+			Annotations:       map[string]string{},
+			CreationTimestamp: v1meta.NewTime(epoch.Add(-time.Duration(age) * time.Hour)),
+		},
+		Status: v1.NodeStatus{
+			Allocatable: v1.ResourceList{
+				v1.ResourceCPU:    resource.MustParse("4"),
+				v1.ResourceMemory: resource.MustParse("16Gi"),
+			},
+		},
+	}
+}
+
+func testPod(name, node, cpu string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: v1meta.ObjectMeta{Name: name, Namespace: "default"},
+		Spec: v1.PodSpec{
+			NodeName: node,
+			Containers: []v1.Container{{
+				Name: "main",
+				Resources: v1.ResourceRequirements{
+					Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse(cpu)},
+				},
+			}},
+		},
+	}
+}
+
+// orderConf returns the configuration of an operator ordering nodes by order,
+// and by poolOrder in the pools listed
+func orderConf(order []string, poolOrder map[string][]string) Config {
+	conf := testConf()
+	conf.Order = order
+	conf.PoolOrder = poolOrder
+	return conf
+}
+
+func names(nodes []v1.Node) []string {
+	res := []string{}
+	for _, n := range nodes {
+		res = append(res, n.Name)
+	}
+	return res
+}
+
+func expectOrder(t *testing.T, op *Operator, nodes []v1.Node, order []string, expected ...string) {
+	sorted, err := op.orderNodes(nodes, order)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got := names(sorted); !reflect.DeepEqual(got, expected) {
+		t.Errorf("order %v: expected %v, got %v", order, expected, got)
+	}
+}
+
+func TestOrderMastersAndAge(t *testing.T) {
+	op, _, _ := newTestCluster(t, testConf(), State{})
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+	nodes := []v1.Node{
+		testNode("worker-1", 1, map[string]string{"role": "worker"}),
+		testNode("master-1", 2, map[string]string{"role": "master"}),
+		testNode("worker-2", 3, map[string]string{"role": "worker"}),
+	}
+
+	expectOrder(t, op, nodes, []string{OrderMastersFirst}, "master-1", "worker-1", "worker-2")
+	expectOrder(t, op, nodes, []string{OrderMastersLast}, "worker-1", "worker-2", "master-1")
+	expectOrder(t, op, nodes, []string{OrderOldest}, "worker-2", "master-1", "worker-1")
+	expectOrder(t, op, nodes, []string{OrderMastersLast, OrderOldest}, "worker-2", "worker-1", "master-1")
+}
+
+func TestOrderPriority(t *testing.T) {
+	op, _, _ := newTestCluster(t, testConf(), State{})
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+	nodes := []v1.Node{
+		testNode("node-1", 1, nil),
+		testNode("node-2", 2, nil),
+		testNode("node-3", 3, nil),
+	}
+	nodes[0].Annotations[annotations.Priority] = "10"
+	nodes[2].Annotations[annotations.Priority] = "-1"
+
+	expectOrder(t, op, nodes, []string{OrderPriority, OrderOldest}, "node-1", "node-2", "node-3")
+}
+
+func TestOrderPods(t *testing.T) {
+	op, _, _ := newTestCluster(t, testConf(), State{},
+		testPod("a", "node-1", "3"),
+		testPod("b", "node-2", "100m"),
+		testPod("c", "node-2", "100m"),
+	)
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+	nodes := []v1.Node{
+		testNode("node-1", 1, nil),
+		testNode("node-2", 1, nil),
+		testNode("node-3", 1, nil),
+	}
+
+	expectOrder(t, op, nodes, []string{OrderFewestPods}, "node-3", "node-1", "node-2")
+	expectOrder(t, op, nodes, []string{OrderLeastUtilized}, "node-3", "node-2", "node-1")
+}
+
+func TestOrderZoneRoundRobin(t *testing.T) {
+	op, _, _ := newTestCluster(t, testConf(), State{})
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+	nodes := []v1.Node{
+		testNode("node-a", 1, map[string]string{LabelZone: "zone-a"}),
+		testNode("node-b", 1, map[string]string{LabelZone: "zone-b"}),
+		testNode("node-c", 1, map[string]string{LabelZoneDeprecated: "zone-c"}),
+	}
+
+	// No cycle yet: zones in order
+	expectOrder(t, op, nodes, []string{OrderZoneRoundRobin}, "node-a", "node-b", "node-c")
+
+	raw, _ := json.Marshal(State{LastCycle: &Cycle{Node: "old", Zone: "zone-b"}})
+	if err := ioutil.WriteFile(op.statePath, raw, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectOrder(t, op, nodes, []string{OrderZoneRoundRobin}, "node-c", "node-a", "node-b")
+}
+
+func TestNextToUpdatePoolOrder(t *testing.T) {
+	op, _, _ := newTestCluster(t, orderConf([]string{OrderMastersLast}, map[string][]string{"worker": {OrderOldest}}), State{})
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+	nodes := []v1.Node{
+		testNode("master-1", 5, map[string]string{"role": "master"}),
+		testNode("worker-1", 1, map[string]string{"role": "worker"}),
+		testNode("worker-2", 3, map[string]string{"role": "worker"}),
+	}
+
+	n, err := op.nextToUpdate(nodes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n.Name != "worker-2" {
+		t.Errorf("expected the oldest worker, got %s", n.Name)
+	}
+}
+
+func TestValidateOrder(t *testing.T) {
+	if err := ValidateOrder([]string{OrderPriority, "newest"}); err == nil {
+		t.Errorf("expected an unknown order to be rejected")
+	}
+}
@@ -0,0 +1,332 @@
+// Package simulator replays rollout scenarios against the operator
+// deterministically. The cluster is a fake clientset, time is a fake clock
+// advanced on every step and instances are backed by the fake cloud provider.
+// Every node runs the real agent of pkg/agent, which moves its node one phase
+// forward per step, so that scenarios can break them at a precise point of a
+// cycle.
+package simulator
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+
+	cloudfake "github.com/utilitywarehouse/kube-node-cycle-operator/cloud/fake"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/agent"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/operator"
+)
+
+const (
+	// DefaultInterval is the time between two steps, as between two reconciles
+	// of a running operator
+	DefaultInterval = 30 * time.Second
+	// PoolLabel is the node label the simulated pools are set under
+	PoolLabel = "role"
+)
+
+// Clock is a fake clock only moved forward by the simulator
+type Clock struct {
+	now time.Time
+}
+
+func (c *Clock) Now() time.Time {
+	return c.now
+}
+
+// Advance moves the clock forward by d
+func (c *Clock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// Step is the outcome of a single reconcile
+type Step struct {
+	Time     time.Time
+	Decision operator.Decision
+}
+
+// Simulator drives an operator over a fake cluster
+type Simulator struct {
+	Client   *fake.Clientset
+	Clock    *Clock
+	Provider *cloudfake.Provider
+	Operator *operator.Operator
+	// Interval is the time the clock is advanced by on every step
+	Interval time.Duration
+	// BrokenTemplate makes replacement nodes register but never become Ready,
+	// as instances created from a broken template would
+	BrokenTemplate bool
+
+	dir      string
+	outdated map[string]string
+	// agents of the nodes keyed by Node uid, as every instance runs its own
+	agents map[types.UID]*agent.NodeAgent
+	// dead agents no longer act on their node
+	dead map[string]bool
+	// pending replacements register on the next step with the labels of the
+	// node they replace, keyed by node name
+	pending     map[string]map[string]string
+	generations map[string]int
+	steps       []Step
+}
+
+// New returns a simulator for an operator configured with conf. The kube
+// client, clock, pool label, state path and cloud provider are set by the
+// simulator. Close removes the state file.
+func New(conf operator.Config) (*Simulator, error) {
+	dir, err := ioutil.TempDir("", "node-cycle-simulator")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Simulator{
+		Client:      fake.NewSimpleClientset(),
+		Clock:       &Clock{now: time.Date(2018, 1, 1, 0, 0, 0, 0, time.UTC)},
+		Interval:    DefaultInterval,
+		dir:         dir,
+		outdated:    map[string]string{},
+		agents:      map[types.UID]*agent.NodeAgent{},
+		dead:        map[string]bool{},
+		pending:     map[string]map[string]string{},
+		generations: map[string]int{},
+	}
+	s.Provider = cloudfake.New(s.Client, source{s})
+
+	// The operator expects the node count of a previous run
+	conf.StatePath = filepath.Join(dir, "state.json")
+	raw, err := json.Marshal(operator.State{})
+	if err != nil {
+		return nil, err
+	}
+	if err := ioutil.WriteFile(conf.StatePath, raw, 0644); err != nil {
+		return nil, err
+	}
+
+	conf.KubeClient = s.Client
+	conf.Now = s.Clock.Now
+	conf.PoolLabel = PoolLabel
+	conf.Cloud = s.Provider
+	if s.Operator, err = operator.New(conf); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Close removes the operator state
+func (s *Simulator) Close() error {
+	return os.RemoveAll(s.dir)
+}
+
+// source declares the nodes marked outdated to the fake provider
+type source struct {
+	s *Simulator
+}
+
+func (src source) Outdated() (map[string]string, error) {
+	outdated := map[string]string{}
+	for node, reason := range src.s.outdated {
+		outdated[node] = reason
+	}
+	return outdated, nil
+}
+
+// AddNode registers a Ready node in pool
+func (s *Simulator) AddNode(name, pool string) error {
+	return s.AddNodeWithLabels(name, map[string]string{PoolLabel: pool})
+}
+
+// AddNodeWithLabels registers a Ready node with labels, e.g. its pool and
+// zone. Replacements of the node keep them.
+func (s *Simulator) AddNodeWithLabels(name string, labels map[string]string) error {
+	_, err := s.Client.CoreV1().Nodes().Create(s.node(name, labels, true))
+	return err
+}
+
+// DeleteNode removes a node and its instance, as a zone outage or a scale
+// down would
+func (s *Simulator) DeleteNode(name string) error {
+	return s.Client.CoreV1().Nodes().Delete(name, &v1meta.DeleteOptions{})
+}
+
+func (s *Simulator) node(name string, labels map[string]string, ready bool) *v1.Node {
+	s.generations[name]++
+	gen := s.generations[name]
+	return &v1.Node{
+		ObjectMeta: v1meta.ObjectMeta{
+			Name:              name,
+			UID:               types.UID(fmt.Sprintf("%s-uid-%d", name, gen)),
+			Labels:            labels,
+			CreationTimestamp: v1meta.NewTime(s.Clock.Now()),
+		},
+		Spec: v1.NodeSpec{ProviderID: "fake://" + name},
+		Status: v1.NodeStatus{
+			Conditions: []v1.NodeCondition{readyCondition(ready, s.Clock.Now())},
+			NodeInfo:   v1.NodeSystemInfo{BootID: fmt.Sprintf("%s-boot-%d", name, gen)},
+		},
+	}
+}
+
+func readyCondition(ready bool, at time.Time) v1.NodeCondition {
+	status := v1.ConditionTrue
+	if !ready {
+		status = v1.ConditionFalse
+	}
+	return v1.NodeCondition{
+		Type:               v1.NodeReady,
+		Status:             status,
+		LastTransitionTime: v1meta.NewTime(at),
+	}
+}
+
+// Outdate declares nodes as needing an update. Their agents report it on the
+// next step.
+func (s *Simulator) Outdate(reason string, nodes ...string) {
+	for _, n := range nodes {
+		s.outdated[n] = reason
+	}
+}
+
+// SetReady flips the Ready condition of a node
+func (s *Simulator) SetReady(name string, ready bool) error {
+	n, err := s.Client.CoreV1().Nodes().Get(name, v1meta.GetOptions{})
+	if err != nil {
+		return err
+	}
+	n.Status.Conditions = []v1.NodeCondition{readyCondition(ready, s.Clock.Now())}
+	_, err = s.Client.CoreV1().Nodes().Update(n)
+	return err
+}
+
+// KillAgent stops the agent of a node from acting on it
+func (s *Simulator) KillAgent(name string) {
+	s.dead[name] = true
+}
+
+// Step lets the agents act, advances the clock and runs a reconcile
+func (s *Simulator) Step() (operator.Decision, error) {
+	if err := s.registerReplacements(); err != nil {
+		return operator.Decision{}, err
+	}
+	if err := s.runAgents(); err != nil {
+		return operator.Decision{}, err
+	}
+
+	// The operator sees what agents did an interval ago, as it would
+	s.Clock.Advance(s.Interval)
+	d := s.Operator.Reconcile(context.Background())
+	s.steps = append(s.steps, Step{Time: s.Clock.Now(), Decision: d})
+	return d, nil
+}
+
+// Run runs n steps
+func (s *Simulator) Run(n int) error {
+	for i := 0; i < n; i++ {
+		if _, err := s.Step(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Steps returns every step run so far
+func (s *Simulator) Steps() []Step {
+	return s.steps
+}
+
+// Grants returns the nodes given permission, in order
+func (s *Simulator) Grants() []string {
+	var grants []string
+	for _, st := range s.steps {
+		if st.Decision.Type == operator.DecisionGrant {
+			grants = append(grants, st.Decision.Node)
+		}
+	}
+	return grants
+}
+
+// registerReplacements brings up the instances recreated on the previous step
+func (s *Simulator) registerReplacements() error {
+	names := []string{}
+	for name := range s.pending {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		n := s.node(name, s.pending[name], !s.BrokenTemplate)
+		if _, err := s.Client.CoreV1().Nodes().Create(n); err != nil {
+			return err
+		}
+		delete(s.pending, name)
+		delete(s.outdated, name)
+		delete(s.dead, name)
+	}
+	return nil
+}
+
+// runAgents runs a step of every live agent
+func (s *Simulator) runAgents() error {
+	nodes, err := s.Client.CoreV1().Nodes().List(v1meta.ListOptions{})
+	if err != nil {
+		return err
+	}
+	for _, n := range nodes.Items {
+		if s.dead[n.Name] {
+			continue
+		}
+		a, ok := s.agents[n.UID]
+		if !ok {
+			a = agent.New(n.Name, s.Client, nodeClient{s: s, node: n.Name}, agent.Config{})
+			a.Start()
+			s.agents[n.UID] = a
+		}
+		if err := a.Step(context.Background()); err != nil {
+			return fmt.Errorf("agent of node %s: %v", n.Name, err)
+		}
+	}
+	return nil
+}
+
+// nodeClient is the fake provider as seen by the agent of a node. The
+// instance goes away with its agent once the termination is waited for, and
+// the group manager brings up a replacement under the same name on the next
+// step.
+type nodeClient struct {
+	s    *Simulator
+	node string
+}
+
+func (c nodeClient) NeedsUpdate(ctx context.Context) (bool, string, error) {
+	return c.s.Provider.Node(c.node).NeedsUpdate(ctx)
+}
+
+func (c nodeClient) TerminateNode(ctx context.Context) (string, error) {
+	return c.s.Provider.Node(c.node).TerminateNode(ctx)
+}
+
+func (c nodeClient) WaitForTermination(ctx context.Context, operation string) error {
+	n, err := c.s.Client.CoreV1().Nodes().Get(c.node, v1meta.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := c.s.Provider.Node(c.node).WaitForTermination(ctx, operation); err != nil {
+		return err
+	}
+	delete(c.s.agents, n.UID)
+	c.s.pending[c.node] = n.Labels
+	return nil
+}
@@ -0,0 +1,333 @@
+package simulator
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/etcd"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/notify"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/operator"
+)
+
+func newSimulator(t *testing.T, conf operator.Config, nodes ...string) *Simulator {
+	s, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range nodes {
+		if err := s.AddNode(n, "worker"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Let the operator record the node count before the rollout
+	if err := s.Run(1); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func run(t *testing.T, s *Simulator, n int) {
+	if err := s.Run(n); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectGrants(t *testing.T, s *Simulator, expected ...string) {
+	grants := s.Grants()
+	if len(grants) == 0 && len(expected) == 0 {
+		return
+	}
+	if !reflect.DeepEqual(grants, expected) {
+		t.Errorf("expected grants %v, got %v", expected, grants)
+	}
+}
+
+func seen(s *Simulator, reason operator.Reason) bool {
+	for _, st := range s.Steps() {
+		if st.Decision.Reason == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func TestRollout(t *testing.T) {
+	s := newSimulator(t, operator.Config{}, "node-a", "node-b", "node-c")
+	defer s.Close()
+
+	s.Outdate("new template", "node-a", "node-b", "node-c")
+	run(t, s, 30)
+
+	expectGrants(t, s, "node-a", "node-b", "node-c")
+	last := s.Steps()[len(s.Steps())-1].Decision
+	if last.Reason != operator.ReasonNoUpdateNeeded {
+		t.Errorf("expected the rollout to be over, got %s", last)
+	}
+}
+
+func TestNodeFlapsNotReady(t *testing.T) {
+	s := newSimulator(t, operator.Config{}, "node-a", "node-b")
+	defer s.Close()
+
+	s.Outdate("new template", "node-a", "node-b")
+	if err := s.SetReady("node-b", false); err != nil {
+		t.Fatal(err)
+	}
+	run(t, s, 10)
+	expectGrants(t, s)
+	if !seen(s, operator.ReasonNotReadyNodes) {
+		t.Errorf("expected grants to be blocked by the not ready node")
+	}
+
+	if err := s.SetReady("node-b", true); err != nil {
+		t.Fatal(err)
+	}
+	run(t, s, 20)
+	expectGrants(t, s, "node-a", "node-b")
+}
+
+func TestAgentDiesMidDrain(t *testing.T) {
+	s := newSimulator(t, operator.Config{CycleTimeout: 10 * time.Minute}, "node-a", "node-b")
+	defer s.Close()
+
+	s.Outdate("new template", "node-a", "node-b")
+	for i := 0; i < 10; i++ {
+		run(t, s, 1)
+		n, err := s.Client.CoreV1().Nodes().Get("node-a", v1meta.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st, _ := nodestate.FromNode(*n); st.Phase == nodestate.Draining {
+			s.KillAgent("node-a")
+			break
+		}
+	}
+
+	// Past the cycle timeout the cycle fails, but the node is still draining
+	run(t, s, 40)
+	expectGrants(t, s, "node-a")
+	last := s.Steps()[len(s.Steps())-1].Decision
+	if last.Reason != operator.ReasonUpdateInProgress {
+		t.Errorf("expected to wait on the node being drained, got %s", last)
+	}
+}
+
+func TestBrokenTemplate(t *testing.T) {
+	s := newSimulator(t, operator.Config{CycleTimeout: 10 * time.Minute, FailureBudget: 1}, "node-a", "node-b", "node-c")
+	defer s.Close()
+
+	s.BrokenTemplate = true
+	s.Outdate("broken template", "node-a", "node-b", "node-c")
+	run(t, s, 60)
+
+	expectGrants(t, s, "node-a")
+	if !seen(s, operator.ReasonNotReadyNodes) {
+		t.Errorf("expected grants to be blocked by the broken replacement")
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	events := &notifications{}
+	s := newSimulator(t, operator.Config{DryRun: true, Notifier: events}, "node-a", "node-b")
+	defer s.Close()
+
+	s.Outdate("new template", "node-a", "node-b")
+	run(t, s, 10)
+
+	expectGrants(t, s)
+	last := s.Steps()[len(s.Steps())-1].Decision
+	if last.Reason != operator.ReasonDryRun || last.Node != "node-a" {
+		t.Errorf("expected a dry run grant of node-a, got %s", last)
+	}
+	if len(*events) != 0 {
+		t.Errorf("expected a dry run not to notify, got %v", *events)
+	}
+}
+
+func TestZoneAware(t *testing.T) {
+	s := newSimulator(t, operator.Config{ZoneAware: true})
+	defer s.Close()
+
+	for _, n := range []string{"b1", "a1", "b2", "a2"} {
+		labels := map[string]string{PoolLabel: "worker", operator.LabelZone: "zone-" + n[:1]}
+		if err := s.AddNodeWithLabels(n, labels); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(t, s, 1)
+
+	s.Outdate("new template", "b1", "a1", "b2", "a2")
+	run(t, s, 40)
+	expectGrants(t, s, "a1", "a2", "b1", "b2")
+}
+
+func TestZoneDegraded(t *testing.T) {
+	s := newSimulator(t, operator.Config{ZoneAware: true})
+	defer s.Close()
+
+	for _, n := range []string{"a1", "a2", "b1", "b2"} {
+		labels := map[string]string{PoolLabel: "worker", operator.LabelZone: "zone-" + n[:1]}
+		if err := s.AddNodeWithLabels(n, labels); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(t, s, 1)
+
+	// The group manager moves an instance to another zone, keeping the
+	// node count
+	if err := s.DeleteNode("b2"); err != nil {
+		t.Fatal(err)
+	}
+	labels := map[string]string{PoolLabel: "worker", operator.LabelZone: "zone-a"}
+	if err := s.AddNodeWithLabels("a3", labels); err != nil {
+		t.Fatal(err)
+	}
+	s.Outdate("new template", "a1", "a2", "a3", "b1")
+	run(t, s, 10)
+
+	expectGrants(t, s)
+	last := s.Steps()[len(s.Steps())-1].Decision
+	if last.Reason != operator.ReasonZoneDegraded {
+		t.Errorf("expected grants to be blocked by zone-b, got %s", last)
+	}
+}
+
+// etcdMasters runs an etcd member on every master, healthy once its node has
+// been Ready for joinAfter. Unmatched members are named after no node.
+type etcdMasters struct {
+	s         *Simulator
+	down      map[string]bool
+	unmatched map[string]bool
+	joinAfter time.Duration
+}
+
+func (e *etcdMasters) Members(ctx context.Context) ([]etcd.Member, error) {
+	nodes, err := e.s.Client.CoreV1().Nodes().List(v1meta.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	ready := map[string]bool{}
+	for _, n := range nodes.Items {
+		if n.Labels[PoolLabel] != "master" {
+			continue
+		}
+		names = append(names, n.Name)
+		for _, c := range n.Status.Conditions {
+			if c.Type == v1.NodeReady && c.Status == v1.ConditionTrue {
+				ready[n.Name] = e.s.Clock.Now().Sub(n.CreationTimestamp.Time) >= e.joinAfter
+			}
+		}
+	}
+	sort.Strings(names)
+
+	members := []etcd.Member{}
+	for i, name := range names {
+		m := etcd.Member{ID: uint64(i + 1), Name: name, Healthy: ready[name] && !e.down[name]}
+		if e.unmatched[name] {
+			m.Name = fmt.Sprintf("etcd-%d", m.ID)
+		}
+		members = append(members, m)
+	}
+	return members, nil
+}
+
+func TestEtcdQuorum(t *testing.T) {
+	members := &etcdMasters{down: map[string]bool{}, joinAfter: 3 * DefaultInterval}
+	s := newSimulator(t, operator.Config{Etcd: members})
+	defer s.Close()
+	members.s = s
+
+	for _, n := range []string{"master-1", "master-2", "master-3"} {
+		if err := s.AddNode(n, "master"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(t, s, 4)
+
+	// Losing master-1 on top of master-3 would leave 1 of 3 members
+	members.down["master-3"] = true
+	s.Outdate("new template", "master-1", "master-2")
+	run(t, s, 10)
+	expectGrants(t, s)
+	last := s.Steps()[len(s.Steps())-1].Decision
+	if last.Reason != operator.ReasonEtcdQuorum {
+		t.Errorf("expected grants to be blocked by etcd quorum, got %s", last)
+	}
+
+	// master-2 is only granted once the member of master-1 is back
+	members.down["master-3"] = false
+	run(t, s, 40)
+	expectGrants(t, s, "master-1", "master-2")
+	joining := false
+	for _, st := range s.Steps() {
+		if strings.Contains(st.Decision.Message, string(operator.CycleEtcdMemberJoining)) {
+			joining = true
+		}
+	}
+	if !joining {
+		t.Errorf("expected to wait for the etcd member of the replacement")
+	}
+}
+
+func TestEtcdUnmatchedMaster(t *testing.T) {
+	members := &etcdMasters{down: map[string]bool{}, unmatched: map[string]bool{"master-1": true}}
+	s := newSimulator(t, operator.Config{Etcd: members})
+	defer s.Close()
+	members.s = s
+
+	for _, n := range []string{"master-1", "master-2", "master-3"} {
+		if err := s.AddNode(n, "master"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	run(t, s, 2)
+
+	// The member of master-1 cannot be found, it must not be taken for free
+	members.down["master-3"] = true
+	s.Outdate("new template", "master-1")
+	run(t, s, 10)
+	expectGrants(t, s)
+	last := s.Steps()[len(s.Steps())-1].Decision
+	if last.Reason != operator.ReasonEtcdQuorum || !strings.Contains(last.Message, "no member matches node master-1") {
+		t.Errorf("expected grants to be blocked by etcd quorum, got %s", last)
+	}
+
+	members.down["master-3"] = false
+	run(t, s, 2)
+	expectGrants(t, s, "master-1")
+}
+
+type notifications []notify.Event
+
+func (n *notifications) Notify(e notify.Event) error {
+	*n = append(*n, e)
+	return nil
+}
+
+func TestNotifications(t *testing.T) {
+	events := &notifications{}
+	s := newSimulator(t, operator.Config{Notifier: events}, "node-a", "node-b")
+	defer s.Close()
+
+	s.Outdate("new template", "node-a", "node-b")
+	run(t, s, 30)
+
+	types := []notify.EventType{}
+	for _, e := range *events {
+		types = append(types, e.Type)
+	}
+	expected := []notify.EventType{notify.RolloutStarted, notify.NodeCycled, notify.NodeCycled, notify.RolloutFinished}
+	if !reflect.DeepEqual(types, expected) {
+		t.Errorf("expected notifications %v, got %v", expected, types)
+	}
+}
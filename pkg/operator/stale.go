@@ -0,0 +1,70 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const defaultStaleNodeGrace = 10 * time.Minute
+
+// notReadySince returns when a node stopped being Ready, or false if it is Ready
+func notReadySince(n v1.Node) (time.Time, bool) {
+	for _, c := range n.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			if c.Status == v1.ConditionTrue {
+				return time.Time{}, false
+			}
+			return c.LastTransitionTime.Time, true
+		}
+	}
+	// No Ready condition reported at all
+	return n.CreationTimestamp.Time, true
+}
+
+// removeStaleNode deletes at most one Node object whose backing instance is
+// gone. Only nodes that have been NotReady for longer than the grace period and
+// that the cloud provider positively reports as missing are considered.
+func (op *Operator) removeStaleNode(ctx context.Context, nodes []v1.Node) (string, error) {
+	if op.cloud == nil {
+		return "", nil
+	}
+
+	for _, n := range nodes {
+		since, notReady := notReadySince(n)
+		if !notReady || op.now().Sub(since) < op.staleNodeGrace {
+			continue
+		}
+		if n.Spec.ProviderID == "" {
+			log.Println("[WARN] not ready node without providerID, not removing:", n.Name)
+			continue
+		}
+
+		exists, err := op.cloud.InstanceExists(ctx, n.Spec.ProviderID)
+		if err != nil {
+			return "", fmt.Errorf("failed to look up instance of node %s: %v", n.Name, err)
+		}
+		if exists {
+			continue
+		}
+
+		if op.dryRun {
+			log.Println(fmt.Sprintf("[INFO] dry run: instance %s is gone, would remove stale node %s", n.Spec.ProviderID, n.Name))
+			continue
+		}
+		log.Println(fmt.Sprintf("[INFO] instance %s is gone, removing stale node %s", n.Spec.ProviderID, n.Name))
+		if err := op.nc.Delete(n.Name, &v1meta.DeleteOptions{
+			Preconditions: &v1meta.Preconditions{UID: &n.UID},
+		}); err != nil {
+			return "", fmt.Errorf("failed to remove stale node %s: %v", n.Name, err)
+		}
+		op.recorder.Eventf(&n, v1.EventTypeNormal, "StaleNodeRemoved",
+			"Removed node %s, instance %s no longer exists", n.Name, n.Spec.ProviderID)
+		return n.Name, nil
+	}
+	return "", nil
+}
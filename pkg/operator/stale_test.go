@@ -0,0 +1,159 @@
+package operator
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	v1core "k8s.io/client-go/kubernetes/typed/core/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+// testCloud reports the instances of the providerIDs in exists, and every
+// operation as done and opErr
+type testCloud struct {
+	exists map[string]bool
+	err    error
+	done   bool
+	opErr  error
+}
+
+func (c *testCloud) InstanceExists(ctx context.Context, providerID string) (bool, error) {
+	return c.exists[providerID], c.err
+}
+
+func (c *testCloud) OperationDone(ctx context.Context, operation string) (bool, error) {
+	return c.done, c.opErr
+}
+
+// preconditionNodes enforces delete preconditions, which the fake clientset
+// ignores, the way the api server does
+type preconditionNodes struct {
+	v1core.NodeInterface
+}
+
+func (nc preconditionNodes) Delete(name string, options *v1meta.DeleteOptions) error {
+	if options == nil || options.Preconditions == nil || options.Preconditions.UID == nil {
+		return fmt.Errorf("expected a uid precondition deleting node %s", name)
+	}
+	n, err := nc.Get(name, v1meta.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if n.UID != *options.Preconditions.UID {
+		return apierrors.NewConflict(schema.GroupResource{Resource: "nodes"}, name,
+			fmt.Errorf("precondition failed: uid %s, object uid %s", *options.Preconditions.UID, n.UID))
+	}
+	return nc.NodeInterface.Delete(name, options)
+}
+
+// staleNode returns a node NotReady since `since` before epoch
+func staleNode(t *testing.T, name string, since time.Duration) *v1.Node {
+	n := clusterNode(t, name, nodestate.Idle)
+	n.Status.Conditions[0].Status = v1.ConditionFalse
+	n.Status.Conditions[0].LastTransitionTime = v1meta.NewTime(epoch.Add(-since))
+	return n
+}
+
+func TestRemoveStaleNode(t *testing.T) {
+	noProviderID := staleNode(t, "node-a", time.Hour)
+	noProviderID.Spec.ProviderID = ""
+
+	tests := []struct {
+		name    string
+		node    *v1.Node
+		cloud   *testCloud
+		dryRun  bool
+		removed string
+		err     bool
+	}{
+		{
+			name:  "ready node",
+			node:  clusterNode(t, "node-a", nodestate.Idle),
+			cloud: &testCloud{},
+		},
+		{
+			name:  "within grace period",
+			node:  staleNode(t, "node-a", 5*time.Minute),
+			cloud: &testCloud{},
+		},
+		{
+			name:  "no providerID",
+			node:  noProviderID,
+			cloud: &testCloud{},
+		},
+		{
+			name:  "instance still there",
+			node:  staleNode(t, "node-a", time.Hour),
+			cloud: &testCloud{exists: map[string]bool{"fake://node-a": true}},
+		},
+		{
+			name:  "lookup error",
+			node:  staleNode(t, "node-a", time.Hour),
+			cloud: &testCloud{err: fmt.Errorf("rate limited")},
+			err:   true,
+		},
+		{
+			name:   "dry run",
+			node:   staleNode(t, "node-a", time.Hour),
+			cloud:  &testCloud{},
+			dryRun: true,
+		},
+		{
+			name:    "instance gone",
+			node:    staleNode(t, "node-a", time.Hour),
+			cloud:   &testCloud{},
+			removed: "node-a",
+		},
+	}
+
+	for _, test := range tests {
+		conf := testConf()
+		conf.Cloud = test.cloud
+		conf.DryRun = test.dryRun
+		op, kc, _ := newTestCluster(t, conf, State{}, test.node)
+		os.RemoveAll(filepath.Dir(op.statePath))
+		op.nc = preconditionNodes{op.nc}
+
+		removed, err := op.removeStaleNode(context.Background(), []v1.Node{*test.node})
+		if (err != nil) != test.err {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		}
+		if removed != test.removed {
+			t.Errorf("%s: expected %q to be removed, got %q", test.name, test.removed, removed)
+		}
+		_, err = kc.CoreV1().Nodes().Get("node-a", v1meta.GetOptions{})
+		if gone := apierrors.IsNotFound(err); gone != (test.removed != "") {
+			t.Errorf("%s: expected node removed to be %v, got %v (%v)", test.name, test.removed != "", gone, err)
+		}
+	}
+}
+
+func TestRemoveStaleNodeChecksUID(t *testing.T) {
+	conf := testConf()
+	conf.Cloud = &testCloud{}
+	listed := staleNode(t, "node-a", time.Hour)
+	// Registered again under the same name since it was listed
+	current := staleNode(t, "node-a", time.Hour)
+	current.UID = types.UID("node-a-new-uid")
+	op, kc, _ := newTestCluster(t, conf, State{}, current)
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+	op.nc = preconditionNodes{op.nc}
+
+	removed, err := op.removeStaleNode(context.Background(), []v1.Node{*listed})
+	if err == nil || removed != "" {
+		t.Errorf("expected the uid precondition to fail, got %q removed (%v)", removed, err)
+	}
+	if _, err := kc.CoreV1().Nodes().Get("node-a", v1meta.GetOptions{}); err != nil {
+		t.Errorf("expected the re-registered node to be kept, got %v", err)
+	}
+}
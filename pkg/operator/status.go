@@ -0,0 +1,157 @@
+package operator
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"k8s.io/api/core/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/control"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+const (
+	defaultPool = "default"
+
+	poolIdle     = "idle"
+	poolPending  = "pending"
+	poolUpdating = "updating"
+	poolPaused   = "paused"
+)
+
+// Status is the view of the operator served by the status API
+type Status struct {
+	Rollout      string        `json:"rollout"`
+	NodeCount    int           `json:"nodeCount"`
+	Pools        []PoolStatus  `json:"pools"`
+	UpdateNeeded []NodeUpdate  `json:"updateNeeded"`
+	InProgress   *NodeProgress `json:"inProgress,omitempty"`
+	Cycle        *Cycle        `json:"cycle,omitempty"`
+	LastCycle    *Cycle        `json:"lastCycle,omitempty"`
+	LastDecision *Decision     `json:"lastDecision,omitempty"`
+	UpdatedAt    time.Time     `json:"updatedAt"`
+}
+
+type PoolStatus struct {
+	Name         string `json:"name"`
+	State        string `json:"state"`
+	Nodes        int    `json:"nodes"`
+	ReadyNodes   int    `json:"readyNodes"`
+	UpdateNeeded int    `json:"updateNeeded"`
+}
+
+type NodeUpdate struct {
+	Name   string `json:"name"`
+	Pool   string `json:"pool"`
+	Reason string `json:"reason"`
+}
+
+type NodeProgress struct {
+	Name     string          `json:"name"`
+	Pool     string          `json:"pool"`
+	Phase    nodestate.Phase `json:"phase"`
+	Since    time.Time       `json:"since,omitempty"`
+	Duration string          `json:"duration,omitempty"`
+}
+
+func isReady(n v1.Node) bool {
+	for _, c := range n.Status.Conditions {
+		if c.Type == v1.NodeReady {
+			return c.Status == v1.ConditionTrue
+		}
+	}
+	return false
+}
+
+// poolOf returns the pool a node belongs to based on the configured label
+func (op *Operator) poolOf(n v1.Node) string {
+	if p, ok := n.Labels[op.poolLabel]; ok && p != "" {
+		return p
+	}
+	return defaultPool
+}
+
+// updateSnapshot rebuilds the served status from the current list of nodes
+func (op *Operator) updateSnapshot(rollout string, nodes []v1.Node) {
+	now := op.now()
+	pools := map[string]*PoolStatus{}
+	updates := []NodeUpdate{}
+	var progress *NodeProgress
+
+	for _, n := range nodes {
+		name := op.poolOf(n)
+		p, ok := pools[name]
+		if !ok {
+			p = &PoolStatus{Name: name, State: poolIdle}
+			pools[name] = p
+		}
+		p.Nodes++
+		if isReady(n) {
+			p.ReadyNodes++
+		}
+
+		ns := op.nodeState(n)
+		if ns.Phase == nodestate.UpdateNeeded {
+			p.UpdateNeeded++
+			if p.State == poolIdle {
+				p.State = poolPending
+			}
+			updates = append(updates, NodeUpdate{
+				Name:   n.Name,
+				Pool:   name,
+				Reason: ns.Reason,
+			})
+		}
+
+		if ns.Phase == nodestate.Approved || ns.InProgress() {
+			p.State = poolUpdating
+			progress = &NodeProgress{Name: n.Name, Pool: name, Phase: ns.Phase}
+			if since, ok := ns.Timestamps[nodestate.Approved]; ok {
+				progress.Since = since
+				progress.Duration = now.Sub(since).Round(time.Second).String()
+			}
+		}
+	}
+
+	st := Status{
+		Rollout:      rollout,
+		UpdateNeeded: updates,
+		InProgress:   progress,
+		UpdatedAt:    now,
+	}
+	for _, p := range pools {
+		if rollout != control.RolloutRunning && p.State == poolPending {
+			p.State = poolPaused
+		}
+		st.Pools = append(st.Pools, *p)
+	}
+	sort.Slice(st.Pools, func(i, j int) bool { return st.Pools[i].Name < st.Pools[j].Name })
+
+	if state, err := op.loadState(); err == nil {
+		st.NodeCount = state.NodeCount
+		st.Cycle = state.Cycle
+		st.LastCycle = state.LastCycle
+	}
+
+	op.mu.Lock()
+	st.LastDecision = op.snapshot.LastDecision
+	op.snapshot = st
+	op.mu.Unlock()
+}
+
+// ServeHTTP serves the current operator status as json
+func (op *Operator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	op.mu.RLock()
+	raw, err := json.MarshalIndent(op.snapshot, "", "  ")
+	op.mu.RUnlock()
+	if err != nil {
+		log.Println("[ERROR] failed to marshal status:", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(raw)
+}
@@ -0,0 +1,90 @@
+package operator
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/annotations"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/control"
+	"github.com/utilitywarehouse/kube-node-cycle-operator/pkg/nodestate"
+)
+
+// poolNode returns a node of pool in phase, entered at since
+func poolNode(t *testing.T, name, pool string, phase nodestate.Phase, since time.Time) *v1.Node {
+	n := clusterNode(t, name, phase)
+	if pool == "" {
+		delete(n.Labels, "role")
+	} else {
+		n.Labels["role"] = pool
+	}
+	st := nodestate.New()
+	st.Phase = phase
+	st.Reason = "new template"
+	st.Timestamps = map[nodestate.Phase]time.Time{phase: since}
+	if phase == nodestate.Draining {
+		st.Timestamps[nodestate.Approved] = since
+	}
+	raw, err := st.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.Annotations[annotations.State] = raw
+	return n
+}
+
+func TestStatus(t *testing.T) {
+	nodes := []v1.Node{
+		*poolNode(t, "master-a", "master", nodestate.UpdateNeeded, epoch),
+		*poolNode(t, "node-a", "worker", nodestate.Draining, epoch.Add(-90*time.Second)),
+		*poolNode(t, "node-b", "worker", nodestate.UpdateNeeded, epoch),
+		*poolNode(t, "other", "", nodestate.Idle, epoch),
+	}
+	op, _, _ := newTestCluster(t, testConf(), State{NodeCount: 4})
+	defer os.RemoveAll(filepath.Dir(op.statePath))
+
+	for _, test := range []struct {
+		rollout string
+		pools   map[string]string
+	}{
+		{control.RolloutRunning, map[string]string{defaultPool: poolIdle, "master": poolPending, "worker": poolUpdating}},
+		// Pools waiting for an update are paused with the rollout
+		{control.RolloutPaused, map[string]string{defaultPool: poolIdle, "master": poolPaused, "worker": poolUpdating}},
+	} {
+		op.updateSnapshot(test.rollout, nodes)
+
+		rec := httptest.NewRecorder()
+		op.ServeHTTP(rec, httptest.NewRequest("GET", "/status", nil))
+		if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: expected json, got %s", test.rollout, ct)
+		}
+		st := Status{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &st); err != nil {
+			t.Fatal(err)
+		}
+
+		if st.Rollout != test.rollout || st.NodeCount != 4 || !st.UpdatedAt.Equal(epoch) {
+			t.Errorf("%s: unexpected status %+v", test.rollout, st)
+		}
+		if len(st.Pools) != len(test.pools) {
+			t.Fatalf("%s: expected pools %v, got %+v", test.rollout, test.pools, st.Pools)
+		}
+		for _, p := range st.Pools {
+			if p.State != test.pools[p.Name] {
+				t.Errorf("%s: expected pool %s %s, got %s", test.rollout, p.Name, test.pools[p.Name], p.State)
+			}
+		}
+		if len(st.UpdateNeeded) != 2 || st.UpdateNeeded[0].Name != "master-a" || st.UpdateNeeded[1].Reason != "new template" {
+			t.Errorf("%s: unexpected nodes needing an update %+v", test.rollout, st.UpdateNeeded)
+		}
+		p := st.InProgress
+		if p == nil || p.Name != "node-a" || p.Phase != nodestate.Draining || p.Duration != "1m30s" {
+			t.Errorf("%s: expected node-a draining for 1m30s, got %+v", test.rollout, p)
+		}
+	}
+}
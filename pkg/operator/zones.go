@@ -0,0 +1,103 @@
+package operator
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"k8s.io/api/core/v1"
+)
+
+// Zone aware rollouts cycle the nodes of one zone after the other and stop
+// granting while a zone is degraded. Cycles are already serialized, so at most
+// one zone is ever disrupted by the operator: a zone outage on top of a cycle
+// could otherwise take out workloads spread across zones for quorum.
+
+// zoneNodeCounts counts the Ready nodes of every zone
+func zoneNodeCounts(nodes []v1.Node) map[string]int {
+	counts := map[string]int{}
+	for _, n := range nodes {
+		if isReady(n) {
+			counts[zoneOf(n)]++
+		}
+	}
+	return counts
+}
+
+// setZoneNodeCounts records the Ready nodes of every zone as the baseline
+// zones are compared against
+func (op *Operator) setZoneNodeCounts(nodes []v1.Node) error {
+	s, err := op.loadState()
+	if os.IsNotExist(err) {
+		s = &State{}
+	} else if err != nil {
+		return err
+	}
+	s.ZoneNodeCounts = zoneNodeCounts(nodes)
+	return op.saveState(s)
+}
+
+// degradedZone returns the first zone with fewer Ready nodes than recorded,
+// and why. Not Ready nodes already block every grant, but instances moved
+// across zones by a regional group manager leave the total count unchanged.
+// Without a baseline, e.g. when zone awareness is turned on mid rollout, the
+// Ready nodes are recorded as the baseline: grants only get here with every
+// node Ready and no cycle in progress.
+func (op *Operator) degradedZone(nodes []v1.Node) (string, string, error) {
+	s, err := op.loadState()
+	if err != nil {
+		return "", "", err
+	}
+	if s.ZoneNodeCounts == nil {
+		log.Println("[INFO] no zone node counts recorded, taking the current ones as the baseline")
+		s.ZoneNodeCounts = zoneNodeCounts(nodes)
+		return "", "", op.saveState(s)
+	}
+
+	zones := []string{}
+	for z := range s.ZoneNodeCounts {
+		zones = append(zones, z)
+	}
+	ready := zoneNodeCounts(nodes)
+	for _, z := range sortedUnique(zones) {
+		if ready[z] < s.ZoneNodeCounts[z] {
+			return z, fmt.Sprintf("%d ready nodes, waiting for %d", ready[z], s.ZoneNodeCounts[z]), nil
+		}
+	}
+	return "", "", nil
+}
+
+// activeZone restricts the nodes to update to a single zone: the zone of the
+// last cycle while it has nodes left to update, else the next one after it
+func (op *Operator) activeZone(updateNodes []v1.Node) ([]v1.Node, string, error) {
+	rank, err := op.zoneRanks(updateNodes)
+	if err != nil {
+		return nil, "", err
+	}
+	s, err := op.loadState()
+	if err != nil && !os.IsNotExist(err) {
+		return nil, "", err
+	}
+
+	zone := ""
+	best := -1
+	for _, n := range updateNodes {
+		z := zoneOf(n)
+		if s != nil && s.LastCycle != nil && z == s.LastCycle.Zone {
+			zone = z
+			break
+		}
+		if best < 0 || rank[z] < best {
+			zone, best = z, rank[z]
+		}
+	}
+
+	res := []v1.Node{}
+	for _, n := range updateNodes {
+		if zoneOf(n) == zone {
+			res = append(res, n)
+		}
+	}
+	log.Println(fmt.Sprintf("[INFO] rolling zone %q, %d nodes left to update", zone, len(res)))
+	return res, zone, nil
+}
@@ -0,0 +1,27 @@
+// Package signals turns termination signals into context cancellation
+package signals
+
+import (
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// Context returns a context that is cancelled on the first SIGTERM or SIGINT.
+// A second signal exits immediately.
+func Context() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	c := make(chan os.Signal, 2)
+	signal.Notify(c, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		s := <-c
+		log.Println("[INFO] received", s, "shutting down")
+		cancel()
+		<-c
+		os.Exit(1)
+	}()
+	return ctx
+}
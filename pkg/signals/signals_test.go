@@ -0,0 +1,55 @@
+package signals
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestContext runs itself in a child process, which is what the signals are
+// sent to: exiting on the second one would end the test binary otherwise
+func TestContext(t *testing.T) {
+	if os.Getenv("SIGNALS_TEST_CHILD") == "1" {
+		child()
+		return
+	}
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestContext$")
+	cmd.Env = append(os.Environ(), "SIGNALS_TEST_CHILD=1")
+	out, err := cmd.CombinedOutput()
+	if !strings.Contains(string(out), "cancelled") {
+		t.Errorf("expected the context to be cancelled on the first signal, got:\n%s", out)
+	}
+	if strings.Contains(string(out), "still running") {
+		t.Errorf("expected an exit on the second signal, got:\n%s", out)
+	}
+	if e, ok := err.(*exec.ExitError); !ok || e.Success() {
+		t.Errorf("expected a failed exit on the second signal, got %v", err)
+	}
+}
+
+func child() {
+	ctx := Context()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		fmt.Println(err)
+		return
+	}
+	select {
+	case <-ctx.Done():
+		fmt.Println("cancelled")
+	case <-time.After(10 * time.Second):
+		fmt.Println("not cancelled")
+		return
+	}
+
+	if err := syscall.Kill(os.Getpid(), syscall.SIGTERM); err != nil {
+		fmt.Println(err)
+		return
+	}
+	time.Sleep(10 * time.Second)
+	fmt.Println("still running")
+}
@@ -0,0 +1,138 @@
+// Package templates shares the instance template of every group manager
+// through a configmap published by the operator, so that agents do not each
+// have to query the compute api for it
+package templates
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+
+	"k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/utilitywarehouse/kube-node-cycle-operator/kube/k8sutil"
+)
+
+const (
+	DefaultNamespace = "kube-system"
+	DefaultName      = "kube-node-cycle-templates"
+	DefaultInterval  = 5 * time.Minute
+
+	// PublishedAnnotation records when the operator last published the templates
+	PublishedAnnotation = "node-cycle/published"
+)
+
+// Source looks up the instance template a regional group manager is using
+type Source interface {
+	GroupTemplate(ctx context.Context, region, group string) (string, error)
+}
+
+// Lister lists the instance template of every group manager in a region
+type Lister interface {
+	ListGroupTemplates(ctx context.Context, region string) (map[string]string, error)
+}
+
+// Key is the configmap key holding the template of a group
+func Key(region, group string) string {
+	return region + "." + group
+}
+
+// Publish writes the templates of the group managers in region to the
+// configmap every interval until ctx is cancelled
+func Publish(ctx context.Context, kc kubernetes.Interface, namespace, name string, lister Lister, region string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if err := publish(ctx, kc, namespace, name, lister, region); err != nil {
+			log.Println("[ERROR] failed to publish group templates:", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func publish(ctx context.Context, kc kubernetes.Interface, namespace, name string, lister Lister, region string) error {
+	templates, err := lister.ListGroupTemplates(ctx, region)
+	if err != nil {
+		return err
+	}
+	data := map[string]string{}
+	for group, template := range templates {
+		data[Key(region, group)] = template
+	}
+	anno := map[string]string{PublishedAnnotation: time.Now().UTC().Format(time.RFC3339)}
+
+	cmi := kc.CoreV1().ConfigMaps(namespace)
+	return k8sutil.RetryOnConflict(k8sutil.DefaultBackoff, func() error {
+		cm, err := cmi.Get(name, v1meta.GetOptions{})
+		if errors.IsNotFound(err) {
+			_, err = cmi.Create(&v1.ConfigMap{
+				ObjectMeta: v1meta.ObjectMeta{
+					Name:        name,
+					Namespace:   namespace,
+					Annotations: anno,
+				},
+				Data: data,
+			})
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		cm.Data = data
+		if cm.Annotations == nil {
+			cm.Annotations = map[string]string{}
+		}
+		cm.Annotations[PublishedAnnotation] = anno[PublishedAnnotation]
+		_, err = cmi.Update(cm)
+		return err
+	})
+}
+
+// ConfigMap reads the templates published by the operator. Groups that are
+// not published are looked up from the fallback source, and so are all of them
+// when the configmap cannot be read or was last published more than maxAge ago.
+type ConfigMap struct {
+	kc        kubernetes.Interface
+	namespace string
+	name      string
+	maxAge    time.Duration
+	fallback  Source
+}
+
+func NewConfigMap(kc kubernetes.Interface, namespace, name string, maxAge time.Duration, fallback Source) *ConfigMap {
+	return &ConfigMap{
+		kc:        kc,
+		namespace: namespace,
+		name:      name,
+		maxAge:    maxAge,
+		fallback:  fallback,
+	}
+}
+
+func (c *ConfigMap) GroupTemplate(ctx context.Context, region, group string) (string, error) {
+	cm, err := c.kc.CoreV1().ConfigMaps(c.namespace).Get(c.name, v1meta.GetOptions{})
+	if err != nil {
+		log.Println(fmt.Sprintf("[ERROR] failed to read group templates from %s/%s, using the api: %v", c.namespace, c.name, err))
+		return c.fallback.GroupTemplate(ctx, region, group)
+	}
+	published, err := time.Parse(time.RFC3339, cm.Annotations[PublishedAnnotation])
+	if err != nil || time.Since(published) > c.maxAge {
+		log.Println(fmt.Sprintf("[ERROR] group templates in %s/%s are stale, using the api", c.namespace, c.name))
+		return c.fallback.GroupTemplate(ctx, region, group)
+	}
+	if template, ok := cm.Data[Key(region, group)]; ok {
+		return template, nil
+	}
+	return c.fallback.GroupTemplate(ctx, region, group)
+}
@@ -0,0 +1,66 @@
+package templates
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"k8s.io/api/core/v1"
+	v1meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+type staticSource map[string]string
+
+func (s staticSource) GroupTemplate(ctx context.Context, region, group string) (string, error) {
+	return s[Key(region, group)], nil
+}
+
+func (s staticSource) ListGroupTemplates(ctx context.Context, region string) (map[string]string, error) {
+	return map[string]string{"nodes": s[Key(region, "nodes")]}, nil
+}
+
+func TestConfigMapReadsPublishedTemplates(t *testing.T) {
+	kc := fake.NewSimpleClientset()
+	published := staticSource{Key("europe-west2", "nodes"): "nodes-v2"}
+	if err := publish(context.Background(), kc, DefaultNamespace, DefaultName, published, "europe-west2"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	api := staticSource{
+		Key("europe-west2", "nodes"):   "nodes-v1",
+		Key("europe-west2", "masters"): "masters-v1",
+	}
+	cm := NewConfigMap(kc, DefaultNamespace, DefaultName, time.Hour, api)
+
+	for group, expected := range map[string]string{"nodes": "nodes-v2", "masters": "masters-v1"} {
+		template, err := cm.GroupTemplate(context.Background(), "europe-west2", group)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if template != expected {
+			t.Errorf("expected template %s for group %s, got %s", expected, group, template)
+		}
+	}
+}
+
+func TestConfigMapIgnoresStaleTemplates(t *testing.T) {
+	kc := fake.NewSimpleClientset(&v1.ConfigMap{
+		ObjectMeta: v1meta.ObjectMeta{
+			Name:        DefaultName,
+			Namespace:   DefaultNamespace,
+			Annotations: map[string]string{PublishedAnnotation: time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339)},
+		},
+		Data: map[string]string{Key("europe-west2", "nodes"): "nodes-v2"},
+	})
+	api := staticSource{Key("europe-west2", "nodes"): "nodes-v1"}
+	cm := NewConfigMap(kc, DefaultNamespace, DefaultName, time.Hour, api)
+
+	template, err := cm.GroupTemplate(context.Background(), "europe-west2", "nodes")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if template != "nodes-v1" {
+		t.Errorf("expected stale configmap to be ignored, got %s", template)
+	}
+}